@@ -112,12 +112,21 @@ const connectIntifaceBtn = document.getElementById('connect-intiface');
 const shareSection = document.getElementById('share-section'); // 新增
 const shareLinkButton = document.getElementById('share-link-button'); // 新增
 const copyStatusElem = document.getElementById('copy-status'); // 新增
+const emergencyStopButton = document.getElementById('emergency-stop-button');
+const unlockButton = document.getElementById('unlock-button');
+const takeoverSection = document.getElementById('takeover-section');
+const takeoverApproveButton = document.getElementById('takeover-approve-button');
+const takeoverDenyButton = document.getElementById('takeover-deny-button');
 
 let serverWs = null;
 let controllerShareUrl = null; // 新增: 存储分享链接
 let intifaceWs = null;
 let targetDeviceIndex = null; // Store the target device index
+let knownDevices = new Map(); // All devices reported by Intiface, keyed by DeviceIndex
 let nextButtplugId = 2; // Start Buttplug message IDs from 2 (1 was used for handshake)
+const MAX_FORWARDED_COMMAND_IDS = 1024;
+let forwardedCommandIds = new Set(); // Server command IDs handed to Intiface, awaiting their Ok
+let roomLocked = false; // Set by our emergency stop, commands are not forwarded until unlocked
 
 // --- Reconnection State ---
 let reconnectAttempts = 0;
@@ -126,9 +135,70 @@ const maxReconnectAttempts = 10;
 const maxReconnectInterval = 30000; // 30 seconds
 let shouldReconnect = true; // Flag to control reconnection
 let heartbeatIntervalId = null; // For heartbeat timer
+let resumeToken = null; // From the server's "session" message, lets a reconnect keep the room state
+const CLOSE_UNAUTHORIZED = 4401; // Server close code for joins without a valid owner secret or invite
+const CLOSE_NO_RECONNECT = [4404, 4408, 4411]; // Unknown room key, room expired, removed by an operator
+let pendingTakeoverId = null; // Takeover request from a second controller awaiting our answer
+
+// --- Clock Synchronization State ---
+const TIME_SYNC_WINDOW = 8; // Exchanges kept, the one with the lowest round trip wins
+const TIME_SYNC_BURST = [0, 500, 1000]; // Delays of the exchanges right after connecting
+let timeSyncSamples = [];
+let clockOffsetMs = 0; // Server clock minus local clock
+let clockRttMs = null; // Round trip to the server, null until the first exchange finished
+
+// Sends a timeSync request; the server answers with its receive (t1) and send (t2) times
+function sendTimeSync() {
+    if (serverWs && serverWs.readyState === WebSocket.OPEN) {
+        serverWs.send(JSON.stringify({ type: "timeSync", t0: Date.now() }));
+    }
+}
+
+// Updates the clock estimate from a timeSync reply and reports the finished exchange back
+function handleTimeSyncReply(message) {
+    const t3 = Date.now();
+    const { t0, t1, t2 } = message;
+    timeSyncSamples.push({ offset: ((t1 - t0) + (t2 - t3)) / 2, rtt: (t3 - t0) - (t2 - t1) });
+    if (timeSyncSamples.length > TIME_SYNC_WINDOW) {
+        timeSyncSamples.shift();
+    }
+    const best = timeSyncSamples.reduce((a, b) => (b.rtt < a.rtt ? b : a));
+    clockOffsetMs = best.offset;
+    clockRttMs = best.rtt;
+    console.log(`Clock offset to server: ${clockOffsetMs.toFixed(1)}ms, round trip ${clockRttMs.toFixed(1)}ms`);
+    if (serverWs && serverWs.readyState === WebSocket.OPEN) {
+        serverWs.send(JSON.stringify({ type: "timeSync", t0, t1, t2, t3 })); // Lets the server know the offset too
+    }
+}
 
 // --- Server WebSocket Connection ---
 
+// Returns this browser's owner secret for a room key, creating it on first use. The first client with
+// a secret owns the room, and controllers then need an invite signed by the server.
+function getOwnerSecret(key) {
+    const storageKey = `remotetoys-owner:${key}`;
+    let secret = new URLSearchParams(window.location.search).get('owner'); // Client URL of a room created with POST /api/rooms
+    try {
+        if (secret) {
+            localStorage.setItem(storageKey, secret);
+        } else {
+            secret = localStorage.getItem(storageKey);
+        }
+    } catch (e) {
+        console.warn('localStorage unavailable, owner secret lasts for this page only:', e);
+    }
+    if (!secret) {
+        const bytes = crypto.getRandomValues(new Uint8Array(16));
+        secret = Array.from(bytes, b => b.toString(16).padStart(2, '0')).join('');
+        try {
+            localStorage.setItem(storageKey, secret);
+        } catch (e) {
+            // Keep the in-memory secret
+        }
+    }
+    return secret;
+}
+
 function connectToServer() {
     // 1. Get key from URL query parameters
     const urlParams = new URLSearchParams(window.location.search);
@@ -145,13 +215,15 @@ function connectToServer() {
 
     // 3. Construct WebSocket URL with key
     const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-    const serverUrl = `${protocol}//${window.location.host}/ws?type=client&key=${encodeURIComponent(key)}`;
+    let serverUrl = `${protocol}//${window.location.host}/ws?type=client&key=${encodeURIComponent(key)}&owner=${encodeURIComponent(getOwnerSecret(key))}`;
+    if (resumeToken) {
+        serverUrl += `&resume=${encodeURIComponent(resumeToken)}`;
+    }
     console.log(`Connecting to: ${serverUrl}`); // Log the full URL for debugging
     updateServerStatus('statusConnectingServer', 'connecting');
    
-    // 构建控制端分享链接
-    controllerShareUrl = `${window.location.origin}/controller/index.html?key=${encodeURIComponent(key)}`;
-    console.log(`Controller share URL: ${controllerShareUrl}`); // Log for debugging
+    // 控制端分享链接需要服务器签发的邀请，连接后再生成
+    controllerShareUrl = null;
 
     serverWs = new WebSocket(serverUrl);
 
@@ -178,9 +250,38 @@ function connectToServer() {
     	    if (serverWs && serverWs.readyState === WebSocket.OPEN) {
     	        serverWs.send(JSON.stringify({ type: "ping" }));
     	        console.log('Sent heartbeat ping to server');
+    	        sendTimeSync(); // Keep the clock estimate fresh
     	    }
     	}, 10000); // Send heartbeat every 10 seconds
     	
+    	// Ask for a controller invite for the share link
+    	serverWs.send(JSON.stringify({ type: "createInvite" }));
+    	
+    	// What happens when a second controller joins: replace, reject, approve or queue (?takeover=...)
+    	const takeoverPolicy = urlParams.get('takeover');
+    	if (takeoverPolicy) {
+    	    serverWs.send(JSON.stringify({ type: "takeoverPolicy", policy: takeoverPolicy }));
+    	}
+    	
+    	// Let several controllers share the room: turns, average or priority (?arbitration=..., ?turnSec=...)
+    	const arbitrationMode = urlParams.get('arbitration');
+    	if (arbitrationMode) {
+    	    const turnSec = parseInt(urlParams.get('turnSec'), 10);
+    	    serverWs.send(JSON.stringify({ type: "arbitration", mode: arbitrationMode, turnMs: turnSec > 0 ? turnSec * 1000 : 0 }));
+    	}
+    	
+    	// Measure the clock offset to the server
+    	timeSyncSamples = [];
+    	TIME_SYNC_BURST.forEach(delay => setTimeout(sendTimeSync, delay));
+    	
+    	// Re-announce devices after a reconnect, the server forgets them unless the session is resumed
+    	if (knownDevices.size > 0) {
+    	    sendDeviceListToServer();
+    	}
+    	if (targetDeviceIndex !== null) {
+    	    sendDeviceIndexToServer(targetDeviceIndex);
+    	}
+    	
     	// 连接成功后显示分享按钮区域
     	if (shareSection) {
             shareSection.style.display = 'block';
@@ -189,10 +290,21 @@ function connectToServer() {
 
     serverWs.onmessage = (event) => {
     	try {
-    		const message = JSON.parse(event.data);
+    		const parsed = JSON.parse(event.data);
+    		// Server messages arrive wrapped in a single-element array, Buttplug commands are arrays without a type
+    		const message = (Array.isArray(parsed) && parsed.length === 1 && parsed[0].type) ? parsed[0] : parsed;
     		console.log('Message from server:', message);
    
-    		if (message.type === 'status') {
+    		if (message.type === 'timeSync') {
+    			handleTimeSyncReply(message);
+    		} else if (message.type === 'invite') {
+    			// 构建控制端分享链接
+    			controllerShareUrl = `${window.location.origin}/controller/index.html?key=${encodeURIComponent(key)}&invite=${encodeURIComponent(message.token)}`;
+    			console.log(`Controller share URL: ${controllerShareUrl}`); // Log for debugging
+    		} else if (message.type === 'session') {
+    			resumeToken = message.resumeToken;
+    			console.log(message.resumed ? 'Resumed previous session' : 'Started new session');
+    		} else if (message.type === 'status') {
     			// Handle status updates from server
     			switch (message.state) {
     				case 'controller_present':
@@ -212,24 +324,59 @@ function connectToServer() {
     					updateSessionStatus('statusControllerDisconnected', 'disconnected');
     					// Maybe revert to 'statusWaitingController' after a delay? Or just show disconnected.
     					break;
+    				case 'controller_reconnecting':
+    					// Controller dropped out, the server holds its place for a while
+    					updateSessionStatus('statusControllerReconnecting', 'connecting');
+    					break;
     				case 'ready':
     					// Everything is ready - controller connected, device selected
-    					updateSessionStatus('statusDeviceReady', 'connected');
+    					if (!roomLocked) {
+    						updateSessionStatus('statusDeviceReady', 'connected');
+    					}
+    					break;
+    				case 'locked':
+    					setLockedUi(true);
+    					break;
+    				case 'unlocked':
+    					setLockedUi(false);
+    					break;
+    				case 'takeover_request':
+    					// A second controller wants to take over, the server waits for our answer
+    					showTakeoverRequest(message.requestId);
+    					break;
+    				case 'takeover_cancelled':
+    					// The controller left or took over without our answer
+    					if (message.requestId === pendingTakeoverId) {
+    						answerTakeover(null);
+    					}
+    					break;
+    				case 'controllers':
+    					// Who shares the room and who is in control
+    					console.log(`Controllers (${message.arbitration}):`, (message.controllers || []).map(c => `${c.name || c.id}${c.active ? ' [active]' : ''}`).join(', '));
+    					break;
+    				case 'arbitration_invalid':
+    					console.warn(`Arbitration mode rejected: ${message.message}`);
     					break;
     				// Add other server-sent statuses if needed
     			}
+    		} else if (message.type) {
+    			// Informational server messages (device list, safety profile) are not for Intiface
+    			console.log(`Received '${message.type}' message from server`);
+    		} else if (roomLocked) {
+    			console.warn('Room is locked by emergency stop, command dropped.');
     		} else {
     			// Assume it's a Buttplug command for Intiface
     			console.log('Received Buttplug Command from server:', event.data);
-    			// Forward message to Intiface if connected AND we have a target device index
-    			if (intifaceWs && intifaceWs.readyState === WebSocket.OPEN && targetDeviceIndex !== null) {
+    			// Forward message to Intiface if connected AND we know at least one device
+    			if (intifaceWs && intifaceWs.readyState === WebSocket.OPEN && knownDevices.size > 0) {
     				try {
     					intifaceWs.send(event.data);
-    					console.log(`Forwarded command to Intiface (DeviceIndex ${targetDeviceIndex})`);
+    					console.log(`Forwarded command to Intiface (${knownDevices.size} known device(s))`);
+    					ackForwardedCommands(parsed);
     				} catch (e) {
     					console.error("Error forwarding message to Intiface:", e);
     				}
-    			} else if (targetDeviceIndex === null) {
+    			} else if (knownDevices.size === 0) {
     				console.warn('Target device index not yet known, command dropped.');
     			} else {
     				console.warn('Intiface not connected, command dropped.');
@@ -255,6 +402,19 @@ function connectToServer() {
     	    heartbeatIntervalId = null;
     	}
     	
+    	if (event.code === CLOSE_UNAUTHORIZED) {
+    	    // Another owner holds this room, reconnecting would be rejected again
+    	    shouldReconnect = false;
+    	    updateServerStatus('statusUnauthorized', 'disconnected', event.reason);
+    	    return;
+    	}
+    	if (CLOSE_NO_RECONNECT.includes(event.code)) {
+    	    // The room key is gone or an operator removed us, reconnecting would be rejected or kicked again
+    	    shouldReconnect = false;
+    	    updateServerStatus('statusClosedByServer', 'disconnected', event.reason);
+    	    return;
+    	}
+    	
     	// Implement auto-reconnect with exponential backoff
     	if (shouldReconnect && reconnectAttempts < maxReconnectAttempts) {
     	    reconnectAttempts++;
@@ -344,8 +504,18 @@ function connectToIntiface() {
             messages.forEach(msgContainer => {
                 if (msgContainer.Ok) {
                     console.log(`Intiface OK for Id: ${msgContainer.Ok.Id}`);
+                    if (forwardedCommandIds.delete(msgContainer.Ok.Id)) {
+                        sendCommandAck(msgContainer.Ok.Id, 'ok');
+                    }
                 } else if (msgContainer.Error) {
                     console.error(`Intiface Error: ${msgContainer.Error.ErrorMessage} (Code: ${msgContainer.Error.ErrorCode}, Id: ${msgContainer.Error.Id})`);
+                    if (forwardedCommandIds.delete(msgContainer.Error.Id)) {
+                        // The server tells the controller which of its commands failed
+                        sendCommandAck(msgContainer.Error.Id, 'error', {
+                            errorCode: msgContainer.Error.ErrorCode,
+                            errorMessage: msgContainer.Error.ErrorMessage
+                        });
+                    }
                 } else if (msgContainer.ServerInfo) {
                     console.log(`Intiface ServerInfo: Name=${msgContainer.ServerInfo.ServerName}, Version=${msgContainer.ServerInfo.MessageVersion}`);
                     // Request Device List after getting ServerInfo
@@ -358,10 +528,14 @@ function connectToIntiface() {
                      const devices = msgContainer.DeviceList.Devices;
                      console.log(`Intiface DeviceList: ${devices.length} devices found.`);
                      console.log(devices); // Log the full device list for debugging
+                     knownDevices = new Map(devices.map(d => [d.DeviceIndex, d]));
+                     sendDeviceListToServer();
                      processDeviceList(devices);
 
                 } else if (msgContainer.DeviceAdded) {
                     console.log(`Intiface DeviceAdded: Name=${msgContainer.DeviceAdded.DeviceName}, Index=${msgContainer.DeviceAdded.DeviceIndex}`);
+                    knownDevices.set(msgContainer.DeviceAdded.DeviceIndex, msgContainer.DeviceAdded);
+                    sendDeviceListToServer();
                     // If we don't have a target device yet, try using this new one
                     if (targetDeviceIndex === null) {
                         console.log("Attempting to use newly added device.");
@@ -373,13 +547,20 @@ function connectToIntiface() {
                 } else if (msgContainer.DeviceRemoved) {
                     const removedIndex = msgContainer.DeviceRemoved.DeviceIndex;
                     console.log(`Intiface DeviceRemoved: Index=${removedIndex}`);
-                    if (targetDeviceIndex === removedIndex) {
+                    knownDevices.delete(removedIndex);
+                    const targetRemoved = targetDeviceIndex === removedIndex;
+                    if (targetRemoved) {
                         console.log("Target device was removed!");
                         targetDeviceIndex = null;
                         // Notify server that the device is gone
                         sendDeviceIndexToServer(null);
                         updateSessionStatus('statusIntifaceStatusTargetRemoved', 'disconnected');
                        }
+                    sendDeviceListToServer();
+                    // Fall back to any remaining device
+                    if (targetRemoved && knownDevices.size > 0) {
+                        processDeviceList(Array.from(knownDevices.values()));
+                    }
                        // TODO: Update UI to remove device
                 }
                 // Add handling for other message types like ScanningFinished if needed
@@ -409,6 +590,7 @@ function connectToIntiface() {
         	 updateSessionStatus('statusDisconnectedIntiface', 'disconnected');
         }
         intifaceWs = null;
+        knownDevices.clear();
        };
 }
 
@@ -427,6 +609,59 @@ function sendToIntiface(msgObject) {
     }
 }
 
+// --- Emergency Stop ---
+
+// Stops all devices locally right away and asks the server to lock the room
+function handleEmergencyStop() {
+    sendToIntiface([{ "StopAllDevices": { "Id": nextButtplugId++ } }]);
+    setLockedUi(true);
+    if (serverWs && serverWs.readyState === WebSocket.OPEN) {
+        serverWs.send(JSON.stringify({ type: "emergencyStop" }));
+        console.log('Sent emergencyStop to server');
+    }
+}
+
+// Asks the server to accept controller commands again
+function handleUnlock() {
+    if (serverWs && serverWs.readyState === WebSocket.OPEN) {
+        serverWs.send(JSON.stringify({ type: "unlock" }));
+        console.log('Sent unlock to server');
+    } else {
+        console.warn('Cannot unlock, server not connected.');
+    }
+}
+
+// --- Controller Takeover ---
+
+function showTakeoverRequest(requestId) {
+    pendingTakeoverId = requestId;
+    if (takeoverSection) {
+        takeoverSection.style.display = 'block';
+    }
+}
+
+// Answers the pending takeover request (null just dismisses it); the server denies it by itself if we don't answer in time
+function answerTakeover(approve) {
+    if (approve !== null && pendingTakeoverId !== null && serverWs && serverWs.readyState === WebSocket.OPEN) {
+        serverWs.send(JSON.stringify({ type: "takeoverDecision", requestId: pendingTakeoverId, approve: approve }));
+        console.log(`Sent takeover decision for request ${pendingTakeoverId}: ${approve ? 'approved' : 'denied'}`);
+    }
+    pendingTakeoverId = null;
+    if (takeoverSection) {
+        takeoverSection.style.display = 'none';
+    }
+}
+
+function setLockedUi(locked) {
+    roomLocked = locked;
+    if (unlockButton) {
+        unlockButton.style.display = locked ? 'inline-block' : 'none';
+    }
+    if (locked) {
+        updateSessionStatus('statusLocked', 'disconnected');
+    }
+}
+
 // Processes the device list (or a single added device) to find a target
 function processDeviceList(devices) {
      if (targetDeviceIndex !== null) {
@@ -477,6 +712,72 @@ function sendDeviceIndexToServer(index) {
     }
 }
 
+// Counts the actuators a device exposes for one Buttplug message
+// (v3 attribute arrays, or v2 objects with FeatureCount)
+function countFeatures(deviceMessages, msgName) {
+    const attrs = deviceMessages ? deviceMessages[msgName] : null;
+    if (!attrs) return 0;
+    if (Array.isArray(attrs)) return attrs.length;
+    return attrs.FeatureCount || 0;
+}
+
+// Converts an Intiface device entry into the device info our Go server expects
+function describeDevice(device) {
+    const msgs = device.DeviceMessages || {};
+    const scalars = Array.isArray(msgs.ScalarCmd) ? msgs.ScalarCmd : [];
+    return {
+        index: device.DeviceIndex,
+        name: device.DeviceName,
+        linearCount: countFeatures(msgs, 'LinearCmd'),
+        vibrateCount: scalars.filter(s => s.ActuatorType === 'Vibrate').length || countFeatures(msgs, 'VibrateCmd'),
+        rotateCount: countFeatures(msgs, 'RotateCmd'),
+        scalarCount: countFeatures(msgs, 'ScalarCmd')
+    };
+}
+
+// Acknowledges a server command stage ("forwarded" to Intiface, or Intiface's "ok"/"error" reply)
+function sendCommandAck(id, stage, details = {}) {
+    if (serverWs && serverWs.readyState === WebSocket.OPEN) {
+        serverWs.send(JSON.stringify({ type: "commandAck", id: id, stage: stage, at: Date.now(), ...details }));
+    }
+}
+
+// Acknowledges every command in a server message handed to Intiface and remembers their IDs until Intiface's Ok
+function ackForwardedCommands(commands) {
+    if (!Array.isArray(commands)) {
+        return;
+    }
+    commands.forEach(container => {
+        Object.values(container).forEach(command => {
+            if (command && command.Id !== undefined) {
+                if (forwardedCommandIds.size >= MAX_FORWARDED_COMMAND_IDS) {
+                    forwardedCommandIds.clear(); // Intiface never answered these
+                }
+                forwardedCommandIds.add(command.Id);
+                sendCommandAck(command.Id, 'forwarded');
+            }
+        });
+    });
+}
+
+// Sends the full list of known devices to our Go server
+function sendDeviceListToServer() {
+    if (serverWs && serverWs.readyState === WebSocket.OPEN) {
+        const msg = {
+            type: "deviceList",
+            devices: Array.from(knownDevices.values()).map(describeDevice)
+        };
+        try {
+            serverWs.send(JSON.stringify(msg));
+            console.log("Sent device list to server:", msg);
+        } catch (e) {
+            console.error("Error sending device list to server:", e);
+        }
+    } else {
+        console.warn("Cannot send device list, server not connected.");
+    }
+}
+
 // REMOVED updateIntifaceStatus function
 
 // --- Helper Functions ---
@@ -553,6 +854,10 @@ document.addEventListener('DOMContentLoaded', async () => {
     // 4. Add event listeners AFTER translation
     connectIntifaceBtn.addEventListener('click', connectToIntiface);
     shareLinkButton.addEventListener('click', handleShareLink);
+    emergencyStopButton.addEventListener('click', handleEmergencyStop);
+    unlockButton.addEventListener('click', handleUnlock);
+    takeoverApproveButton.addEventListener('click', () => answerTakeover(true));
+    takeoverDenyButton.addEventListener('click', () => answerTakeover(false));
 
     // 5. Add Language Switch Button Listeners
     const langSwitchEn = document.getElementById('lang-switch-en');
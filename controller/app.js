@@ -117,6 +117,7 @@ const i18n = {
 // --- DOM Elements ---
 const serverStatusElem = document.getElementById('server-status');
 const sessionStatusElem = document.getElementById('session-status'); // NEW: Session status indicator
+const controllersRosterElem = document.getElementById('controllers-roster');
 // const strokeSlider = document.getElementById('stroke-slider'); // REMOVED
 const verticalSliderContainer = document.getElementById('vertical-slider-container'); // NEW
 const sleeveElem = document.getElementById('sleeve'); // NEW
@@ -152,10 +153,44 @@ let reconnectTimeoutId = null;
 const maxReconnectAttempts = 10;
 const maxReconnectInterval = 30000; // 30 seconds
 let shouldReconnect = true; // Flag to control reconnection
+let resumeToken = null; // From the server's "session" message, lets a reconnect keep the room state
+const CLOSE_UNAUTHORIZED = 4401; // Server close code for joins without a valid invite
+const CLOSE_NO_RECONNECT = [4403, 4404, 4408, 4409, 4410, 4411]; // Takeover denied, unknown room key, room expired, room occupied, replaced by another controller, removed by an operator
 
 // --- Heartbeat State ---
 let heartbeatIntervalId = null;
 
+// --- Clock Synchronization State ---
+const TIME_SYNC_WINDOW = 8; // Exchanges kept, the one with the lowest round trip wins
+const TIME_SYNC_BURST = [0, 500, 1000]; // Delays of the exchanges right after connecting
+let timeSyncSamples = [];
+let clockOffsetMs = 0; // Server clock minus local clock
+let clockRttMs = null; // Round trip to the server, null until the first exchange finished
+
+// Sends a timeSync request; the server answers with its receive (t1) and send (t2) times
+function sendTimeSync() {
+    if (serverWs && serverWs.readyState === WebSocket.OPEN) {
+        serverWs.send(JSON.stringify({ type: "timeSync", t0: Date.now() }));
+    }
+}
+
+// Updates the clock estimate from a timeSync reply and reports the finished exchange back
+function handleTimeSyncReply(message) {
+    const t3 = Date.now();
+    const { t0, t1, t2 } = message;
+    timeSyncSamples.push({ offset: ((t1 - t0) + (t2 - t3)) / 2, rtt: (t3 - t0) - (t2 - t1) });
+    if (timeSyncSamples.length > TIME_SYNC_WINDOW) {
+        timeSyncSamples.shift();
+    }
+    const best = timeSyncSamples.reduce((a, b) => (b.rtt < a.rtt ? b : a));
+    clockOffsetMs = best.offset;
+    clockRttMs = best.rtt;
+    console.log(`Clock offset to server: ${clockOffsetMs.toFixed(1)}ms, round trip ${clockRttMs.toFixed(1)}ms`);
+    if (serverWs && serverWs.readyState === WebSocket.OPEN) {
+        serverWs.send(JSON.stringify({ type: "timeSync", t0, t1, t2, t3 })); // Lets the server know the offset too
+    }
+}
+
 // --- Momentum State ---
 let momentumIntervalId = null;
 let lastCalculatedSpeed = 0; // Store last speed for momentum calculation
@@ -195,7 +230,21 @@ function connectToServer() {
 
     // 3. Construct WebSocket URL with key
     const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-    const serverUrl = `${protocol}//${window.location.host}/ws?type=controller&key=${encodeURIComponent(key)}`;
+    let serverUrl = `${protocol}//${window.location.host}/ws?type=controller&key=${encodeURIComponent(key)}`;
+    const invite = urlParams.get('invite'); // From the client's share link, required for protected rooms
+    if (invite) {
+        serverUrl += `&invite=${encodeURIComponent(invite)}`;
+    }
+    // Identity shown to the other controllers when the room has several
+    for (const param of ['name', 'priority']) {
+        const value = urlParams.get(param);
+        if (value) {
+            serverUrl += `&${param}=${encodeURIComponent(value)}`;
+        }
+    }
+    if (resumeToken) {
+        serverUrl += `&resume=${encodeURIComponent(resumeToken)}`;
+    }
     console.log(`Connecting to: ${serverUrl}`); // Log the full URL for debugging
     updateServerStatus('statusConnecting', 'connecting', key); // Use key and pass argument
 
@@ -220,17 +269,32 @@ function connectToServer() {
                 const pingMsg = { type: "ping" };
                 serverWs.send(JSON.stringify(pingMsg));
                 console.log('Sent heartbeat ping to server');
+                sendTimeSync(); // Keep the clock estimate fresh
             }
         }, 10000); // Send ping every 10 seconds
+
+        // Measure the clock offset to the server
+        timeSyncSamples = [];
+        TIME_SYNC_BURST.forEach(delay => setTimeout(sendTimeSync, delay));
     };
 
     serverWs.onmessage = (event) => {
     	try {
-    		const message = JSON.parse(event.data);
+    		const parsed = JSON.parse(event.data);
+    		// Server messages arrive wrapped in a single-element array
+    		const message = (Array.isArray(parsed) && parsed.length === 1) ? parsed[0] : parsed;
     		console.log('Message from server:', message);
    
-    		if (message.type === 'status') {
-    			updateSessionStatus(message.state);
+    		if (message.type === 'timeSync') {
+    			handleTimeSyncReply(message);
+    		} else if (message.type === 'session') {
+    			resumeToken = message.resumeToken;
+    			console.log(message.resumed ? 'Resumed previous session' : 'Started new session');
+    		} else if (message.type === 'status') {
+    			if (message.state === 'device_error') {
+    				console.warn(`Intiface rejected ${message.command} for device ${message.deviceIndex}: ${message.message} (${message.errorType})`);
+    			}
+    			updateSessionStatus(message.state, message);
     		} else {
     			console.log('Received non-status message:', message);
     		}
@@ -254,6 +318,19 @@ function connectToServer() {
             heartbeatIntervalId = null;
         }
         
+        if (event.code === CLOSE_UNAUTHORIZED) {
+            // Missing, invalid or expired invite, reconnecting would be rejected again
+            shouldReconnect = false;
+            updateServerStatus('statusUnauthorized', 'disconnected', event.reason);
+            return;
+        }
+        if (CLOSE_NO_RECONNECT.includes(event.code)) {
+            // Another controller holds the room or the room is gone, reconnecting would take it back or be refused again
+            shouldReconnect = false;
+            updateServerStatus('statusClosedByServer', 'disconnected', event.reason);
+            return;
+        }
+
         // Implement auto-reconnect with exponential backoff
         if (shouldReconnect && reconnectAttempts < maxReconnectAttempts) {
             reconnectAttempts++;
@@ -454,7 +531,8 @@ function sendControlCommand(position, speed, isFinal = false) {
         type: "control",
         position: finalPos,
         speed: finalSpeed,
-        sampleIntervalMs: currentSampleIntervalMs // Send interval for server context
+        sampleIntervalMs: currentSampleIntervalMs, // Send interval for server context
+        sentAt: Date.now() // For the server's latency stats and jitter buffer
     };
     
     // Add isFinal flag if it's true
@@ -940,11 +1018,39 @@ document.addEventListener('DOMContentLoaded', async () => {
     // 6. Connect to server
     connectToServer();
 });
+// --- Controllers Roster ---
+function updateControllersRoster(message) {
+    if (!controllersRosterElem) return;
+    const controllers = message.controllers || [];
+    if (!message.arbitration || controllers.length === 0) {
+        controllersRosterElem.style.display = 'none';
+        return;
+    }
+
+    const entries = controllers.map(c => {
+        let entry = c.name || c.id;
+        if (c.id === message.self) {
+            entry = i18n.t('rosterSelf', entry);
+        }
+        if (c.active) {
+            entry = i18n.t('rosterActive', entry);
+        }
+        if (c.turnEndsAt) {
+            const seconds = Math.max(0, Math.round((c.turnEndsAt - Date.now()) / 1000));
+            entry += ' ' + i18n.t('rosterTurnEnds', seconds);
+        }
+        return entry;
+    });
+    controllersRosterElem.textContent = i18n.t('rosterLabel', i18n.t('arbitration' + message.arbitration[0].toUpperCase() + message.arbitration.slice(1))) + ' ' + entries.join(', ');
+    controllersRosterElem.style.display = '';
+}
+
 // --- Session Status Update ---
-function updateSessionStatus(state) {
+function updateSessionStatus(state, message = {}) {
     if (!sessionStatusElem) return;
 
     let i18nKey = '';
+    let i18nArgs = [];
     let cssClass = 'status-unknown'; // Default class
 
     switch (state) {
@@ -964,6 +1070,41 @@ function updateSessionStatus(state) {
             i18nKey = 'statusClientDisconnected';
             cssClass = 'status-disconnected';
             break;
+        case 'takeover_pending':
+            i18nKey = 'statusTakeoverPending';
+            cssClass = 'status-waiting';
+            break;
+        case 'controller_queued':
+            i18nKey = 'statusControllerQueued';
+            i18nArgs = [message.queuePosition];
+            cssClass = 'status-waiting';
+            break;
+        case 'client_reconnecting': // The server holds the client's devices until it is back or the grace period ends
+            i18nKey = 'statusClientReconnecting';
+            cssClass = 'status-waiting';
+            break;
+        case 'locked':
+            i18nKey = 'statusLocked';
+            cssClass = 'status-disconnected';
+            break;
+        case 'unlocked': // Followed by the current ready/waiting_toy state
+        case 'safety_violation': // Informational, the session state is unchanged
+        case 'watchdog_stop':
+        case 'playback_error':
+        case 'recording_error':
+        case 'pattern_error':
+        case 'jitter_buffer':
+        case 'jitter_buffer_disabled':
+        case 'device_error':
+        case 'client_backlog':
+        case 'client_reconnected': // Followed by the current ready/waiting_toy/locked state
+        case 'turn_change': // Followed by a 'controllers' update naming the new turn holder
+        case 'admin_stop': // An operator stopped the devices
+            console.log(`Session notice received by controller: ${state}`);
+            return;
+        case 'controllers':
+            updateControllersRoster(message);
+            return;
         case 'client_connected': // Intermediate state, often quickly followed by waiting_toy or ready
              // Let's show waiting_toy as it's the most likely next step needed from client.
             i18nKey = 'statusWaitingToy';
@@ -981,7 +1122,7 @@ function updateSessionStatus(state) {
     }
 
     // Update text using i18n
-    sessionStatusElem.textContent = i18n.t(i18nKey);
+    sessionStatusElem.textContent = i18n.t(i18nKey, ...i18nArgs);
     // Update class for styling (remove old status classes first)
     sessionStatusElem.classList.remove('status-waiting', 'status-ready', 'status-disconnected', 'status-unknown');
     sessionStatusElem.classList.add(cssClass);
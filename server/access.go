@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// closeUnauthorized is the WebSocket close code for joins without a valid owner secret or invite.
+// Clients should not reconnect automatically after receiving it.
+const closeUnauthorized = 4401
+
+var (
+	inviteSecret   []byte        // HMAC key for invite tokens, random per process unless -invite-secret is set
+	maxInviteTTL   time.Duration // Longest validity of an invite token
+	requireInvites bool          // Only clients with an owner secret create rooms, controllers always need an invite
+)
+
+// InviteMessage answers a client's "createInvite" with a signed token for the controller share link.
+type InviteMessage struct {
+	Type      string `json:"type"`      // Always "invite"
+	Token     string `json:"token"`     // Pass as ?invite= when joining as controller
+	ExpiresAt int64  `json:"expiresAt"` // Unix ms
+}
+
+// initInviteSecret sets the HMAC key for invite tokens. Without a configured secret, invites stop
+// working when the server restarts.
+func initInviteSecret(secret string) {
+	if secret != "" {
+		inviteSecret = []byte(secret)
+		return
+	}
+	inviteSecret = make([]byte, 32)
+	rand.Read(inviteSecret)
+}
+
+// hashOwnerSecret returns what a room keeps of its owner secret.
+func hashOwnerSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// inviteSignature signs a room key and expiry. The owner hash is part of the signature, so a room
+// recreated under a different owner does not accept old invites.
+func inviteSignature(key string, owner []byte, expires int64) []byte {
+	mac := hmac.New(sha256.New, inviteSecret)
+	fmt.Fprintf(mac, "%s\n%x\n%d", key, owner, expires)
+	return mac.Sum(nil)
+}
+
+// newInvite creates an invite token for a room, valid for ttl (capped at maxInviteTTL).
+// Tokens have the form "<expiry unix seconds>.<base64url HMAC>".
+func newInvite(key string, owner []byte, ttl time.Duration) (string, time.Time) {
+	if ttl <= 0 || ttl > maxInviteTTL {
+		ttl = maxInviteTTL
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	signature := inviteSignature(key, owner, expires.Unix())
+	return strconv.FormatInt(expires.Unix(), 10) + "." + base64.RawURLEncoding.EncodeToString(signature), expires
+}
+
+// checkInvite verifies an invite token for a room.
+func checkInvite(key string, owner []byte, token string) error {
+	if token == "" {
+		return errors.New("invite required")
+	}
+	expiryText, signatureText, ok := strings.Cut(token, ".")
+	expires, err := strconv.ParseInt(expiryText, 10, 64)
+	if !ok || err != nil {
+		return errors.New("malformed invite")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(signatureText)
+	if err != nil || !hmac.Equal(signature, inviteSignature(key, owner, expires)) {
+		return errors.New("invalid invite")
+	}
+	if time.Now().Unix() > expires {
+		return errors.New("invite expired")
+	}
+	return nil
+}
+
+// authorizeJoin decides whether a connection may join the room for key; room is nil if it does not
+// exist yet. A client that brings an owner secret to an unowned room claims it; the connections the
+// claim evicts are returned for the caller to close once it released roomsMu. Caller must hold
+// roomsMu; authorizeJoin locks the room itself.
+func authorizeJoin(room *Room, key string, clientType string, owner string, invite string) (evicted []*Client, err error) {
+	if room == nil {
+		if requireInvites && (clientType != "client" || owner == "") {
+			return nil, errors.New("room does not exist")
+		}
+		return nil, nil
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if room.owner == nil {
+		if requireInvites {
+			return nil, errors.New("room has no owner")
+		}
+		if clientType == "client" && owner != "" {
+			return room.claim(owner), nil
+		}
+		return nil, nil
+	}
+
+	if clientType == "client" {
+		if subtle.ConstantTimeCompare(hashOwnerSecret(owner), room.owner) != 1 {
+			return nil, errors.New("owner secret required")
+		}
+		return nil, nil
+	}
+	return nil, checkInvite(key, room.owner, invite)
+}
+
+// authorizeRequest decides whether an HTTP API request may act on the room for key, with the same
+// rules as a controller joining it: an invite (?invite=) once the room is owned. The owner secret
+// (?owner=) and the admin token are accepted as well and make the request privileged, i.e. not
+// subject to the room's takeover policy. Caller must hold roomsMu.
+func authorizeRequest(room *Room, key string, r *http.Request) (privileged bool, err error) {
+	if isAdminRequest(r) {
+		return true, nil
+	}
+	query := r.URL.Query()
+	if owner := query.Get("owner"); owner != "" && room != nil {
+		room.mu.RLock()
+		owned := room.owner != nil && subtle.ConstantTimeCompare(hashOwnerSecret(owner), room.owner) == 1
+		room.mu.RUnlock()
+		if owned {
+			return true, nil
+		}
+	}
+	_, err = authorizeJoin(room, key, "controller", "", query.Get("invite")) // Controllers never claim a room
+	return false, err
+}
+
+// claim protects an unowned room with the owner secret. Everyone but the client joined while the
+// room was open and has no invite: claim returns those connections (controllers, waiting
+// controllers and spectators) to be sent away with closeEvicted. Caller must hold r.mu.
+func (r *Room) claim(owner string) []*Client {
+	r.owner = hashOwnerSecret(owner)
+	log.Printf("Key %s: Room claimed by its owner", r.key)
+	evicted := append(r.controllerTargets(), r.spectatorList()...)
+	for _, w := range r.waiting {
+		evicted = append(evicted, w.client)
+	}
+	return evicted
+}
+
+// closeEvicted closes the connections a claim sent away. Caller must not hold r.mu or roomsMu.
+func closeEvicted(evicted []*Client) {
+	for _, c := range evicted {
+		c.closeWith(closeUnauthorized, "room is now protected, invite required")
+	}
+}
+
+// handleCreateInvite answers the owner's "createInvite" with a signed invite for a controller.
+func (r *Room) handleCreateInvite(client *Client, msg *MessageFromClient) {
+	r.mu.RLock()
+	owner := r.owner
+	r.mu.RUnlock()
+	if owner == nil {
+		r.sendStatusUpdate(client, "invite_error", "room has no owner secret")
+		return
+	}
+
+	token, expires := newInvite(r.key, owner, time.Duration(msg.TTLSec)*time.Second)
+	log.Printf("Key %s: Created controller invite valid until %s", r.key, expires.Format(time.RFC3339))
+	r.sendMessage(client, InviteMessage{Type: "invite", Token: token, ExpiresAt: expires.UnixMilli()}, "invite")
+}
+
+// closeWith sends a close frame with code and reason, then closes the connection. Safe to call
+// concurrently with writePump.
+func (c *Client) closeWith(code int, reason string) {
+	rejectConnection(c.conn, code, reason)
+}
+
+// rejectConnection closes an upgraded connection with a close code and reason.
+func rejectConnection(ws *websocket.Conn, code int, reason string) {
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	ws.Close()
+}
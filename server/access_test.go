@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestInvites(t *testing.T) {
+	owner := hashOwnerSecret("owner-secret")
+	invite, expires := newInvite("invites", owner, time.Minute)
+	if err := checkInvite("invites", owner, invite); err != nil {
+		t.Fatalf("a fresh invite was refused: %v", err)
+	}
+	if time.Until(expires) > time.Minute {
+		t.Fatalf("invite expires at %v, later than its ttl", expires)
+	}
+	if err := checkInvite("other-room", owner, invite); err == nil {
+		t.Fatal("an invite was accepted for another room")
+	}
+	if err := checkInvite("invites", hashOwnerSecret("new-owner"), invite); err == nil {
+		t.Fatal("an invite was accepted after the room changed owner")
+	}
+	if err := checkInvite("invites", owner, ""); err == nil {
+		t.Fatal("a missing invite was accepted")
+	}
+
+	capped, _ := newInvite("invites", owner, -time.Minute) // A non-positive ttl means maxInviteTTL
+	if err := checkInvite("invites", owner, capped); err != nil {
+		t.Fatalf("an invite with a non-positive ttl was refused: %v", err)
+	}
+}
+
+func TestOwnedRoomNeedsInvite(t *testing.T) {
+	srv := newTestServer(t)
+	client := dial(t, srv, "type=client&key=owned&owner=secret")
+	waitStatus(t, client, "waiting_controller")
+	room := lookupRoom("owned")
+
+	if code := waitClose(t, dial(t, srv, "type=controller&key=owned")); code != closeUnauthorized {
+		t.Fatalf("controller without invite closed with %d, want %d", code, closeUnauthorized)
+	}
+	if code := waitClose(t, dial(t, srv, "type=client&key=owned&owner=wrong")); code != closeUnauthorized {
+		t.Fatalf("client with the wrong secret closed with %d, want %d", code, closeUnauthorized)
+	}
+
+	room.mu.RLock()
+	invite, _ := newInvite("owned", room.owner, time.Minute)
+	room.mu.RUnlock()
+	controller := dial(t, srv, "type=controller&key=owned&invite="+url.QueryEscape(invite))
+	waitStatus(t, controller, "waiting_toy")
+	waitStatus(t, client, "controller_present")
+}
+
+func TestClaimEvictsEveryoneWithoutInvite(t *testing.T) {
+	defaultTakeoverPolicy = "queue"
+	t.Cleanup(func() { defaultTakeoverPolicy = "replace" })
+	srv := newTestServer(t)
+	controller := dial(t, srv, "type=controller&key=claim")
+	waitStatus(t, controller, "waiting_client")
+	queued := dial(t, srv, "type=controller&key=claim")
+	waitStatus(t, queued, "controller_queued")
+	spectator := dial(t, srv, "type=spectator&key=claim")
+	readUntil(t, spectator, 2*time.Second, func(msg map[string]json.RawMessage) bool { return string(msg["type"]) == `"devices"` })
+
+	dial(t, srv, "type=client&key=claim&owner=secret")
+	for name, ws := range map[string]*websocket.Conn{"controller": controller, "queued controller": queued, "spectator": spectator} {
+		if code := waitClose(t, ws); code != closeUnauthorized {
+			t.Errorf("%s closed with %d, want %d", name, code, closeUnauthorized)
+		}
+	}
+
+	room := lookupRoom("claim")
+	eventually(t, 2*time.Second, "the evicted connections to leave", func() bool {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return room.clientConnected && !room.controllerConnected && len(room.waiting) == 0 && len(room.spectators) == 0
+	})
+}
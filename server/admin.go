@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// closeKicked is the WebSocket close code for connections an operator removed. Clients should not
+// reconnect automatically after receiving it.
+const closeKicked = 4411
+
+// adminToken authorizes the admin API as "Authorization: Bearer <token>"; the API is disabled when empty.
+var adminToken string
+
+// AdminRoomInfo describes a room in the admin API.
+type AdminRoomInfo struct {
+	Key            string                        `json:"key"`
+	Owned          bool                          `json:"owned"`   // Protected by an owner secret
+	Created        bool                          `json:"created"` // Key issued by POST /api/rooms
+	Locked         bool                          `json:"locked"`
+	DeviceIndex    *uint32                       `json:"deviceIndex"` // Default device, nil if none selected
+	Devices        []DeviceInfo                  `json:"devices"`
+	Positions      map[uint32]map[uint32]float64 `json:"positions"` // Last commanded position per device index and axis index
+	TakeoverPolicy string                        `json:"takeoverPolicy"`
+	Arbitration    string                        `json:"arbitration,omitempty"`
+	Connections    []AdminConnectionInfo         `json:"connections"`
+}
+
+// AdminConnectionInfo describes one connection of a room in the admin API.
+type AdminConnectionInfo struct {
+	ID          string `json:"id"`   // Pass as ?id= to kick it
+	Role        string `json:"role"` // "client", "controller", "waiting_controller" or "spectator"
+	Name        string `json:"name,omitempty"`
+	Active      bool   `json:"active,omitempty"` // A controller whose input drives the devices
+	ConnectedAt int64  `json:"connectedAt"`      // Unix ms
+	AgeSec      int64  `json:"ageSec"`
+	LastPingAt  int64  `json:"lastPingAt,omitempty"` // Unix ms, clients and controllers only
+	Received    uint64 `json:"received"`             // Messages read from the connection
+	Sent        uint64 `json:"sent"`                 // Messages written to the connection
+	Remote      string `json:"remote"`
+}
+
+// handleAdmin serves the admin API:
+//
+//	GET  /api/admin/rooms                        lists the rooms (?key= for one room)
+//	POST /api/admin/rooms/stop?key=&device=&lock= stops one device (all without ?device=), lock=1 also locks the room
+//	POST /api/admin/rooms/kick?key=&id=          disconnects a participant
+//	POST /api/admin/rooms/close?key=             stops the devices, disconnects everyone and forgets the room
+func handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if adminToken == "" {
+		http.Error(w, "admin API is disabled on this server", http.StatusNotFound)
+		return
+	}
+	if !isAdminRequest(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodGet && r.URL.Path == "/api/admin/rooms" {
+		listRooms(w, r.URL.Query().Get("key"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	roomsMu.RLock()
+	room, ok := rooms[key]
+	roomsMu.RUnlock()
+	if key == "" || !ok {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/admin/rooms/stop":
+		var device *uint32
+		if value := r.URL.Query().Get("device"); value != "" {
+			index, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				http.Error(w, "invalid device index", http.StatusBadRequest)
+				return
+			}
+			device = new(uint32)
+			*device = uint32(index)
+		}
+		room.adminStop(device, r.URL.Query().Get("lock") == "1")
+
+	case "/api/admin/rooms/kick":
+		if !room.kick(r.URL.Query().Get("id")) {
+			http.Error(w, "no such connection", http.StatusNotFound)
+			return
+		}
+
+	case "/api/admin/rooms/close":
+		closeRoom(room)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isAdminRequest reports whether r carries the admin token.
+func isAdminRequest(r *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// listRooms writes the admin view of every room, or only of the room with key.
+func listRooms(w http.ResponseWriter, key string) {
+	roomsMu.RLock()
+	list := make([]*Room, 0, len(rooms))
+	created := make(map[*Room]bool, len(rooms))
+	for roomKey, room := range rooms {
+		if key == "" || roomKey == key {
+			list = append(list, room)
+			created[room] = createdRooms[roomKey] != nil
+		}
+	}
+	roomsMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].key < list[j].key })
+
+	infos := make([]AdminRoomInfo, 0, len(list))
+	for _, room := range list {
+		info := room.adminInfo()
+		info.Created = created[room]
+		infos = append(infos, info)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"rooms": infos})
+}
+
+// adminInfo describes the room and its connections.
+func (r *Room) adminInfo() AdminRoomInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	info := AdminRoomInfo{
+		Key:            r.key,
+		Owned:          r.owner != nil,
+		Locked:         r.locked,
+		DeviceIndex:    r.clientDeviceIndex,
+		Devices:        r.deviceListMessage().Devices,
+		Positions:      make(map[uint32]map[uint32]float64, len(r.lastCommandedPositions)),
+		TakeoverPolicy: r.takeoverPolicy(),
+		Arbitration:    r.arbitration.mode,
+	}
+	for index := range r.lastCommandedPositions {
+		info.Positions[index] = r.axisPositions(index)
+	}
+
+	now := time.Now()
+	describe := func(c *Client, id string, role string) AdminConnectionInfo {
+		conn := AdminConnectionInfo{
+			ID:          id,
+			Role:        role,
+			Name:        c.name,
+			ConnectedAt: c.connectedAt.UnixMilli(),
+			AgeSec:      int64(now.Sub(c.connectedAt).Seconds()),
+			Received:    c.received.Load(),
+			Sent:        c.sent.Load(),
+			Remote:      c.conn.RemoteAddr().String(),
+		}
+		if role != "spectator" {
+			conn.LastPingAt = c.lastPingTime.UnixMilli()
+		}
+		return conn
+	}
+	if r.client != nil {
+		info.Connections = append(info.Connections, describe(r.client, "client", "client"))
+	}
+	for _, c := range r.controllerTargets() {
+		conn := describe(c, c.id, "controller")
+		conn.Active = r.acceptsInput(c)
+		info.Connections = append(info.Connections, conn)
+	}
+	for _, w := range r.waiting {
+		info.Connections = append(info.Connections, describe(w.client, w.client.id, "waiting_controller"))
+	}
+	spectators := r.spectatorList()
+	sort.Slice(spectators, func(i, j int) bool { return spectators[i].connectedAt.Before(spectators[j].connectedAt) })
+	for _, c := range spectators {
+		info.Connections = append(info.Connections, describe(c, c.id, "spectator"))
+	}
+	return info
+}
+
+// adminStop stops one device of the room, or all of them if device is nil, and optionally locks the
+// room like the client's emergency stop. Both parties are told; the client can unlock as usual.
+func (r *Room) adminStop(device *uint32, lock bool) {
+	r.mu.Lock()
+	devices := r.sortedDeviceIndices()
+	if device != nil {
+		devices = []uint32{*device}
+	}
+	if lock {
+		r.locked = true
+		r.disarmWatchdog()
+	}
+	client := r.client
+	controllers := r.controllerTargets()
+	r.mu.Unlock()
+
+	log.Printf("Key %s: Operator stops %d device(s), lock=%v", r.key, len(devices), lock)
+	if lock {
+		r.cancelScriptedMotion("stopped by an operator")
+	} else {
+		r.stopScriptedMotion("stopped by an operator")
+	}
+	r.stopDevices(client, devices)
+
+	state, message := "admin_stop", fmt.Sprintf("%d device(s) stopped by an operator", len(devices))
+	if lock {
+		state, message = "locked", "stopped by an operator"
+	}
+	for _, controller := range controllers {
+		r.sendPriorityStatusUpdate(controller, state, message)
+	}
+	r.sendPriorityStatusUpdate(client, state, message)
+}
+
+// kick disconnects the connection with id ("client", a controller ID or a spectator ID) and reports
+// whether it was found. A kicked client or controller loses its place: its resume token stops
+// working, and a client within its grace period ("client" after a drop) is released right away.
+func (r *Room) kick(id string) bool {
+	r.mu.Lock()
+	var target *Client
+	role := "" // Role whose place the kicked connection holds
+	if id == "client" {
+		target, role = r.client, "client"
+	}
+	candidates := append(r.controllerTargets(), r.spectatorList()...)
+	for _, w := range r.waiting {
+		candidates = append(candidates, w.client)
+	}
+	for _, c := range candidates {
+		if id != "" && c.id == id {
+			target = c
+			if c == r.controller {
+				role = "controller"
+			}
+		}
+	}
+	released := role != "" && r.revokeResume(role)
+	if released {
+		r.releaseRoleLocked(role)
+	}
+	r.mu.Unlock()
+
+	if released {
+		log.Printf("Key %s: Operator ends the %s's grace period", r.key, role)
+		if role == "controller" {
+			r.finishRecording()
+		}
+		r.removeIfEmpty()
+	}
+	if target == nil {
+		return released
+	}
+	log.Printf("Key %s: Operator kicks %s", r.key, id)
+	target.closeWith(closeKicked, "removed by an operator")
+	return true
+}
+
+// closeRoom stops a room's devices, disconnects everyone and forgets the room, including a key
+// created with POST /api/rooms.
+func closeRoom(room *Room) {
+	roomsMu.Lock()
+	if rooms[room.key] == room {
+		delete(rooms, room.key)
+	}
+	delete(createdRooms, room.key)
+	roomsMu.Unlock()
+
+	log.Printf("Key %s: Operator closes the room", room.key)
+	room.adminStop(nil, false)
+	room.closeAll(closeKicked, "room closed by an operator")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// adminRequest sends an admin API request with token and returns the status code.
+func adminRequest(t *testing.T, srv *httptest.Server, method string, path string, token string) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, srv.URL+path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// enableAdmin sets the admin token for one test.
+func enableAdmin(t *testing.T) {
+	adminToken = "test-admin"
+	t.Cleanup(func() { adminToken = "" })
+}
+
+func TestAdminNeedsToken(t *testing.T) {
+	srv := newTestServer(t)
+	if code := adminRequest(t, srv, "GET", "/api/admin/rooms", ""); code != http.StatusNotFound {
+		t.Fatalf("disabled API: status %d, want 404", code)
+	}
+
+	enableAdmin(t)
+	addRoom(t, "admin", "")
+	for _, token := range []string{"", "wrong"} {
+		if code := adminRequest(t, srv, "GET", "/api/admin/rooms", token); code != http.StatusUnauthorized {
+			t.Errorf("list with token %q: status %d, want 401", token, code)
+		}
+		if code := adminRequest(t, srv, "POST", "/api/admin/rooms/close?key=admin", token); code != http.StatusUnauthorized {
+			t.Errorf("close with token %q: status %d, want 401", token, code)
+		}
+	}
+	if lookupRoom("admin") == nil {
+		t.Fatal("an unauthorized request closed the room")
+	}
+	if code := adminRequest(t, srv, "GET", "/api/admin/rooms", "test-admin"); code != http.StatusOK {
+		t.Fatalf("list: status %d, want 200", code)
+	}
+}
+
+func TestAdminKickEndsResume(t *testing.T) {
+	enableAdmin(t)
+	srv := newTestServer(t)
+	controller := dial(t, srv, "type=controller&key=kick")
+	waitStatus(t, controller, "waiting_client")
+	client := dial(t, srv, "type=client&key=kick")
+	token := waitSession(t, client).ResumeToken
+	client.WriteJSON(MessageFromClient{Type: "deviceList", Devices: []DeviceInfo{{Index: 0, LinearCount: 1}}})
+	waitStatus(t, controller, "ready")
+
+	if code := adminRequest(t, srv, "POST", "/api/admin/rooms/kick?key=kick&id=nobody", "test-admin"); code != http.StatusNotFound {
+		t.Fatalf("kick of an unknown connection: status %d, want 404", code)
+	}
+	if code := adminRequest(t, srv, "POST", "/api/admin/rooms/kick?key=kick&id=client", "test-admin"); code != http.StatusNoContent {
+		t.Fatalf("kick: status %d, want 204", code)
+	}
+	if code := waitClose(t, client); code != closeKicked {
+		t.Fatalf("client closed with %d, want %d", code, closeKicked)
+	}
+	status := readUntil(t, controller, 2*time.Second, func(msg map[string]json.RawMessage) bool {
+		return string(msg["state"]) == `"client_reconnecting"` || string(msg["state"]) == `"client_disconnected"`
+	})
+	if string(status["state"]) != `"client_disconnected"` {
+		t.Fatalf("controller got %s, want client_disconnected: no place is held for a kicked client", status["state"])
+	}
+	again := dial(t, srv, "type=client&key=kick&resume="+url.QueryEscape(token))
+	if waitSession(t, again).Resumed {
+		t.Fatal("the kicked client resumed its place")
+	}
+	room := lookupRoom("kick")
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	if room.hasDevice() {
+		t.Fatal("the kicked client's devices stayed in the room")
+	}
+}
+
+func TestAdminKickDuringGrace(t *testing.T) {
+	enableAdmin(t)
+	srv := newTestServer(t)
+	controller := dial(t, srv, "type=controller&key=kick-grace")
+	waitStatus(t, controller, "waiting_client")
+	client := dial(t, srv, "type=client&key=kick-grace")
+	waitSession(t, client)
+	client.Close()
+	waitStatus(t, controller, "client_reconnecting")
+
+	if code := adminRequest(t, srv, "POST", "/api/admin/rooms/kick?key=kick-grace&id=client", "test-admin"); code != http.StatusNoContent {
+		t.Fatalf("kick: status %d, want 204", code)
+	}
+	waitStatus(t, controller, "client_disconnected")
+	room := lookupRoom("kick-grace")
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	if room.graceHeld("client") {
+		t.Fatal("the room still holds the kicked client's place")
+	}
+}
+
+func TestAdminCloseRoom(t *testing.T) {
+	enableAdmin(t)
+	srv := newTestServer(t)
+	client := dial(t, srv, "type=client&key=close")
+	client.WriteJSON(MessageFromClient{Type: "deviceList", Devices: []DeviceInfo{{Index: 0, LinearCount: 1}}})
+	controller := dial(t, srv, "type=controller&key=close")
+	waitStatus(t, controller, "ready")
+	spectator := dial(t, srv, "type=spectator&key=close")
+	readSpectatorFrame(t, spectator, func(SpectatorFrame) bool { return true })
+
+	if code := adminRequest(t, srv, "POST", "/api/admin/rooms/stop?key=close&lock=1", "test-admin"); code != http.StatusNoContent {
+		t.Fatalf("stop: status %d, want 204", code)
+	}
+	waitStatus(t, controller, "locked")
+
+	if code := adminRequest(t, srv, "POST", "/api/admin/rooms/close?key=close", "test-admin"); code != http.StatusNoContent {
+		t.Fatalf("close: status %d, want 204", code)
+	}
+	for name, ws := range map[string]*websocket.Conn{"client": client, "controller": controller, "spectator": spectator} {
+		if code := waitClose(t, ws); code != closeKicked {
+			t.Errorf("%s closed with %d, want %d", name, code, closeKicked)
+		}
+	}
+	if lookupRoom("close") != nil {
+		t.Fatal("the closed room is still registered")
+	}
+	if code := adminRequest(t, srv, "POST", "/api/admin/rooms/close?key=close", "test-admin"); code != http.StatusNotFound {
+		t.Fatalf("second close: status %d, want 404", code)
+	}
+}
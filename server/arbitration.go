@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	defaultTurnLength = 30 * time.Second // Slot length in "turns" mode
+	minTurnLength     = 5 * time.Second
+	blendWindow       = time.Second // "average" mode ignores controllers that sent no position for this long
+	maxControllerName = 32
+)
+
+// arbitrationModes let a room accept several controllers at once:
+// "turns" rotates control in timed slots, "average" blends the positions of all controllers, and
+// "priority" gives control to the highest-priority controller and falls back to the next when it leaves.
+// Without a mode the room has a single controller and the takeover policy decides about newcomers.
+var arbitrationModes = map[string]bool{"turns": true, "average": true, "priority": true}
+
+// ControllerInfo identifies a controller in "controllers" status updates.
+type ControllerInfo struct {
+	ID         string `json:"id"`
+	Name       string `json:"name,omitempty"`       // From ?name= when joining
+	Active     bool   `json:"active"`               // Its input currently drives the devices
+	Priority   int    `json:"priority,omitempty"`   // From ?priority= when joining ("priority" mode)
+	TurnEndsAt int64  `json:"turnEndsAt,omitempty"` // Unix ms, for the turn holder ("turns" mode)
+}
+
+// blendInput is a controller's latest position per axis index in "average" mode.
+type blendInput struct {
+	axes map[uint32]float64
+	at   time.Time
+}
+
+// arbitrationState tracks the controllers of a room in a multi-controller mode. r.controller is
+// the controller whose input drives the devices; in "average" mode it is the longest-connected one
+// and receives the feedback for everyone's commands.
+type arbitrationState struct {
+	mode        string    // "turns", "average" or "priority"; empty for a single controller
+	controllers []*Client // Every connected controller in join order (turn order in "turns" mode)
+	nextID      int
+
+	turnLength time.Duration
+	turnTimer  *time.Timer
+	turnEnds   time.Time
+	turnSeq    uint64 // Bumped on every turn change, so a stale timer does nothing
+
+	positions map[*Client]blendInput
+}
+
+// controllerTargets returns every controller that should see room-wide notices. Caller must hold r.mu
+// (read or write).
+func (r *Room) controllerTargets() []*Client {
+	if r.arbitration.mode != "" && len(r.arbitration.controllers) > 0 {
+		return append([]*Client(nil), r.arbitration.controllers...)
+	}
+	if r.controller != nil {
+		return []*Client{r.controller}
+	}
+	return nil
+}
+
+// sendStatusToControllers sends a status update to every controller. Caller must hold r.mu (read or write).
+func (r *Room) sendStatusToControllers(state string, message string) {
+	for _, c := range r.controllerTargets() {
+		r.sendStatusUpdate(c, state, message)
+	}
+}
+
+// sendToControllers sends a message to every controller. Caller must hold r.mu (read or write).
+func (r *Room) sendToControllers(msg interface{}, label string) {
+	for _, c := range r.controllerTargets() {
+		r.sendMessage(c, msg, label)
+	}
+}
+
+// acceptsInput reports whether commands from c may drive the devices. Caller must hold r.mu (read or write).
+func (r *Room) acceptsInput(c *Client) bool {
+	if r.arbitration.mode == "average" {
+		for _, member := range r.arbitration.controllers {
+			if member == c {
+				return true
+			}
+		}
+		return false
+	}
+	return r.controller == c
+}
+
+// isRoomController reports whether c is connected to the room as a controller, with or without
+// control. Caller must hold r.mu (read or write).
+func (r *Room) isRoomController(c *Client) bool {
+	if r.controller == c || r.isWaitingController(c) {
+		return true
+	}
+	for _, member := range r.arbitration.controllers {
+		if member == c {
+			return true
+		}
+	}
+	return false
+}
+
+// nameController gives a joining controller its room identity. Caller must hold r.mu.
+func (r *Room) nameController(c *Client, name string, priority int) {
+	r.arbitration.nextID++
+	c.id = fmt.Sprintf("controller-%d", r.arbitration.nextID)
+	if len(name) > maxControllerName {
+		name = name[:maxControllerName]
+	}
+	c.name = name
+	c.rank = priority
+}
+
+// joinController adds a controller to a room in a multi-controller mode. It reports whether c took
+// control from another controller; the caller then calls restAfterHandover once it released r.mu.
+// Caller must hold r.mu.
+func (r *Room) joinController(c *Client, resumed bool) (tookOver bool) {
+	r.arbitration.controllers = append(r.arbitration.controllers, c)
+	if r.controller == nil {
+		r.registerController(c, resumed)
+	} else {
+		r.controllerConnected = true
+		r.sendControllerState(c)
+		if r.arbitration.mode == "priority" && c.rank > r.controller.rank {
+			log.Printf("Key %s: %s has priority %d and takes over from %s", r.key, c.id, c.rank, r.controller.id)
+			r.handOverLocked(c)
+			tookOver = true
+		}
+	}
+	log.Printf("Key %s: %s joined (%d controllers, %s mode)", r.key, c.id, len(r.arbitration.controllers), r.arbitration.mode)
+	r.scheduleTurnLocked()
+	r.notifyControllersLocked()
+	return tookOver
+}
+
+// handOverLocked gives control to c. Held input of the previous controller is discarded, so it does
+// not play out under c. Caller must hold r.mu.
+func (r *Room) handOverLocked(c *Client) {
+	r.controller = c
+	if r.jitter != nil {
+		r.jitter.flush()
+	}
+}
+
+// restAfterHandover brings the devices to rest after control changed hands, so one controller's
+// motion does not carry over to the next. Caller must not hold r.mu.
+func (r *Room) restAfterHandover(reason string) {
+	r.stopScriptedMotion("control changed hands")
+	r.safeStop("turn_change", reason)
+}
+
+// leaveController removes a disconnected controller in a multi-controller mode. It reports whether
+// c was driving the devices, and ok=false if c was the last controller, which leaves the room like a
+// single controller does. Caller must hold r.mu.
+func (r *Room) leaveController(c *Client) (wasActive bool, ok bool) {
+	index := -1
+	for i, member := range r.arbitration.controllers {
+		if member == c {
+			index = i
+		}
+	}
+	if index < 0 {
+		return false, false
+	}
+	r.arbitration.controllers = append(r.arbitration.controllers[:index], r.arbitration.controllers[index+1:]...)
+	delete(r.arbitration.positions, c)
+	if len(r.arbitration.controllers) == 0 {
+		r.stopTurnsLocked()
+		return r.controller == c, false
+	}
+
+	wasActive = r.controller == c && r.arbitration.mode != "average" // Everyone drives in "average" mode
+	if r.controller == c {
+		switch r.arbitration.mode {
+		case "priority":
+			r.controller = r.highestPriorityLocked()
+		case "turns":
+			r.controller = r.arbitration.controllers[index%len(r.arbitration.controllers)] // Next in turn order
+			r.arbitration.turnEnds = time.Time{}
+		default:
+			r.controller = r.arbitration.controllers[0]
+		}
+		log.Printf("Key %s: %s left, %s takes over", r.key, c.id, r.controller.id)
+	} else {
+		log.Printf("Key %s: %s left", r.key, c.id)
+	}
+	r.scheduleTurnLocked()
+	r.notifyControllersLocked()
+	return wasActive, true
+}
+
+// highestPriorityLocked returns the controller with the highest priority, the earliest joined on ties.
+// Caller must hold r.mu.
+func (r *Room) highestPriorityLocked() *Client {
+	best := r.arbitration.controllers[0]
+	for _, c := range r.arbitration.controllers[1:] {
+		if c.rank > best.rank {
+			best = c
+		}
+	}
+	return best
+}
+
+// scheduleTurnLocked starts the current turn's timer in "turns" mode when more than one controller
+// is connected, and stops it otherwise. Caller must hold r.mu.
+func (r *Room) scheduleTurnLocked() {
+	a := &r.arbitration
+	if a.mode != "turns" || len(a.controllers) < 2 {
+		r.stopTurnsLocked()
+		return
+	}
+	if !a.turnEnds.IsZero() {
+		return // The current turn is already running
+	}
+	a.turnSeq++
+	seq := a.turnSeq
+	a.turnEnds = time.Now().Add(a.turnLength)
+	a.turnTimer = time.AfterFunc(a.turnLength, func() { r.nextTurn(seq) })
+}
+
+// stopTurnsLocked cancels the turn timer. Caller must hold r.mu.
+func (r *Room) stopTurnsLocked() {
+	a := &r.arbitration
+	if a.turnTimer != nil {
+		a.turnTimer.Stop()
+		a.turnTimer = nil
+	}
+	a.turnSeq++
+	a.turnEnds = time.Time{}
+}
+
+// nextTurn passes control to the next controller in turn order when a turn ends. The devices are
+// brought to rest first, so one controller's motion does not carry over into the next turn.
+func (r *Room) nextTurn(seq uint64) {
+	r.mu.Lock()
+	a := &r.arbitration
+	if a.turnSeq != seq || len(a.controllers) < 2 {
+		r.mu.Unlock()
+		return
+	}
+	next := a.controllers[0]
+	for i, c := range a.controllers {
+		if c == r.controller {
+			next = a.controllers[(i+1)%len(a.controllers)]
+		}
+	}
+	previous := r.controller
+	r.handOverLocked(next)
+	a.turnEnds = time.Time{}
+	r.scheduleTurnLocked()
+	r.notifyControllersLocked()
+	r.mu.Unlock()
+
+	log.Printf("Key %s: Turn passes from %s to %s", r.key, previous.id, next.id)
+	r.restAfterHandover(fmt.Sprintf("turn passed to %s", next.id))
+}
+
+// blendPosition replaces a "control" message's positions with the average of every controller's
+// latest position on the same axis in "average" mode. Controllers that never drove an axis do not
+// count towards its average.
+func (r *Room) blendPosition(c *Client, msg *ControlMessage) {
+	if msg.Type != "control" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a := &r.arbitration
+	if a.mode != "average" {
+		return
+	}
+	if a.positions == nil {
+		a.positions = make(map[*Client]blendInput)
+	}
+	now := time.Now()
+	input := blendInput{axes: make(map[uint32]float64), at: now}
+	if previous, ok := a.positions[c]; ok && now.Sub(previous.at) <= blendWindow {
+		for index, position := range previous.axes {
+			input.axes[index] = position // Axes this message leaves out keep their last position
+		}
+	}
+	for _, axis := range msg.linearAxes() {
+		input.axes[axis.Index] = axis.Position
+	}
+	a.positions[c] = input
+
+	average := func(index uint32) float64 {
+		sum, count := 0.0, 0
+		for _, other := range a.positions {
+			if position, ok := other.axes[index]; ok && now.Sub(other.at) <= blendWindow {
+				sum += position
+				count++
+			}
+		}
+		return sum / float64(count)
+	}
+	if len(msg.Axes) == 0 {
+		msg.Position = average(0)
+		return
+	}
+	for i := range msg.Axes {
+		msg.Axes[i].Position = average(msg.Axes[i].Index)
+	}
+}
+
+// notifyControllersLocked sends the roster to every controller and the client. Caller must hold r.mu.
+func (r *Room) notifyControllersLocked() {
+	a := &r.arbitration
+	roster := make([]ControllerInfo, 0, len(a.controllers))
+	for _, c := range a.controllers {
+		info := ControllerInfo{ID: c.id, Name: c.name, Active: r.acceptsInput(c), Priority: c.rank}
+		if c == r.controller && !a.turnEnds.IsZero() {
+			info.TurnEndsAt = a.turnEnds.UnixMilli()
+		}
+		roster = append(roster, info)
+	}
+	update := StatusUpdateMessage{Type: "status", State: "controllers", Arbitration: a.mode, Controllers: roster}
+	for _, c := range a.controllers {
+		update.Self = c.id
+		r.sendMessage(c, update, "controllers")
+	}
+	update.Self = ""
+	r.sendMessage(r.client, update, "controllers")
+}
+
+// setArbitration switches the room's multi-controller mode at the client's request. Controllers
+// waiting under the takeover policy join right away; leaving multi-controller mode keeps only the
+// driving controller.
+func (r *Room) setArbitration(client *Client, msg *MessageFromClient) {
+	if msg.Mode != "" && !arbitrationModes[msg.Mode] {
+		r.sendStatusUpdate(client, "arbitration_invalid", fmt.Sprintf("unknown arbitration mode %q", msg.Mode))
+		return
+	}
+	turnLength := time.Duration(msg.TurnMs) * time.Millisecond
+	if turnLength == 0 {
+		turnLength = defaultTurnLength
+	}
+	if turnLength < minTurnLength {
+		r.sendStatusUpdate(client, "arbitration_invalid", fmt.Sprintf("turns must last at least %v", minTurnLength))
+		return
+	}
+
+	r.mu.Lock()
+	a := &r.arbitration
+	previous := a.mode
+	driving := r.controller
+	a.mode = msg.Mode
+	a.turnLength = turnLength
+	r.stopTurnsLocked()
+	a.positions = nil
+	if msg.Mode == "average" && r.jitter != nil {
+		r.jitter.flush() // Input is blended as it arrives from now on, see submitControlMessage
+	}
+
+	var dismissed []*Client
+	if msg.Mode == "" {
+		for _, c := range a.controllers {
+			if c != r.controller {
+				dismissed = append(dismissed, c)
+			}
+		}
+		a.controllers = nil
+	} else {
+		if previous == "" && r.controller != nil {
+			a.controllers = []*Client{r.controller}
+		}
+		for next := r.nextWaitingController(); next != nil; next = r.nextWaitingController() {
+			r.joinController(next, false)
+		}
+		if msg.Mode == "priority" && len(a.controllers) > 0 {
+			if best := r.highestPriorityLocked(); best != r.controller {
+				r.handOverLocked(best)
+			}
+		}
+		r.scheduleTurnLocked()
+		r.notifyControllersLocked()
+	}
+	handedOver := driving != nil && r.controller != driving
+	current := r.controller
+	r.mu.Unlock()
+
+	for _, c := range dismissed {
+		c.closeWith(closeRoomOccupied, "room switched to a single controller")
+	}
+	if handedOver {
+		r.restAfterHandover(fmt.Sprintf("%s has priority and takes control", current.id))
+	}
+	log.Printf("Key %s: Client set arbitration mode %q", r.key, msg.Mode)
+	r.sendStatusUpdate(client, "arbitration", msg.Mode)
+}
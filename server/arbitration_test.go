@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAverageBlendsEachAxis(t *testing.T) {
+	room := newTestRoom("blend-axes")
+	room.arbitration.mode = "average"
+	first, second := &Client{}, &Client{}
+
+	blend := func(c *Client, msg ControlMessage) ControlMessage {
+		msg.Type = "control"
+		room.blendPosition(c, &msg)
+		return msg
+	}
+
+	msg := blend(first, ControlMessage{Axes: []AxisCommand{{Index: 0, Position: 0.25}, {Index: 1, Position: 1}}})
+	if msg.Axes[0].Position != 0.25 || msg.Axes[1].Position != 1 {
+		t.Fatalf("a single controller's axes were changed: %+v", msg.Axes)
+	}
+
+	// Position drives axis 0 and is averaged with axis 0 only
+	if msg := blend(second, ControlMessage{Position: 0.75}); msg.Position != 0.5 {
+		t.Fatalf("axis 0 = %v, want 0.5", msg.Position)
+	}
+
+	// The second controller keeps its axis 0 position while it drives axis 1
+	msg = blend(second, ControlMessage{Axes: []AxisCommand{{Index: 1, Position: 0}}})
+	if msg.Axes[0].Position != 0.5 {
+		t.Fatalf("axis 1 = %v, want 0.5", msg.Axes[0].Position)
+	}
+	if msg := blend(first, ControlMessage{Axes: []AxisCommand{{Index: 0, Position: 0.75}}}); msg.Axes[0].Position != 0.75 {
+		t.Fatalf("axis 0 = %v, want 0.75", msg.Axes[0].Position)
+	}
+
+	// Input older than the blend window no longer counts
+	room.arbitration.positions[second] = blendInput{axes: map[uint32]float64{0: 0}, at: time.Now().Add(-2 * blendWindow)}
+	if msg := blend(first, ControlMessage{Position: 1}); msg.Position != 1 {
+		t.Fatalf("axis 0 = %v, want 1 without the stale input", msg.Position)
+	}
+}
+
+func TestAverageModeBypassesJitterBuffer(t *testing.T) {
+	room := newTestRoom("blend-jitter")
+	room.locked = true // Released commands are dropped, the test only watches the buffer
+	buffer := newJitterBuffer(room, 0)
+	room.jitter = buffer
+	t.Cleanup(buffer.close)
+
+	transits := func() int {
+		buffer.mu.Lock()
+		defer buffer.mu.Unlock()
+		return len(buffer.transits)
+	}
+
+	room.arbitration.mode = "average"
+	room.submitControlMessage(&ControlMessage{Type: "control", Position: 0.5, SentAt: time.Now().UnixMilli()}, time.Now())
+	if n := transits(); n != 0 {
+		t.Fatalf("average mode input went through the jitter buffer (%d samples)", n)
+	}
+
+	room.arbitration.mode = ""
+	room.submitControlMessage(&ControlMessage{Type: "control", Position: 0.5, SentAt: time.Now().UnixMilli()}, time.Now())
+	if n := transits(); n != 1 {
+		t.Fatalf("single controller input was not buffered (%d samples)", n)
+	}
+}
+
+// activeController returns the name of the controller driving the room.
+func activeController(room *Room) string {
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	if room.controller == nil {
+		return ""
+	}
+	return room.controller.name
+}
+
+func TestPriorityFallsBackWhenHighestLeaves(t *testing.T) {
+	srv := newTestServer(t)
+	room := addRoom(t, "arbitration-priority", "")
+	room.arbitration.mode = "priority"
+
+	dial(t, srv, "type=controller&key=arbitration-priority&name=low&priority=1")
+	eventually(t, 2*time.Second, "the first controller to drive", func() bool { return activeController(room) == "low" })
+	high := dial(t, srv, "type=controller&key=arbitration-priority&name=high&priority=5")
+	eventually(t, 2*time.Second, "the higher priority to take over", func() bool { return activeController(room) == "high" })
+
+	high.Close()
+	eventually(t, 2*time.Second, "control to fall back", func() bool { return activeController(room) == "low" })
+}
+
+func TestTurnsRotateBetweenControllers(t *testing.T) {
+	srv := newTestServer(t)
+	room := addRoom(t, "arbitration-turns", "")
+	room.arbitration.mode = "turns"
+	room.arbitration.turnLength = 100 * time.Millisecond // Below minTurnLength, which only binds clients
+
+	dial(t, srv, "type=controller&key=arbitration-turns&name=first")
+	eventually(t, 2*time.Second, "the first controller to drive", func() bool { return activeController(room) == "first" })
+	second := dial(t, srv, "type=controller&key=arbitration-turns&name=second")
+	eventually(t, 2*time.Second, "the turn to pass", func() bool { return activeController(room) == "second" })
+	eventually(t, 2*time.Second, "the turn to come back", func() bool { return activeController(room) == "first" })
+
+	// Leave one at a time, like TestEndToEnd
+	second.Close()
+	eventually(t, 2*time.Second, "the second controller to leave", func() bool {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return len(room.arbitration.controllers) == 1
+	})
+}
+
+func TestPriorityTakeoverStopsDevices(t *testing.T) {
+	srv := newTestServer(t)
+	addRoom(t, "arbitration-takeover", "").arbitration.mode = "priority"
+	client := dial(t, srv, "type=client&key=arbitration-takeover")
+	client.WriteJSON(MessageFromClient{Type: "deviceList", Devices: []DeviceInfo{{Index: 0, LinearCount: 1}}})
+	low := dial(t, srv, "type=controller&key=arbitration-takeover&name=low&priority=1")
+	waitStatus(t, low, "ready")
+	low.WriteJSON(ControlMessage{Type: "control", Position: 0.8, Speed: 0.5})
+	readLinearCmd(t, client)
+
+	// The newcomer starts from rest, like after a turn change
+	high := dial(t, srv, "type=controller&key=arbitration-takeover&name=high&priority=5")
+	readUntil(t, client, 2*time.Second, func(msg map[string]json.RawMessage) bool { return msg["StopDeviceCmd"] != nil })
+	waitStatus(t, high, "turn_change")
+}
+
+func TestRoomNoticesReachEveryController(t *testing.T) {
+	srv := newTestServer(t)
+	addRoom(t, "arbitration-notices", "").arbitration.mode = "average"
+	client := dial(t, srv, "type=client&key=arbitration-notices")
+	client.WriteJSON(MessageFromClient{Type: "deviceList", Devices: []DeviceInfo{{Index: 0, LinearCount: 1}}})
+	first := dial(t, srv, "type=controller&key=arbitration-notices")
+	waitStatus(t, first, "ready")
+	second := dial(t, srv, "type=controller&key=arbitration-notices")
+	waitStatus(t, second, "ready")
+
+	// An error goes back to the sender only; the room's pattern status goes to everyone
+	second.WriteJSON(ControlMessage{Type: "pattern"})
+	waitStatus(t, second, "pattern_error")
+	second.WriteJSON(ControlMessage{Type: "pattern", Pattern: &PatternParams{Waveform: "sine", FrequencyHz: 1, Amplitude: 1, Max: 1}})
+	for name, ws := range map[string]*websocket.Conn{"first": first, "second": second} {
+		readUntil(t, ws, 2*time.Second, func(msg map[string]json.RawMessage) bool {
+			if string(msg["state"]) == `"pattern_error"` {
+				t.Fatalf("%s controller got another controller's pattern error", name)
+			}
+			return string(msg["type"]) == `"pattern"`
+		})
+	}
+	second.WriteJSON(ControlMessage{Type: "pattern", Action: "stop"})
+}
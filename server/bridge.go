@@ -0,0 +1,661 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The bridge is a headless replacement for the browser client in client/app.js. It joins a room as
+// type=client, performs the Buttplug handshake with a local Intiface instance, reports its devices
+// to the server and relays every Buttplug command the server sends.
+
+const (
+	bridgeClientName        = "RemoteToysBridge"
+	bridgeMessageVersion    = 3 // Same Buttplug spec version as the browser client
+	bridgeHeartbeatInterval = 10 * time.Second
+	bridgeMaxReconnectDelay = 30 * time.Second
+)
+
+// ButtplugDevice is a device entry from Intiface's DeviceList / DeviceAdded messages.
+type ButtplugDevice struct {
+	DeviceIndex    uint32                     `json:"DeviceIndex"`
+	DeviceName     string                     `json:"DeviceName"`
+	DeviceMessages map[string]json.RawMessage `json:"DeviceMessages"`
+}
+
+// featureCount counts the actuators a device exposes for one Buttplug message. Spec v3 lists one
+// attribute object per actuator, older specs carry a FeatureCount.
+func (d ButtplugDevice) featureCount(msgName string) uint32 {
+	raw, ok := d.DeviceMessages[msgName]
+	if !ok {
+		return 0
+	}
+	var attrs []json.RawMessage
+	if err := json.Unmarshal(raw, &attrs); err == nil {
+		return uint32(len(attrs))
+	}
+	var legacy struct {
+		FeatureCount uint32 `json:"FeatureCount"`
+	}
+	if err := json.Unmarshal(raw, &legacy); err == nil {
+		return legacy.FeatureCount
+	}
+	return 0
+}
+
+// vibrateCount counts ScalarCmd actuators of type Vibrate, falling back to the legacy VibrateCmd.
+func (d ButtplugDevice) vibrateCount() uint32 {
+	var scalars []struct {
+		ActuatorType string `json:"ActuatorType"`
+	}
+	var count uint32
+	if raw, ok := d.DeviceMessages["ScalarCmd"]; ok && json.Unmarshal(raw, &scalars) == nil {
+		for _, s := range scalars {
+			if s.ActuatorType == "Vibrate" {
+				count++
+			}
+		}
+	}
+	if count == 0 {
+		count = d.featureCount("VibrateCmd")
+	}
+	return count
+}
+
+// info converts the Intiface device entry into the DeviceInfo reported to the server.
+func (d ButtplugDevice) info() DeviceInfo {
+	return DeviceInfo{
+		Index:        d.DeviceIndex,
+		Name:         d.DeviceName,
+		LinearCount:  d.featureCount("LinearCmd"),
+		VibrateCount: d.vibrateCount(),
+		RotateCount:  d.featureCount("RotateCmd"),
+		ScalarCount:  d.featureCount("ScalarCmd"),
+	}
+}
+
+// bridge holds the state of a single server + Intiface session.
+type bridge struct {
+	serverURL   string
+	intifaceURL string
+	scan        bool
+	owner       bool           // The room is protected by an owner secret, so controllers need invites
+	safety      *SafetyProfile // Pushed to the server on every connect, nil leaves the room unrestricted
+	limits      *MotionLimits  // Reported for every linear device, nil leaves moves unshaped
+	takeover    bool           // Answer to takeover requests under the "approve" policy, from --takeover
+
+	serverConn   *websocket.Conn
+	intifaceConn *websocket.Conn
+	serverMu     sync.Mutex // Serializes writes to serverConn
+	intifaceMu   sync.Mutex // Serializes writes to intifaceConn
+
+	mu          sync.Mutex
+	devices     map[uint32]ButtplugDevice
+	targetIndex *uint32
+	nextID      uint          // Buttplug message IDs for the bridge's own requests (1 is the handshake)
+	forwarded   map[uint]bool // IDs of server commands forwarded to Intiface, awaiting their Ok
+
+	clock  clockSync               // Clock offset to the server from timeSync exchanges
+	resume *atomic.Pointer[string] // Resume token from the server, shared across reconnects
+}
+
+// runBridge implements the "bridge" subcommand.
+func runBridge(args []string) {
+	fs := flag.NewFlagSet("bridge", flag.ExitOnError)
+	serverAddr := fs.String("server", "ws://localhost:8080/ws", "WebSocket endpoint of the remotetoys server")
+	key := fs.String("key", "", "Room key to join as the client (required)")
+	intifaceAddr := fs.String("intiface", "ws://localhost:12345", "WebSocket address of Intiface Central / Engine")
+	scan := fs.Bool("scan", true, "Ask Intiface to scan for devices after the handshake")
+	safetyFile := fs.String("safety", "", "JSON file with the safety profile to enforce for this room")
+	owner := fs.String("owner", "", "Owner secret that protects the room; controllers then need an invite, which the bridge logs")
+	takeover := fs.String("takeover", "deny", "Answer to a new controller asking to take over under the \"approve\" policy: approve or deny")
+	var limits MotionLimits
+	fs.Float64Var(&limits.MaxVelocity, "max-velocity", 0, "Trajectory planner velocity limit for linear devices, in strokes/s (0 = unlimited)")
+	fs.Float64Var(&limits.MaxAcceleration, "max-acceleration", 0, "Trajectory planner acceleration limit for linear devices, in strokes/s² (0 = unlimited)")
+	fs.Float64Var(&limits.MaxJerk, "max-jerk", 0, "Trajectory planner jerk limit for linear devices, in strokes/s³ (0 = unlimited)")
+	fs.Parse(args)
+
+	if *key == "" {
+		fmt.Fprintln(os.Stderr, "bridge: --key is required")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if *takeover != "approve" && *takeover != "deny" {
+		fmt.Fprintf(os.Stderr, "bridge: --takeover must be approve or deny, not %q\n", *takeover)
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var safety *SafetyProfile
+	if *safetyFile != "" {
+		var err error
+		if safety, err = loadSafetyProfile(*safetyFile); err != nil {
+			log.Fatalf("bridge: %v", err)
+		}
+		log.Printf("Bridge: enforcing safety profile %+v", *safety)
+	}
+
+	var deviceLimits *MotionLimits
+	if limits != (MotionLimits{}) {
+		if _, err := newTrajectoryPlanner(limits); err != nil {
+			log.Fatalf("bridge: %v", err)
+		}
+		deviceLimits = &limits
+	}
+
+	serverURL, err := url.Parse(*serverAddr)
+	if err != nil {
+		log.Fatalf("bridge: invalid --server address %q: %v", *serverAddr, err)
+	}
+	query := serverURL.Query()
+	query.Set("type", "client")
+	query.Set("key", *key)
+	if *owner != "" {
+		query.Set("owner", *owner)
+	}
+	serverURL.RawQuery = query.Encode()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// Reconnect with exponential backoff, like the browser client
+	attempts := 0
+	var resume atomic.Pointer[string]
+	for {
+		b := &bridge{
+			serverURL:   serverURL.String(),
+			intifaceURL: *intifaceAddr,
+			scan:        *scan,
+			owner:       *owner != "",
+			safety:      safety,
+			limits:      deviceLimits,
+			takeover:    *takeover == "approve",
+			devices:     make(map[uint32]ButtplugDevice),
+			nextID:      2,
+			resume:      &resume,
+		}
+		start := time.Now()
+		err := b.run(ctx)
+		if ctx.Err() != nil {
+			log.Println("Bridge: shutting down")
+			return
+		}
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			switch closeErr.Code {
+			case closeUnauthorized, closeRoomNotFound:
+				log.Fatalf("bridge: server refused the room: %s", closeErr.Text)
+			case closeRoomExpired:
+				log.Fatalf("bridge: room expired")
+			case closeKicked:
+				log.Fatalf("bridge: removed by an operator: %s", closeErr.Text)
+			}
+		}
+		if time.Since(start) > bridgeMaxReconnectDelay {
+			attempts = 0 // The session was healthy for a while, start backing off from scratch
+		}
+		delay := time.Duration(1<<attempts) * time.Second
+		if delay > bridgeMaxReconnectDelay {
+			delay = bridgeMaxReconnectDelay
+		} else {
+			attempts++
+		}
+		log.Printf("Bridge: session ended (%v), reconnecting in %v", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			log.Println("Bridge: shutting down")
+			return
+		}
+	}
+}
+
+// run connects to Intiface and the server and relays messages until either side fails or ctx is cancelled.
+func (b *bridge) run(ctx context.Context) error {
+	var err error
+	b.intifaceConn, _, err = websocket.DefaultDialer.DialContext(ctx, b.intifaceURL, nil)
+	if err != nil {
+		return fmt.Errorf("connect to Intiface at %s: %w", b.intifaceURL, err)
+	}
+	defer b.intifaceConn.Close()
+	log.Printf("Bridge: connected to Intiface at %s", b.intifaceURL)
+
+	serverURL := b.serverURL
+	if token := b.resume.Load(); token != nil {
+		serverURL += "&resume=" + url.QueryEscape(*token) // Keeps the room's devices if we are back within the grace period
+	}
+	b.serverConn, _, err = websocket.DefaultDialer.DialContext(ctx, serverURL, nil)
+	if err != nil {
+		return fmt.Errorf("connect to server: %w", err)
+	}
+	defer b.serverConn.Close()
+	address, _, _ := strings.Cut(b.serverURL, "?") // The query carries the owner secret
+	log.Printf("Bridge: connected to server at %s", address)
+
+	if b.owner {
+		if err := b.sendToServer(MessageFromClient{Type: "createInvite"}); err != nil {
+			return fmt.Errorf("request invite: %w", err)
+		}
+	}
+
+	if b.safety != nil {
+		if err := b.sendToServer(MessageFromClient{Type: "safetyProfile", Profile: b.safety}); err != nil {
+			return fmt.Errorf("send safety profile: %w", err)
+		}
+	}
+
+	handshake := []map[string]interface{}{{
+		"RequestServerInfo": map[string]interface{}{
+			"Id":             1,
+			"ClientName":     bridgeClientName,
+			"MessageVersion": bridgeMessageVersion,
+		},
+	}}
+	if err := b.sendToIntiface(handshake); err != nil {
+		return fmt.Errorf("send handshake: %w", err)
+	}
+
+	errc := make(chan error, 2)
+	go func() { errc <- b.readIntiface() }()
+	go func() { errc <- b.readServer() }()
+
+	heartbeat := time.NewTicker(bridgeHeartbeatInterval)
+	defer heartbeat.Stop()
+	if err := b.sendTimeSync(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case <-heartbeat.C:
+			if err := b.sendToServer(map[string]string{"type": "ping"}); err != nil {
+				return fmt.Errorf("send heartbeat: %w", err)
+			}
+			if err := b.sendTimeSync(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			// Leave the toys at rest when the bridge is stopped
+			b.sendToIntiface([]map[string]interface{}{{"StopAllDevices": map[string]interface{}{"Id": b.allocID()}}})
+			return ctx.Err()
+		}
+	}
+}
+
+// loadSafetyProfile reads and validates a SafetyProfile JSON file.
+func loadSafetyProfile(path string) (*SafetyProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read safety profile: %w", err)
+	}
+	var profile SafetyProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("parse safety profile %s: %w", path, err)
+	}
+	if err := profile.normalize(); err != nil {
+		return nil, fmt.Errorf("safety profile %s: %w", path, err)
+	}
+	return &profile, nil
+}
+
+func (b *bridge) allocID() uint {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	return id
+}
+
+func (b *bridge) sendToIntiface(v interface{}) error {
+	b.intifaceMu.Lock()
+	defer b.intifaceMu.Unlock()
+	return b.intifaceConn.WriteJSON(v)
+}
+
+// sendTimeSync starts a clock synchronization exchange with the server.
+func (b *bridge) sendTimeSync() error {
+	request := MessageFromClient{Type: "timeSync", TimeSyncStamps: TimeSyncStamps{T0: serverMillis(time.Now())}}
+	if err := b.sendToServer(request); err != nil {
+		return fmt.Errorf("send timeSync: %w", err)
+	}
+	return nil
+}
+
+// handleTimeSyncReply updates the clock estimate and reports the finished exchange back to the server.
+func (b *bridge) handleTimeSyncReply(data []byte) error {
+	t3 := serverMillis(time.Now())
+	var reply []TimeSyncMessage
+	if err := json.Unmarshal(data, &reply); err != nil || len(reply) == 0 {
+		log.Printf("Bridge: ignoring malformed timeSync reply: %s", string(data))
+		return nil
+	}
+	stamps := reply[0].TimeSyncStamps
+	stamps.T3 = t3
+	estimate := b.clock.add(stamps)
+	log.Printf("Bridge: clock offset to server %.1fms, round trip %.1fms", estimate.offset, estimate.rtt)
+	if err := b.sendToServer(MessageFromClient{Type: "timeSync", TimeSyncStamps: stamps}); err != nil {
+		return fmt.Errorf("report timeSync: %w", err)
+	}
+	return nil
+}
+
+func (b *bridge) sendToServer(v interface{}) error {
+	b.serverMu.Lock()
+	defer b.serverMu.Unlock()
+	return b.serverConn.WriteJSON(v)
+}
+
+// readServer forwards Buttplug commands from the server to Intiface and logs server status messages.
+func (b *bridge) readServer() error {
+	for {
+		_, data, err := b.serverConn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("server read: %w", err)
+		}
+
+		// Server messages and Buttplug commands are both JSON arrays; only server messages carry "type"
+		var envelope []map[string]json.RawMessage
+		if err := json.Unmarshal(data, &envelope); err != nil || len(envelope) == 0 {
+			log.Printf("Bridge: ignoring unrecognized server message: %s", string(data))
+			continue
+		}
+		if rawType, ok := envelope[0]["type"]; ok {
+			var msgType string
+			json.Unmarshal(rawType, &msgType)
+			if msgType == "timeSync" {
+				if err := b.handleTimeSyncReply(data); err != nil {
+					return err
+				}
+				continue
+			}
+			if msgType == "invite" {
+				var invite []InviteMessage
+				if err := json.Unmarshal(data, &invite); err == nil {
+					log.Printf("Bridge: controller invite (valid until %s): %s", time.UnixMilli(invite[0].ExpiresAt).Format(time.RFC3339), invite[0].Token)
+				}
+				continue
+			}
+			if msgType == "session" {
+				var session []SessionMessage
+				if err := json.Unmarshal(data, &session); err == nil && session[0].ResumeToken != "" {
+					b.resume.Store(&session[0].ResumeToken)
+					log.Printf("Bridge: session started (resumed: %v)", session[0].Resumed)
+				}
+				continue
+			}
+			log.Printf("Bridge: server %s message: %s", msgType, string(data))
+			if msgType == "status" {
+				if err := b.answerTakeover(data); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		b.mu.Lock()
+		haveDevices := len(b.devices) > 0
+		b.mu.Unlock()
+		if !haveDevices {
+			log.Printf("Bridge: no devices known, command dropped: %s", string(data))
+			continue
+		}
+
+		b.intifaceMu.Lock()
+		err = b.intifaceConn.WriteMessage(websocket.TextMessage, data)
+		b.intifaceMu.Unlock()
+		if err != nil {
+			return fmt.Errorf("forward to Intiface: %w", err)
+		}
+		if err := b.ackForwarded(data); err != nil {
+			return err
+		}
+	}
+}
+
+// answerTakeover answers a takeover request with the --takeover decision; the bridge has nobody
+// to ask. Other status updates are only logged.
+func (b *bridge) answerTakeover(data []byte) error {
+	var status []StatusUpdateMessage
+	if err := json.Unmarshal(data, &status); err != nil || status[0].State != "takeover_request" {
+		return nil
+	}
+	log.Printf("Bridge: answering takeover request %d (approve: %v)", status[0].RequestID, b.takeover)
+	decision := MessageFromClient{Type: "takeoverDecision", RequestID: status[0].RequestID, Approve: b.takeover}
+	if err := b.sendToServer(decision); err != nil {
+		return fmt.Errorf("answer takeover request: %w", err)
+	}
+	return nil
+}
+
+// commandIDs returns the Buttplug message IDs of the commands in a server message.
+func commandIDs(data []byte) []uint {
+	var commands []map[string]struct {
+		Id uint `json:"Id"`
+	}
+	if err := json.Unmarshal(data, &commands); err != nil {
+		return nil
+	}
+	var ids []uint
+	for _, container := range commands {
+		for _, command := range container {
+			ids = append(ids, command.Id)
+		}
+	}
+	return ids
+}
+
+// ackForwarded tells the server that its commands were handed to Intiface, for latency stats.
+func (b *bridge) ackForwarded(data []byte) error {
+	at := serverMillis(time.Now())
+	for _, id := range commandIDs(data) {
+		b.mu.Lock()
+		if b.forwarded == nil {
+			b.forwarded = make(map[uint]bool)
+		}
+		b.forwarded[id] = true
+		b.mu.Unlock()
+		if err := b.sendToServer(MessageFromClient{Type: "commandAck", CommandID: id, Stage: "forwarded", At: at}); err != nil {
+			return fmt.Errorf("send commandAck: %w", err)
+		}
+	}
+	return nil
+}
+
+// readIntiface handles the Buttplug handshake, device list changes and replies from Intiface.
+func (b *bridge) readIntiface() error {
+	for {
+		var messages []map[string]json.RawMessage
+		if err := b.intifaceConn.ReadJSON(&messages); err != nil {
+			return fmt.Errorf("Intiface read: %w", err)
+		}
+
+		for _, container := range messages {
+			for name, body := range container {
+				if err := b.handleIntifaceMessage(name, body); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (b *bridge) handleIntifaceMessage(name string, body json.RawMessage) error {
+	switch name {
+	case "ServerInfo":
+		log.Printf("Bridge: Intiface ServerInfo: %s", string(body))
+		if b.scan {
+			if err := b.sendToIntiface([]map[string]interface{}{{"StartScanning": map[string]interface{}{"Id": b.allocID()}}}); err != nil {
+				return fmt.Errorf("request scanning: %w", err)
+			}
+		}
+		if err := b.sendToIntiface([]map[string]interface{}{{"RequestDeviceList": map[string]interface{}{"Id": b.allocID()}}}); err != nil {
+			return fmt.Errorf("request device list: %w", err)
+		}
+
+	case "DeviceList":
+		var list struct {
+			Devices []ButtplugDevice `json:"Devices"`
+		}
+		if err := json.Unmarshal(body, &list); err != nil {
+			log.Printf("Bridge: invalid DeviceList: %v", err)
+			return nil
+		}
+		log.Printf("Bridge: Intiface DeviceList: %d device(s)", len(list.Devices))
+		b.mu.Lock()
+		b.devices = make(map[uint32]ButtplugDevice, len(list.Devices))
+		for _, d := range list.Devices {
+			b.devices[d.DeviceIndex] = d
+		}
+		b.mu.Unlock()
+		return b.reportDevices()
+
+	case "DeviceAdded":
+		var d ButtplugDevice
+		if err := json.Unmarshal(body, &d); err != nil {
+			log.Printf("Bridge: invalid DeviceAdded: %v", err)
+			return nil
+		}
+		log.Printf("Bridge: Intiface DeviceAdded: Name=%s, Index=%d", d.DeviceName, d.DeviceIndex)
+		b.mu.Lock()
+		b.devices[d.DeviceIndex] = d
+		b.mu.Unlock()
+		return b.reportDevices()
+
+	case "DeviceRemoved":
+		var removed struct {
+			DeviceIndex uint32 `json:"DeviceIndex"`
+		}
+		if err := json.Unmarshal(body, &removed); err != nil {
+			log.Printf("Bridge: invalid DeviceRemoved: %v", err)
+			return nil
+		}
+		log.Printf("Bridge: Intiface DeviceRemoved: Index=%d", removed.DeviceIndex)
+		b.mu.Lock()
+		delete(b.devices, removed.DeviceIndex)
+		b.mu.Unlock()
+		return b.reportDevices()
+
+	case "Ok":
+		var ok struct {
+			Id uint `json:"Id"`
+		}
+		json.Unmarshal(body, &ok)
+		b.mu.Lock()
+		fromServer := b.forwarded[ok.Id]
+		delete(b.forwarded, ok.Id)
+		b.mu.Unlock()
+		if fromServer {
+			ack := MessageFromClient{Type: "commandAck", CommandID: ok.Id, Stage: "ok", At: serverMillis(time.Now())}
+			if err := b.sendToServer(ack); err != nil {
+				return fmt.Errorf("send commandAck: %w", err)
+			}
+		}
+
+	case "Error":
+		log.Printf("Bridge: Intiface Error: %s", string(body))
+		var reply struct {
+			Id           uint   `json:"Id"`
+			ErrorCode    int    `json:"ErrorCode"`
+			ErrorMessage string `json:"ErrorMessage"`
+		}
+		json.Unmarshal(body, &reply)
+		b.mu.Lock()
+		fromServer := b.forwarded[reply.Id]
+		delete(b.forwarded, reply.Id)
+		b.mu.Unlock()
+		if fromServer {
+			ack := MessageFromClient{
+				Type:         "commandAck",
+				CommandID:    reply.Id,
+				Stage:        "error",
+				At:           serverMillis(time.Now()),
+				ErrorCode:    reply.ErrorCode,
+				ErrorMessage: reply.ErrorMessage,
+			}
+			if err := b.sendToServer(ack); err != nil {
+				return fmt.Errorf("send commandAck: %w", err)
+			}
+		}
+
+	default:
+		log.Printf("Bridge: Intiface %s: %s", name, string(body))
+	}
+	return nil
+}
+
+// reportDevices sends the full device list and the selected default device to the server.
+// The default prefers a device with a linear actuator, like the browser client.
+func (b *bridge) reportDevices() error {
+	b.mu.Lock()
+	indices := make([]uint32, 0, len(b.devices))
+	for index := range b.devices {
+		indices = append(indices, index)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+
+	infos := make([]DeviceInfo, 0, len(indices))
+	for _, index := range indices {
+		info := b.devices[index].info()
+		if info.LinearCount > 0 {
+			info.Limits = b.limits
+		}
+		infos = append(infos, info)
+	}
+
+	if b.targetIndex != nil {
+		if _, ok := b.devices[*b.targetIndex]; !ok {
+			log.Printf("Bridge: target device %d was removed", *b.targetIndex)
+			b.targetIndex = nil
+		}
+	}
+	if b.targetIndex == nil {
+		for _, info := range infos {
+			if info.LinearCount > 0 {
+				picked := info.Index
+				b.targetIndex = &picked
+				break
+			}
+		}
+		if b.targetIndex == nil && len(infos) > 0 {
+			picked := infos[0].Index
+			b.targetIndex = &picked
+		}
+	}
+	var target *uint32
+	if b.targetIndex != nil {
+		picked := *b.targetIndex
+		target = &picked
+	}
+	b.mu.Unlock()
+
+	if err := b.sendToServer(MessageFromClient{Type: "deviceList", Devices: infos}); err != nil {
+		return fmt.Errorf("send device list: %w", err)
+	}
+	if err := b.sendToServer(MessageFromClient{Type: "setDeviceIndex", Index: target}); err != nil {
+		return fmt.Errorf("send device index: %w", err)
+	}
+	if target != nil {
+		log.Printf("Bridge: reported %d device(s), default device %d", len(infos), *target)
+	} else {
+		log.Println("Bridge: no suitable device found")
+	}
+	return nil
+}
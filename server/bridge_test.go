@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBridgeDeviceInfo(t *testing.T) {
+	var devices []ButtplugDevice
+	err := json.Unmarshal([]byte(`[
+		{"DeviceIndex": 0, "DeviceName": "Stroker", "DeviceMessages": {
+			"LinearCmd": [{"StepCount": 100}, {"StepCount": 100}],
+			"StopDeviceCmd": {}}},
+		{"DeviceIndex": 1, "DeviceName": "Vibrator", "DeviceMessages": {
+			"ScalarCmd": [{"ActuatorType": "Vibrate"}, {"ActuatorType": "Vibrate"}, {"ActuatorType": "Constrict"}],
+			"RotateCmd": [{"StepCount": 20}]}},
+		{"DeviceIndex": 2, "DeviceName": "Legacy", "DeviceMessages": {
+			"VibrateCmd": {"FeatureCount": 2}}}
+	]`), &devices)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	want := []DeviceInfo{
+		{Index: 0, Name: "Stroker", LinearCount: 2},
+		{Index: 1, Name: "Vibrator", VibrateCount: 2, RotateCount: 1, ScalarCount: 3},
+		{Index: 2, Name: "Legacy", VibrateCount: 2},
+	}
+	for i, d := range devices {
+		if got := d.info(); got != want[i] {
+			t.Errorf("device %d: got %+v, want %+v", i, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package buttplugsim
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// DeviceConfig describes the actuators of a simulated device.
+type DeviceConfig struct {
+	Name    string
+	Linear  int // Number of LinearCmd axes
+	Vibrate int // Number of vibration motors (exposed through ScalarCmd, and VibrateCmd before spec v3)
+	Rotate  int // Number of RotateCmd motors
+}
+
+// linearMove is the motion of one axis: from -> to over duration, starting at start.
+type linearMove struct {
+	from     float64
+	to       float64
+	start    time.Time
+	duration time.Duration
+}
+
+// positionAt interpolates the axis position at time t.
+func (m linearMove) positionAt(t time.Time) float64 {
+	if m.duration <= 0 || !t.Before(m.start.Add(m.duration)) {
+		return m.to
+	}
+	if t.Before(m.start) {
+		return m.from
+	}
+	progress := float64(t.Sub(m.start)) / float64(m.duration)
+	return m.from + (m.to-m.from)*progress
+}
+
+// Rotation is the state of a single RotateCmd motor.
+type Rotation struct {
+	Speed     float64
+	Clockwise bool
+}
+
+// Device is a simulated toy. All methods are safe for concurrent use.
+type Device struct {
+	Index  uint32
+	Config DeviceConfig
+
+	mu        sync.Mutex
+	linear    []linearMove
+	vibrate   []float64
+	rotations []Rotation
+}
+
+func newDevice(index uint32, config DeviceConfig) *Device {
+	d := &Device{
+		Index:     index,
+		Config:    config,
+		linear:    make([]linearMove, config.Linear),
+		vibrate:   make([]float64, config.Vibrate),
+		rotations: make([]Rotation, config.Rotate),
+	}
+	for i := range d.linear {
+		// Strokers start parked at the middle of their range
+		d.linear[i] = linearMove{from: 0.5, to: 0.5}
+	}
+	return d
+}
+
+// Position returns the simulated position (0.0 - 1.0) of a linear axis right now.
+func (d *Device) Position(axis int) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if axis < 0 || axis >= len(d.linear) {
+		return math.NaN()
+	}
+	return d.linear[axis].positionAt(time.Now())
+}
+
+// Target returns the position a linear axis is moving towards.
+func (d *Device) Target(axis int) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if axis < 0 || axis >= len(d.linear) {
+		return math.NaN()
+	}
+	return d.linear[axis].to
+}
+
+// VibrateSpeed returns the current speed (0.0 - 1.0) of a vibration motor.
+func (d *Device) VibrateSpeed(motor int) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if motor < 0 || motor >= len(d.vibrate) {
+		return math.NaN()
+	}
+	return d.vibrate[motor]
+}
+
+// Rotation returns the current state of a rotation motor.
+func (d *Device) Rotation(motor int) Rotation {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if motor < 0 || motor >= len(d.rotations) {
+		return Rotation{}
+	}
+	return d.rotations[motor]
+}
+
+// moveTo starts a linear move of one axis from its current position.
+func (d *Device) moveTo(axis int, position float64, duration time.Duration) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.linear[axis] = linearMove{
+		from:     d.linear[axis].positionAt(now),
+		to:       position,
+		start:    now,
+		duration: duration,
+	}
+}
+
+func (d *Device) setVibrate(motor int, speed float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.vibrate[motor] = speed
+}
+
+func (d *Device) setRotation(motor int, rotation Rotation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rotations[motor] = rotation
+}
+
+// stop freezes every linear axis where it currently is and stops all motors.
+func (d *Device) stop() {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, m := range d.linear {
+		pos := m.positionAt(now)
+		d.linear[i] = linearMove{from: pos, to: pos}
+	}
+	for i := range d.vibrate {
+		d.vibrate[i] = 0
+	}
+	for i := range d.rotations {
+		d.rotations[i] = Rotation{}
+	}
+}
+
+// deviceMessages describes the device's supported messages in Buttplug spec v3 format.
+func (d *Device) deviceMessages() map[string]interface{} {
+	msgs := map[string]interface{}{
+		"StopDeviceCmd": map[string]interface{}{},
+	}
+	if d.Config.Linear > 0 {
+		attrs := make([]map[string]interface{}, d.Config.Linear)
+		for i := range attrs {
+			attrs[i] = map[string]interface{}{"FeatureDescriptor": "", "ActuatorType": "Position", "StepCount": 100}
+		}
+		msgs["LinearCmd"] = attrs
+	}
+	if d.Config.Vibrate > 0 {
+		attrs := make([]map[string]interface{}, d.Config.Vibrate)
+		for i := range attrs {
+			attrs[i] = map[string]interface{}{"FeatureDescriptor": "", "ActuatorType": "Vibrate", "StepCount": 20}
+		}
+		msgs["ScalarCmd"] = attrs
+	}
+	if d.Config.Rotate > 0 {
+		attrs := make([]map[string]interface{}, d.Config.Rotate)
+		for i := range attrs {
+			attrs[i] = map[string]interface{}{"FeatureDescriptor": "", "ActuatorType": "Rotate", "StepCount": 20}
+		}
+		msgs["RotateCmd"] = attrs
+	}
+	return msgs
+}
@@ -0,0 +1,433 @@
+// Package buttplugsim implements a simulated Buttplug (Intiface) server for tests and local development.
+//
+// It speaks the JSON WebSocket protocol of Buttplug spec v3: the RequestServerInfo handshake,
+// RequestDeviceList, scanning, DeviceAdded/DeviceRemoved events, Ok/Error replies and the
+// LinearCmd, ScalarCmd, RotateCmd, StopDeviceCmd and StopAllDevices commands. VibrateCmd is only
+// accepted from clients that negotiated an older spec, as v3 removed it.
+// Linear axes move over the requested duration, so their position can be sampled over time.
+package buttplugsim
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// MessageVersion is the highest Buttplug spec version the simulator speaks.
+const MessageVersion = 3
+
+// Buttplug error codes sent in Error replies.
+const (
+	ErrorUnknown = 0
+	ErrorInit    = 1
+	ErrorPing    = 2
+	ErrorMessage = 3
+	ErrorDevice  = 4
+)
+
+// Command is a device command received by the simulator, reported through Server.OnCommand.
+type Command struct {
+	Name        string          // Buttplug message name, e.g. "LinearCmd"
+	DeviceIndex uint32          // Zero for StopAllDevices
+	Body        json.RawMessage // Raw message body
+	Received    time.Time
+}
+
+// Server is a simulated Intiface server. It implements http.Handler for the WebSocket endpoint.
+type Server struct {
+	Name string
+
+	// OnCommand, if set, is called for every device command after it was applied.
+	OnCommand func(Command)
+
+	// Logf is used for protocol logging; it defaults to log.Printf.
+	Logf func(format string, args ...interface{})
+
+	upgrader websocket.Upgrader
+
+	mu        sync.Mutex
+	devices   map[uint32]*Device
+	nextIndex uint32
+	conns     map[*simConn]struct{}
+}
+
+// NewServer creates a simulator without devices.
+func NewServer(name string) *Server {
+	return &Server{
+		Name:     name,
+		upgrader: websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }},
+		devices:  make(map[uint32]*Device),
+		conns:    make(map[*simConn]struct{}),
+	}
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// AddDevice adds a simulated device and announces it to every connected client with DeviceAdded.
+func (s *Server) AddDevice(config DeviceConfig) *Device {
+	s.mu.Lock()
+	d := newDevice(s.nextIndex, config)
+	s.devices[d.Index] = d
+	s.nextIndex++
+	conns := s.connList()
+	s.mu.Unlock()
+
+	s.logf("buttplugsim: device %d added: %s", d.Index, config.Name)
+	added := deviceEntry(d)
+	added["Id"] = 0 // Server events use Id 0
+	for _, c := range conns {
+		if c.handshakeDone() {
+			c.send(message("DeviceAdded", added))
+		}
+	}
+	return d
+}
+
+// RemoveDevice removes a simulated device and announces it with DeviceRemoved.
+func (s *Server) RemoveDevice(index uint32) bool {
+	s.mu.Lock()
+	_, ok := s.devices[index]
+	delete(s.devices, index)
+	conns := s.connList()
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	s.logf("buttplugsim: device %d removed", index)
+	for _, c := range conns {
+		if c.handshakeDone() {
+			c.send(message("DeviceRemoved", map[string]interface{}{"Id": 0, "DeviceIndex": index}))
+		}
+	}
+	return true
+}
+
+// Device returns the simulated device with the given index, or nil.
+func (s *Server) Device(index uint32) *Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.devices[index]
+}
+
+// Devices returns all simulated devices ordered by index.
+func (s *Server) Devices() []*Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices := make([]*Device, 0, len(s.devices))
+	for _, d := range s.devices {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Index < devices[j].Index })
+	return devices
+}
+
+// connList snapshots the open connections. Caller must hold s.mu.
+func (s *Server) connList() []*simConn {
+	conns := make([]*simConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// ServeHTTP upgrades the request and serves a Buttplug client until it disconnects.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logf("buttplugsim: upgrade error: %v", err)
+		return
+	}
+	c := &simConn{server: s, ws: ws}
+
+	s.mu.Lock()
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+	s.logf("buttplugsim: client connected from %s", r.RemoteAddr)
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		ws.Close()
+		s.logf("buttplugsim: client %q disconnected", c.clientName)
+	}()
+
+	for {
+		var messages []map[string]json.RawMessage
+		if err := ws.ReadJSON(&messages); err != nil {
+			return
+		}
+		for _, container := range messages {
+			for name, body := range container {
+				c.send(s.handle(c, name, body))
+			}
+		}
+	}
+}
+
+// simConn is a single Buttplug client connection.
+type simConn struct {
+	server *Server
+	ws     *websocket.Conn
+
+	writeMu sync.Mutex
+
+	mu         sync.Mutex
+	handshake  bool
+	clientName string
+	version    uint32 // Negotiated message spec version
+}
+
+func (c *simConn) handshakeDone() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.handshake
+}
+
+func (c *simConn) messageVersion() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+func (c *simConn) send(msg map[string]interface{}) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := c.ws.WriteJSON([]map[string]interface{}{msg}); err != nil {
+		c.ws.Close()
+	}
+}
+
+// message wraps a body in a single Buttplug message object.
+func message(name string, body interface{}) map[string]interface{} {
+	return map[string]interface{}{name: body}
+}
+
+func okReply(id uint32) map[string]interface{} {
+	return message("Ok", map[string]interface{}{"Id": id})
+}
+
+func errorReply(id uint32, code int, format string, args ...interface{}) map[string]interface{} {
+	return message("Error", map[string]interface{}{
+		"Id":           id,
+		"ErrorCode":    code,
+		"ErrorMessage": fmt.Sprintf(format, args...),
+	})
+}
+
+func deviceEntry(d *Device) map[string]interface{} {
+	return map[string]interface{}{
+		"DeviceIndex":    d.Index,
+		"DeviceName":     d.Config.Name,
+		"DeviceMessages": d.deviceMessages(),
+	}
+}
+
+// handle processes one client message and returns the reply.
+func (s *Server) handle(c *simConn, name string, body json.RawMessage) map[string]interface{} {
+	var header struct {
+		Id          uint32 `json:"Id"`
+		DeviceIndex uint32 `json:"DeviceIndex"`
+	}
+	if err := json.Unmarshal(body, &header); err != nil {
+		return errorReply(0, ErrorMessage, "malformed %s: %v", name, err)
+	}
+
+	if name == "RequestServerInfo" {
+		var req struct {
+			ClientName     string `json:"ClientName"`
+			MessageVersion uint32 `json:"MessageVersion"`
+		}
+		json.Unmarshal(body, &req)
+		version := req.MessageVersion
+		if version > MessageVersion {
+			version = MessageVersion
+		}
+		c.mu.Lock()
+		c.handshake = true
+		c.clientName = req.ClientName
+		c.version = version
+		c.mu.Unlock()
+		s.logf("buttplugsim: handshake from %q (spec v%d)", req.ClientName, req.MessageVersion)
+		return message("ServerInfo", map[string]interface{}{
+			"Id":             header.Id,
+			"ServerName":     s.Name,
+			"MessageVersion": version,
+			"MaxPingTime":    0,
+		})
+	}
+	if !c.handshakeDone() {
+		return errorReply(header.Id, ErrorInit, "%s received before RequestServerInfo", name)
+	}
+
+	switch name {
+	case "Ping":
+		return okReply(header.Id)
+
+	case "StartScanning":
+		return okReply(header.Id)
+
+	case "StopScanning":
+		go c.send(message("ScanningFinished", map[string]interface{}{"Id": 0}))
+		return okReply(header.Id)
+
+	case "RequestDeviceList":
+		devices := s.Devices()
+		entries := make([]map[string]interface{}, 0, len(devices))
+		for _, d := range devices {
+			entries = append(entries, deviceEntry(d))
+		}
+		return message("DeviceList", map[string]interface{}{"Id": header.Id, "Devices": entries})
+
+	case "StopAllDevices":
+		for _, d := range s.Devices() {
+			d.stop()
+		}
+		s.notify(name, 0, body)
+		return okReply(header.Id)
+
+	case "StopDeviceCmd", "LinearCmd", "VibrateCmd", "ScalarCmd", "RotateCmd":
+		if version := c.messageVersion(); name == "VibrateCmd" && version >= 3 {
+			return errorReply(header.Id, ErrorMessage, "VibrateCmd is not part of message spec v%d, use ScalarCmd", version)
+		}
+		d := s.Device(header.DeviceIndex)
+		if d == nil {
+			return errorReply(header.Id, ErrorDevice, "device %d does not exist", header.DeviceIndex)
+		}
+		if err := applyCommand(d, name, body); err != nil {
+			return errorReply(header.Id, ErrorDevice, "%s: %v", name, err)
+		}
+		s.notify(name, header.DeviceIndex, body)
+		return okReply(header.Id)
+
+	default:
+		return errorReply(header.Id, ErrorMessage, "unknown message %s", name)
+	}
+}
+
+func (s *Server) notify(name string, deviceIndex uint32, body json.RawMessage) {
+	if s.OnCommand != nil {
+		s.OnCommand(Command{Name: name, DeviceIndex: deviceIndex, Body: body, Received: time.Now()})
+	}
+}
+
+// applyCommand validates a device command and updates the simulated device state.
+func applyCommand(d *Device, name string, body json.RawMessage) error {
+	switch name {
+	case "StopDeviceCmd":
+		d.stop()
+
+	case "LinearCmd":
+		var cmd struct {
+			Vectors []struct {
+				Index    int     `json:"Index"`
+				Duration uint32  `json:"Duration"`
+				Position float64 `json:"Position"`
+			} `json:"Vectors"`
+		}
+		if err := json.Unmarshal(body, &cmd); err != nil {
+			return err
+		}
+		if len(cmd.Vectors) == 0 {
+			return fmt.Errorf("no vectors")
+		}
+		for _, v := range cmd.Vectors {
+			if v.Index < 0 || v.Index >= d.Config.Linear {
+				return fmt.Errorf("linear axis %d out of range (device has %d)", v.Index, d.Config.Linear)
+			}
+			if v.Position < 0 || v.Position > 1 {
+				return fmt.Errorf("position %.3f out of range", v.Position)
+			}
+		}
+		for _, v := range cmd.Vectors {
+			d.moveTo(v.Index, v.Position, time.Duration(v.Duration)*time.Millisecond)
+		}
+
+	case "VibrateCmd":
+		var cmd struct {
+			Speeds []struct {
+				Index int     `json:"Index"`
+				Speed float64 `json:"Speed"`
+			} `json:"Speeds"`
+		}
+		if err := json.Unmarshal(body, &cmd); err != nil {
+			return err
+		}
+		for _, v := range cmd.Speeds {
+			if v.Index < 0 || v.Index >= d.Config.Vibrate {
+				return fmt.Errorf("vibrator %d out of range (device has %d)", v.Index, d.Config.Vibrate)
+			}
+			if v.Speed < 0 || v.Speed > 1 {
+				return fmt.Errorf("speed %.3f out of range", v.Speed)
+			}
+		}
+		for _, v := range cmd.Speeds {
+			d.setVibrate(v.Index, v.Speed)
+		}
+
+	case "ScalarCmd":
+		var cmd struct {
+			Scalars []struct {
+				Index        int     `json:"Index"`
+				Scalar       float64 `json:"Scalar"`
+				ActuatorType string  `json:"ActuatorType"`
+			} `json:"Scalars"`
+		}
+		if err := json.Unmarshal(body, &cmd); err != nil {
+			return err
+		}
+		for _, v := range cmd.Scalars {
+			// The simulator only exposes vibration motors through ScalarCmd
+			if v.Index < 0 || v.Index >= d.Config.Vibrate {
+				return fmt.Errorf("scalar actuator %d out of range (device has %d)", v.Index, d.Config.Vibrate)
+			}
+			if v.ActuatorType != "Vibrate" {
+				return fmt.Errorf("scalar actuator %d is Vibrate, not %s", v.Index, v.ActuatorType)
+			}
+			if v.Scalar < 0 || v.Scalar > 1 {
+				return fmt.Errorf("scalar %.3f out of range", v.Scalar)
+			}
+		}
+		for _, v := range cmd.Scalars {
+			d.setVibrate(v.Index, v.Scalar)
+		}
+
+	case "RotateCmd":
+		var cmd struct {
+			Rotations []struct {
+				Index     int     `json:"Index"`
+				Speed     float64 `json:"Speed"`
+				Clockwise bool    `json:"Clockwise"`
+			} `json:"Rotations"`
+		}
+		if err := json.Unmarshal(body, &cmd); err != nil {
+			return err
+		}
+		for _, v := range cmd.Rotations {
+			if v.Index < 0 || v.Index >= d.Config.Rotate {
+				return fmt.Errorf("rotator %d out of range (device has %d)", v.Index, d.Config.Rotate)
+			}
+			if v.Speed < 0 || v.Speed > 1 {
+				return fmt.Errorf("speed %.3f out of range", v.Speed)
+			}
+		}
+		for _, v := range cmd.Rotations {
+			d.setRotation(v.Index, Rotation{Speed: v.Speed, Clockwise: v.Clockwise})
+		}
+	}
+	return nil
+}
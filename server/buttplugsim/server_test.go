@@ -0,0 +1,151 @@
+package buttplugsim
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialSim starts a simulator and connects a Buttplug client to it.
+func dialSim(t *testing.T) (*Server, *websocket.Conn) {
+	t.Helper()
+	sim := NewServer("Test Server")
+	sim.Logf = t.Logf
+	srv := httptest.NewServer(sim)
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial simulator: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return sim, ws
+}
+
+// send writes a single Buttplug message.
+func send(t *testing.T, ws *websocket.Conn, name string, body map[string]interface{}) {
+	t.Helper()
+	if err := ws.WriteJSON([]map[string]interface{}{{name: body}}); err != nil {
+		t.Fatalf("send %s: %v", name, err)
+	}
+}
+
+// expect reads messages until one named name arrives and returns its body.
+func expect(t *testing.T, ws *websocket.Conn, name string) map[string]json.RawMessage {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var messages []map[string]map[string]json.RawMessage
+		if err := ws.ReadJSON(&messages); err != nil {
+			t.Fatalf("waiting for %s: %v", name, err)
+		}
+		for _, container := range messages {
+			if body, ok := container[name]; ok {
+				return body
+			}
+		}
+	}
+}
+
+func TestHandshakeRequired(t *testing.T) {
+	_, ws := dialSim(t)
+	send(t, ws, "RequestDeviceList", map[string]interface{}{"Id": 1})
+	reply := expect(t, ws, "Error")
+	if string(reply["ErrorCode"]) != "1" {
+		t.Fatalf("ErrorCode = %s, want %d (ErrorInit)", reply["ErrorCode"], ErrorInit)
+	}
+}
+
+func TestHandshakeDeviceAddedAndLinearCmd(t *testing.T) {
+	sim, ws := dialSim(t)
+	commands := make(chan Command, 1)
+	sim.OnCommand = func(c Command) { commands <- c }
+
+	send(t, ws, "RequestServerInfo", map[string]interface{}{"Id": 1, "ClientName": "test", "MessageVersion": 3})
+	info := expect(t, ws, "ServerInfo")
+	if string(info["Id"]) != "1" || string(info["MessageVersion"]) != "3" {
+		t.Fatalf("ServerInfo = %v", info)
+	}
+
+	sim.AddDevice(DeviceConfig{Name: "Stroker", Linear: 1})
+	added := expect(t, ws, "DeviceAdded")
+	if string(added["DeviceIndex"]) != "0" || string(added["DeviceName"]) != `"Stroker"` {
+		t.Fatalf("DeviceAdded = %v", added)
+	}
+
+	send(t, ws, "LinearCmd", map[string]interface{}{
+		"Id":          2,
+		"DeviceIndex": 0,
+		"Vectors":     []map[string]interface{}{{"Index": 0, "Duration": 100, "Position": 0.9}},
+	})
+	if ok := expect(t, ws, "Ok"); string(ok["Id"]) != "2" {
+		t.Fatalf("Ok = %v, want Id 2", ok)
+	}
+	select {
+	case c := <-commands:
+		if c.Name != "LinearCmd" || c.DeviceIndex != 0 {
+			t.Fatalf("OnCommand got %s for device %d", c.Name, c.DeviceIndex)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnCommand not called")
+	}
+
+	device := sim.Device(0)
+	if target := device.Target(0); target != 0.9 {
+		t.Fatalf("Target = %v, want 0.9", target)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if position := device.Position(0); position != 0.9 {
+		t.Fatalf("Position after the move = %v, want 0.9", position)
+	}
+}
+
+func TestLinearCmdOutOfRange(t *testing.T) {
+	sim, ws := dialSim(t)
+	sim.AddDevice(DeviceConfig{Name: "Stroker", Linear: 1})
+	send(t, ws, "RequestServerInfo", map[string]interface{}{"Id": 1, "ClientName": "test", "MessageVersion": 3})
+	expect(t, ws, "ServerInfo")
+
+	send(t, ws, "LinearCmd", map[string]interface{}{
+		"Id":          2,
+		"DeviceIndex": 0,
+		"Vectors":     []map[string]interface{}{{"Index": 1, "Duration": 100, "Position": 0.5}},
+	})
+	reply := expect(t, ws, "Error")
+	if string(reply["ErrorCode"]) != "4" {
+		t.Fatalf("ErrorCode = %s, want %d (ErrorDevice)", reply["ErrorCode"], ErrorDevice)
+	}
+	if target := sim.Device(0).Target(0); target != 0.5 {
+		t.Fatalf("rejected command moved the device to %v", target)
+	}
+}
+
+func TestVibrateCmdNeedsOldSpec(t *testing.T) {
+	sim, ws := dialSim(t)
+	sim.AddDevice(DeviceConfig{Name: "Vibe", Vibrate: 1})
+	send(t, ws, "RequestServerInfo", map[string]interface{}{"Id": 1, "ClientName": "test", "MessageVersion": 3})
+	expect(t, ws, "ServerInfo")
+
+	send(t, ws, "VibrateCmd", map[string]interface{}{
+		"Id":          2,
+		"DeviceIndex": 0,
+		"Speeds":      []map[string]interface{}{{"Index": 0, "Speed": 0.5}},
+	})
+	if reply := expect(t, ws, "Error"); string(reply["ErrorCode"]) != "3" {
+		t.Fatalf("ErrorCode = %s, want %d (ErrorMessage)", reply["ErrorCode"], ErrorMessage)
+	}
+
+	send(t, ws, "ScalarCmd", map[string]interface{}{
+		"Id":          3,
+		"DeviceIndex": 0,
+		"Scalars":     []map[string]interface{}{{"Index": 0, "Scalar": 0.5, "ActuatorType": "Vibrate"}},
+	})
+	expect(t, ws, "Ok")
+	if speed := sim.Device(0).VibrateSpeed(0); speed != 0.5 {
+		t.Fatalf("VibrateSpeed = %v, want 0.5", speed)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+const clockSyncWindow = 8 // Exchanges kept per connection; the one with the lowest round trip wins
+
+// TimeSyncStamps are the four timestamps of an NTP-like exchange, in Unix milliseconds (fractions allowed).
+// t0 and t3 are on the peer's clock, t1 and t2 on the server's.
+type TimeSyncStamps struct {
+	T0 float64 `json:"t0,omitempty"` // Peer: request sent
+	T1 float64 `json:"t1,omitempty"` // Server: request received
+	T2 float64 `json:"t2,omitempty"` // Server: reply sent
+	T3 float64 `json:"t3,omitempty"` // Peer: reply received, only set when reporting a finished exchange
+}
+
+// TimeSyncMessage is the server's reply to a "timeSync" request.
+type TimeSyncMessage struct {
+	Type string `json:"type"` // Always "timeSync"
+	TimeSyncStamps
+}
+
+// clockSample is the result of one finished exchange.
+type clockSample struct {
+	offset float64 // Server clock minus peer clock, ms
+	rtt    float64 // Round trip without the server's processing time, ms
+}
+
+// clockSync holds a connection's clock estimate. The peer sends {"type":"timeSync","t0":...}, the
+// server answers with t1 and t2, and the peer reports the finished exchange back with t3 so the
+// server knows the offset too.
+type clockSync struct {
+	mu      sync.Mutex
+	samples []clockSample
+	best    clockSample
+	synced  bool
+}
+
+// serverMillis converts a server time to the Unix milliseconds used in timeSync messages.
+func serverMillis(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1000
+}
+
+// add records a finished exchange and returns the current estimate.
+func (s *clockSync) add(stamps TimeSyncStamps) clockSample {
+	sample := clockSample{
+		offset: ((stamps.T1 - stamps.T0) + (stamps.T2 - stamps.T3)) / 2,
+		rtt:    (stamps.T3 - stamps.T0) - (stamps.T2 - stamps.T1),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples = append(s.samples, sample)
+	if len(s.samples) > clockSyncWindow {
+		s.samples = s.samples[1:]
+	}
+	// Queueing delay only ever adds to the round trip, so the fastest exchange has the most accurate offset
+	s.best = s.samples[0]
+	for _, candidate := range s.samples[1:] {
+		if candidate.rtt < s.best.rtt {
+			s.best = candidate
+		}
+	}
+	s.synced = true
+	return s.best
+}
+
+// clockEstimate returns the offset (server clock minus peer clock) and round-trip time of the
+// connection, or ok=false if the peer has not finished a timeSync exchange yet.
+func (c *Client) clockEstimate() (offset time.Duration, rtt time.Duration, ok bool) {
+	c.clock.mu.Lock()
+	defer c.clock.mu.Unlock()
+	if !c.clock.synced {
+		return 0, 0, false
+	}
+	toDuration := func(ms float64) time.Duration { return time.Duration(ms * float64(time.Millisecond)) }
+	return toDuration(c.clock.best.offset), toDuration(c.clock.best.rtt), true
+}
+
+// serverTime converts a timestamp on the peer's clock (Unix ms) to server time.
+// Without an estimate the clocks are assumed to agree.
+func (c *Client) serverTime(peerMs float64) time.Time {
+	offset, _, _ := c.clockEstimate()
+	return time.UnixMicro(int64(math.Round(peerMs * 1000))).Add(offset)
+}
+
+// handleTimeSync answers a timeSync request, or records a finished exchange reported with t3.
+func (r *Room) handleTimeSync(c *Client, stamps TimeSyncStamps, arrival time.Time) {
+	if stamps.T3 != 0 {
+		if stamps.T0 == 0 || stamps.T1 > stamps.T2 || stamps.T3 < stamps.T0 {
+			log.Printf("Key %s: Ignoring inconsistent timeSync report from %s: %+v", r.key, c.Type, stamps)
+			return
+		}
+		estimate := c.clock.add(stamps)
+		log.Printf("Key %s: Clock of %s: offset %.1fms, round trip %.1fms", r.key, c.Type, estimate.offset, estimate.rtt)
+		return
+	}
+	if stamps.T0 == 0 {
+		log.Printf("Key %s: timeSync request from %s without t0", r.key, c.Type)
+		return
+	}
+
+	reply := TimeSyncMessage{Type: "timeSync", TimeSyncStamps: TimeSyncStamps{T0: stamps.T0, T1: serverMillis(arrival)}}
+	reply.T2 = serverMillis(time.Now()) // Queued right away; the write pump adds little on top
+	r.sendMessage(c, reply, "timeSync reply")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestClockSyncPicksFastestExchange(t *testing.T) {
+	var s clockSync
+	// Peer clock 50ms behind the server, 20ms round trip, 2ms spent on the server
+	estimate := s.add(TimeSyncStamps{T0: 1000, T1: 1060, T2: 1062, T3: 1022})
+	if estimate.offset != 50 || estimate.rtt != 20 {
+		t.Fatalf("estimate %+v, want offset 50 and round trip 20", estimate)
+	}
+
+	// A slow, asymmetric exchange does not replace the fast one
+	if estimate = s.add(TimeSyncStamps{T0: 2000, T1: 2150, T2: 2150, T3: 2110}); estimate.offset != 50 {
+		t.Fatalf("estimate %+v after a slow exchange, want offset 50 kept", estimate)
+	}
+
+	// The fast exchange ages out of the window
+	for i := 0; i < clockSyncWindow; i++ {
+		base := float64(3000 + 100*i)
+		s.add(TimeSyncStamps{T0: base, T1: base + 40, T2: base + 40, T3: base + 30})
+	}
+	if estimate = s.best; estimate.offset != 25 || estimate.rtt != 30 {
+		t.Fatalf("estimate %+v, want offset 25 and round trip 30 from the recent exchanges", estimate)
+	}
+}
+
+func TestTimeSyncExchange(t *testing.T) {
+	_, controller := joinWatchdogRoom(t, "timesync", nil)
+	room := lookupRoom("timesync")
+	room.mu.RLock()
+	c := room.controller
+	room.mu.RUnlock()
+
+	t0 := serverMillis(time.Now()) - 1000 // The controller's clock is a second behind
+	if err := controller.WriteJSON(ControlMessage{Type: "timeSync", TimeSyncStamps: TimeSyncStamps{T0: t0}}); err != nil {
+		t.Fatalf("send timeSync: %v", err)
+	}
+	msg := readUntil(t, controller, 2*time.Second, func(msg map[string]json.RawMessage) bool { return string(msg["type"]) == `"timeSync"` })
+	var reply TimeSyncMessage
+	if err := json.Unmarshal(mustMarshal(t, msg), &reply); err != nil {
+		t.Fatalf("decode reply: %v", err)
+	}
+	if reply.T0 != t0 || reply.T1 == 0 || reply.T2 < reply.T1 {
+		t.Fatalf("reply %+v, want t0 echoed and t1 <= t2", reply.TimeSyncStamps)
+	}
+
+	// A report that arrived before it was sent is ignored
+	if err := controller.WriteJSON(ControlMessage{Type: "timeSync", TimeSyncStamps: TimeSyncStamps{T0: t0, T1: reply.T1, T2: reply.T2, T3: t0 - 5}}); err != nil {
+		t.Fatalf("report timeSync: %v", err)
+	}
+	stamps := reply.TimeSyncStamps
+	stamps.T3 = serverMillis(time.Now()) - 1000
+	if err := controller.WriteJSON(ControlMessage{Type: "timeSync", TimeSyncStamps: stamps}); err != nil {
+		t.Fatalf("report timeSync: %v", err)
+	}
+	eventually(t, 2*time.Second, "the clock estimate", func() bool {
+		_, _, ok := c.clockEstimate()
+		return ok
+	})
+	c.clock.mu.Lock()
+	samples := len(c.clock.samples)
+	c.clock.mu.Unlock()
+	if samples != 1 {
+		t.Fatalf("%d exchange(s) recorded, want only the consistent one", samples)
+	}
+	offset, _, _ := c.clockEstimate()
+	if offset < 900*time.Millisecond || offset > 1100*time.Millisecond {
+		t.Fatalf("offset %v, want about 1s", offset)
+	}
+	if got := c.serverTime(1000); got != time.UnixMilli(1000).Add(offset) {
+		t.Fatalf("serverTime(1000) = %v, want shifted by %v", got, offset)
+	}
+
+	controller.Close()
+	eventually(t, 2*time.Second, "the controller to leave", func() bool {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return !room.controllerConnected
+	})
+}
+
+// mustMarshal re-encodes a message read with readUntil.
+func mustMarshal(t *testing.T, msg map[string]json.RawMessage) []byte {
+	t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	return data
+}
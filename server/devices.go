@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+)
+
+// DeviceInfo describes a single device reported by the client from its Intiface device list.
+type DeviceInfo struct {
+	Index        uint32 `json:"index"`
+	Name         string `json:"name,omitempty"`
+	LinearCount  uint32 `json:"linearCount,omitempty"`  // Number of LinearCmd actuators
+	VibrateCount uint32 `json:"vibrateCount,omitempty"` // Number of vibration actuators
+	RotateCount  uint32 `json:"rotateCount,omitempty"`  // Number of RotateCmd actuators
+	ScalarCount  uint32 `json:"scalarCount,omitempty"`  // Number of ScalarCmd actuators
+
+	Limits *MotionLimits `json:"limits,omitempty"` // Physical limits for the trajectory planner, nil sends moves unshaped
+}
+
+// capabilitiesKnown reports whether the client sent any feature counts for this device.
+// Devices registered through the legacy setDeviceIndex message have none.
+func (d DeviceInfo) capabilitiesKnown() bool {
+	return d.LinearCount+d.VibrateCount+d.RotateCount+d.ScalarCount > 0
+}
+
+// supports reports whether the device can handle the given controller message type.
+// Devices with unknown capabilities are assumed to support everything.
+func (d DeviceInfo) supports(msgType string) bool {
+	if !d.capabilitiesKnown() {
+		return true
+	}
+	switch msgType {
+	case "control":
+		return d.LinearCount > 0
+	case "vibrate":
+		return d.VibrateCount > 0
+	case "rotate":
+		return d.RotateCount > 0
+	case "scalar":
+		return d.ScalarCount > 0
+	default:
+		return true
+	}
+}
+
+// DeviceTarget selects which device(s) a ControlMessage addresses.
+// In JSON it is either a device index or the string "all".
+type DeviceTarget struct {
+	All   bool
+	Index uint32
+}
+
+func (t *DeviceTarget) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		if strings.EqualFold(s, "all") {
+			t.All = true
+			return nil
+		}
+		return fmt.Errorf("invalid device target %q", s)
+	}
+	var index uint32
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("invalid device target %s", string(data))
+	}
+	t.All = false
+	t.Index = index
+	return nil
+}
+
+func (t DeviceTarget) MarshalJSON() ([]byte, error) {
+	if t.All {
+		return json.Marshal("all")
+	}
+	return json.Marshal(t.Index)
+}
+
+// DeviceListMessage is sent to the controller whenever the room's device list changes.
+type DeviceListMessage struct {
+	Type          string       `json:"type"` // Always "devices"
+	Devices       []DeviceInfo `json:"devices"`
+	DefaultDevice *uint32      `json:"defaultDevice"` // Device used when a command carries no target
+}
+
+// setDeviceList replaces the room's devices with the list reported by the client.
+// Positions of devices that disappeared are forgotten and the default device is re-picked if needed.
+// Caller must hold r.mu.
+func (r *Room) setDeviceList(devices []DeviceInfo) {
+	r.devices = make(map[uint32]DeviceInfo, len(devices))
+	for _, d := range devices {
+		r.devices[d.Index] = d
+	}
+	for index := range r.lastCommandedPositions {
+		if _, ok := r.devices[index]; !ok {
+			delete(r.lastCommandedPositions, index)
+		}
+	}
+	if r.clientDeviceIndex != nil {
+		if _, ok := r.devices[*r.clientDeviceIndex]; !ok {
+			log.Printf("Key %s: Default device %d no longer present.", r.key, *r.clientDeviceIndex)
+			r.clientDeviceIndex = nil
+		}
+	}
+	if r.clientDeviceIndex == nil {
+		r.clientDeviceIndex = r.pickDefaultDevice()
+	}
+	r.updatePlanners()
+}
+
+// pickDefaultDevice prefers the lowest-indexed device with a linear actuator, falling back to the
+// lowest-indexed device overall. Caller must hold r.mu.
+func (r *Room) pickDefaultDevice() *uint32 {
+	indices := r.sortedDeviceIndices()
+	for _, index := range indices {
+		if r.devices[index].LinearCount > 0 {
+			picked := index
+			return &picked
+		}
+	}
+	if len(indices) > 0 {
+		picked := indices[0]
+		return &picked
+	}
+	return nil
+}
+
+// sortedDeviceIndices returns the indices of all known devices in ascending order.
+// Caller must hold r.mu (read or write).
+func (r *Room) sortedDeviceIndices() []uint32 {
+	indices := make([]uint32, 0, len(r.devices))
+	for index := range r.devices {
+		indices = append(indices, index)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	return indices
+}
+
+// resetDevices forgets every device and commanded position, e.g. when the client goes away.
+// Caller must hold r.mu.
+func (r *Room) resetDevices() {
+	r.devices = make(map[uint32]DeviceInfo)
+	r.clientDeviceIndex = nil
+	r.lastCommandedPositions = make(map[uint32]map[uint32]float64)
+	r.planners = nil
+	r.plannerLimits = nil
+}
+
+// hasDevice reports whether at least one device can receive commands. Caller must hold r.mu.
+func (r *Room) hasDevice() bool {
+	return r.clientDeviceIndex != nil || len(r.devices) > 0
+}
+
+// axisPositions returns a copy of the last positions commanded to each axis of a device.
+// Axes that were never commanded are absent. Caller must hold r.mu (read or write).
+func (r *Room) axisPositions(deviceIndex uint32) map[uint32]float64 {
+	positions := make(map[uint32]float64, len(r.lastCommandedPositions[deviceIndex]))
+	for axis, pos := range r.lastCommandedPositions[deviceIndex] {
+		positions[axis] = pos
+	}
+	return positions
+}
+
+// setAxisPositions records the positions just commanded to a device's axes. Caller must hold r.mu.
+func (r *Room) setAxisPositions(deviceIndex uint32, axes []AxisCommand) {
+	positions, ok := r.lastCommandedPositions[deviceIndex]
+	if !ok {
+		positions = make(map[uint32]float64, len(axes))
+		r.lastCommandedPositions[deviceIndex] = positions
+	}
+	for _, axis := range axes {
+		positions[axis.Index] = math.Max(0.0, math.Min(1.0, axis.Position))
+	}
+}
+
+// resolveTargets expands a message's device target into concrete device indices.
+// A nil target addresses the default device; "all" addresses every device that supports msgType.
+// Caller must hold r.mu (read or write).
+func (r *Room) resolveTargets(target *DeviceTarget, msgType string) ([]uint32, error) {
+	if target == nil {
+		if r.clientDeviceIndex == nil {
+			return nil, fmt.Errorf("no default device selected")
+		}
+		return []uint32{*r.clientDeviceIndex}, nil
+	}
+	if !target.All {
+		if _, ok := r.devices[target.Index]; !ok {
+			return nil, fmt.Errorf("device %d is not connected", target.Index)
+		}
+		return []uint32{target.Index}, nil
+	}
+	var indices []uint32
+	for _, index := range r.sortedDeviceIndices() {
+		if r.devices[index].supports(msgType) {
+			indices = append(indices, index)
+		}
+	}
+	if len(indices) == 0 {
+		return nil, fmt.Errorf("no connected device supports %q", msgType)
+	}
+	return indices, nil
+}
+
+// deviceListMessage snapshots the device list for the controller. Caller must hold r.mu (read or write).
+func (r *Room) deviceListMessage() DeviceListMessage {
+	msg := DeviceListMessage{Type: "devices", Devices: make([]DeviceInfo, 0, len(r.devices))}
+	for _, index := range r.sortedDeviceIndices() {
+		msg.Devices = append(msg.Devices, r.devices[index])
+	}
+	if r.clientDeviceIndex != nil {
+		defaultDevice := *r.clientDeviceIndex
+		msg.DefaultDevice = &defaultDevice
+	}
+	return msg
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestDeviceListPicksLinearDefault(t *testing.T) {
+	room := newTestRoom("devices-default")
+	room.setAxisPositions(7, []AxisCommand{{Index: 0, Position: 0.5}})
+	room.setDeviceList([]DeviceInfo{{Index: 1, VibrateCount: 1}, {Index: 4, LinearCount: 1}, {Index: 2, LinearCount: 1}})
+
+	if room.clientDeviceIndex == nil || *room.clientDeviceIndex != 2 {
+		t.Fatalf("default device = %v, want the lowest linear device 2", room.clientDeviceIndex)
+	}
+	if positions := room.axisPositions(7); len(positions) != 0 {
+		t.Fatalf("positions of a removed device = %v, want them forgotten", positions)
+	}
+
+	// The default stays while it is connected, and is re-picked once it leaves
+	room.setDeviceList([]DeviceInfo{{Index: 1, VibrateCount: 1}, {Index: 2, LinearCount: 1}})
+	if *room.clientDeviceIndex != 2 {
+		t.Fatalf("default device = %d, want 2", *room.clientDeviceIndex)
+	}
+	room.setDeviceList([]DeviceInfo{{Index: 1, VibrateCount: 1}})
+	if room.clientDeviceIndex == nil || *room.clientDeviceIndex != 1 {
+		t.Fatalf("default device = %v, want 1 without any linear device", room.clientDeviceIndex)
+	}
+}
+
+func TestResolveTargets(t *testing.T) {
+	room := newTestRoom("devices-targets")
+	room.setDeviceList([]DeviceInfo{
+		{Index: 0, LinearCount: 1},
+		{Index: 1, VibrateCount: 2},
+		{Index: 2, LinearCount: 1, VibrateCount: 1},
+		{Index: 3}, // Legacy device without capabilities, assumed to support everything
+	})
+
+	tests := []struct {
+		target  string
+		msgType string
+		want    []uint32
+	}{
+		{"", "control", []uint32{0}},
+		{"1", "control", []uint32{1}}, // An explicit index is not filtered by capability
+		{`"all"`, "control", []uint32{0, 2, 3}},
+		{`"ALL"`, "vibrate", []uint32{1, 2, 3}},
+		{`"all"`, "rotate", []uint32{3}},
+	}
+	for _, tt := range tests {
+		var target *DeviceTarget
+		if tt.target != "" {
+			target = new(DeviceTarget)
+			if err := json.Unmarshal([]byte(tt.target), target); err != nil {
+				t.Fatalf("unmarshal %s: %v", tt.target, err)
+			}
+		}
+		got, err := room.resolveTargets(target, tt.msgType)
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("%s %s: got %v, %v, want %v", tt.target, tt.msgType, got, err, tt.want)
+		}
+	}
+
+	if _, err := room.resolveTargets(&DeviceTarget{Index: 9}, "control"); err == nil {
+		t.Error("a device that is not connected was resolved")
+	}
+	room.setDeviceList([]DeviceInfo{{Index: 0, LinearCount: 1}})
+	if _, err := room.resolveTargets(&DeviceTarget{All: true}, "vibrate"); err == nil {
+		t.Error(`"all" resolved without any device supporting the message`)
+	}
+	if err := json.Unmarshal([]byte(`"some"`), new(DeviceTarget)); err == nil {
+		t.Error(`device target "some" was accepted`)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/buttplugsim"
+)
+
+// deviceFlags collects repeated --device flags of the form "Name:linear=1,vibrate=2,rotate=0".
+type deviceFlags []buttplugsim.DeviceConfig
+
+func (f *deviceFlags) String() string {
+	names := make([]string, 0, len(*f))
+	for _, d := range *f {
+		names = append(names, d.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (f *deviceFlags) Set(value string) error {
+	name, spec, _ := strings.Cut(value, ":")
+	if name == "" {
+		return fmt.Errorf("device name is required")
+	}
+	config := buttplugsim.DeviceConfig{Name: name}
+	if spec != "" {
+		for _, part := range strings.Split(spec, ",") {
+			kind, countStr, ok := strings.Cut(part, "=")
+			if !ok {
+				return fmt.Errorf("invalid actuator spec %q, expected kind=count", part)
+			}
+			count, err := strconv.Atoi(countStr)
+			if err != nil || count < 0 {
+				return fmt.Errorf("invalid actuator count %q", countStr)
+			}
+			switch kind {
+			case "linear":
+				config.Linear = count
+			case "vibrate":
+				config.Vibrate = count
+			case "rotate":
+				config.Rotate = count
+			default:
+				return fmt.Errorf("unknown actuator kind %q (use linear, vibrate or rotate)", kind)
+			}
+		}
+	}
+	*f = append(*f, config)
+	return nil
+}
+
+// runFakeIntiface implements the "fakeintiface" subcommand: a simulated Intiface server that the
+// browser client or the bridge can connect to instead of real hardware.
+func runFakeIntiface(args []string) {
+	fs := flag.NewFlagSet("fakeintiface", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:12345", "Address to serve the Buttplug WebSocket on")
+	report := fs.Duration("report", time.Second, "Interval for logging simulated device state (0 disables)")
+	hotplug := fs.Duration("hotplug", 0, "If set, remove and re-add the last device at this interval to exercise DeviceAdded/DeviceRemoved")
+	var devices deviceFlags
+	fs.Var(&devices, "device", `Simulated device "Name:linear=1,vibrate=2,rotate=0" (repeatable)`)
+	fs.Parse(args)
+
+	if len(devices) == 0 {
+		devices = deviceFlags{
+			{Name: "Simulated Stroker", Linear: 1},
+			{Name: "Simulated Vibrator", Vibrate: 2},
+		}
+	}
+
+	sim := buttplugsim.NewServer("RemoteToys Simulated Intiface")
+	sim.OnCommand = func(cmd buttplugsim.Command) {
+		log.Printf("FakeIntiface: %s for device %d: %s", cmd.Name, cmd.DeviceIndex, string(cmd.Body))
+	}
+	for _, config := range devices {
+		sim.AddDevice(config)
+	}
+
+	if *report > 0 {
+		go reportSimulatedDevices(sim, *report)
+	}
+	if *hotplug > 0 {
+		go hotplugSimulatedDevice(sim, *hotplug)
+	}
+
+	log.Printf("FakeIntiface: serving Buttplug spec v%d on ws://%s with %d device(s)", buttplugsim.MessageVersion, *listen, len(devices))
+	if err := http.ListenAndServe(*listen, sim); err != nil {
+		fmt.Fprintf(os.Stderr, "fakeintiface: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// reportSimulatedDevices periodically logs the position and motor speeds of every simulated device.
+func reportSimulatedDevices(sim *buttplugsim.Server, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, d := range sim.Devices() {
+			var parts []string
+			for i := 0; i < d.Config.Linear; i++ {
+				parts = append(parts, fmt.Sprintf("axis%d=%.3f", i, d.Position(i)))
+			}
+			for i := 0; i < d.Config.Vibrate; i++ {
+				parts = append(parts, fmt.Sprintf("vibrate%d=%.2f", i, d.VibrateSpeed(i)))
+			}
+			for i := 0; i < d.Config.Rotate; i++ {
+				r := d.Rotation(i)
+				parts = append(parts, fmt.Sprintf("rotate%d=%.2f(cw=%v)", i, r.Speed, r.Clockwise))
+			}
+			log.Printf("FakeIntiface: device %d %q: %s", d.Index, d.Config.Name, strings.Join(parts, " "))
+		}
+	}
+}
+
+// hotplugSimulatedDevice alternately removes and re-adds the highest-indexed device.
+func hotplugSimulatedDevice(sim *buttplugsim.Server, interval time.Duration) {
+	var removed *buttplugsim.DeviceConfig
+	for range time.Tick(interval) {
+		if removed != nil {
+			sim.AddDevice(*removed)
+			removed = nil
+			continue
+		}
+		devices := sim.Devices()
+		if len(devices) == 0 {
+			continue
+		}
+		last := devices[len(devices)-1]
+		config := last.Config
+		sim.RemoveDevice(last.Index)
+		removed = &config
+	}
+}
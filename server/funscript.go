@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxFunscriptBytes = 10 << 20 // Upload limit for /api/funscript
+	minPlaybackRate   = 0.1
+	maxPlaybackRate   = 4.0
+)
+
+// FunscriptAction is a single point of a funscript: position pos (0 - 100) at time at (ms).
+type FunscriptAction struct {
+	At  int64   `json:"at"`
+	Pos float64 `json:"pos"`
+}
+
+// Funscript is the subset of the funscript file format the player understands.
+type Funscript struct {
+	Version  string            `json:"version,omitempty"`
+	Inverted bool              `json:"inverted,omitempty"`
+	Range    float64           `json:"range,omitempty"` // Position of a full stroke, 0 means 100
+	Actions  []FunscriptAction `json:"actions"`
+}
+
+// normalize sorts the actions, scales positions to Range, clamps them and applies Inverted, so the
+// player can use them as-is.
+func (s *Funscript) normalize() error {
+	if len(s.Actions) == 0 {
+		return fmt.Errorf("funscript has no actions")
+	}
+	if s.Range < 0 || s.Range > 100 || math.IsNaN(s.Range) {
+		return fmt.Errorf("invalid range %v", s.Range)
+	}
+	scale := 1.0
+	if s.Range > 0 {
+		scale = 100 / s.Range
+	}
+	sort.SliceStable(s.Actions, func(i, j int) bool { return s.Actions[i].At < s.Actions[j].At })
+	for i := range s.Actions {
+		a := &s.Actions[i]
+		if a.At < 0 || math.IsNaN(a.Pos) {
+			return fmt.Errorf("invalid action %d (at=%d, pos=%v)", i, a.At, a.Pos)
+		}
+		a.Pos = math.Max(0, math.Min(100, a.Pos*scale))
+		if s.Inverted {
+			a.Pos = 100 - a.Pos
+		}
+	}
+	s.Inverted = false
+	s.Range = 0
+	if s.durationMs() == 0 {
+		return fmt.Errorf("funscript has no duration, all actions are at 0ms")
+	}
+	return nil
+}
+
+// durationMs returns the timestamp of the last action.
+func (s *Funscript) durationMs() int64 {
+	return s.Actions[len(s.Actions)-1].At
+}
+
+// PlaybackStatusMessage reports the player state to both parties.
+type PlaybackStatusMessage struct {
+	Type       string  `json:"type"`  // Always "playback"
+	State      string  `json:"state"` // "loaded", "playing", "paused", "stopped", "finished"
+	PositionMs int64   `json:"positionMs"`
+	DurationMs int64   `json:"durationMs"`
+	Rate       float64 `json:"rate"`
+	Loop       bool    `json:"loop"`
+	Actions    int     `json:"actions"`
+	Message    string  `json:"message,omitempty"`
+}
+
+// funscriptPlayer schedules LinearCmds for a loaded funscript. Script time advances with the wall clock
+// times rate while playing; each command moves to the next action over the time left until it.
+type funscriptPlayer struct {
+	room   *Room
+	script *Funscript
+	device *DeviceTarget // nil plays on the room's default device
+
+	mu         sync.Mutex
+	playing    bool
+	positionMs float64   // Script time at startedAt (or while paused)
+	startedAt  time.Time // Wall time playback (re)started
+	rate       float64
+	loop       bool
+	stop       chan struct{} // Closed to end the current playback goroutine
+}
+
+// currentMs returns the current script time. Caller must hold p.mu.
+func (p *funscriptPlayer) currentMs() float64 {
+	if !p.playing {
+		return p.positionMs
+	}
+	return p.positionMs + float64(time.Since(p.startedAt).Milliseconds())*p.rate
+}
+
+// halt ends the playback goroutine, keeping the current script time. Caller must hold p.mu.
+func (p *funscriptPlayer) halt() {
+	p.positionMs = p.currentMs()
+	p.playing = false
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+// start (re)starts the playback goroutine from positionMs. Caller must hold p.mu.
+func (p *funscriptPlayer) start() {
+	if p.stop != nil {
+		close(p.stop)
+	}
+	p.playing = true
+	p.startedAt = time.Now()
+	p.stop = make(chan struct{})
+	go p.run(p.stop)
+}
+
+// status builds a PlaybackStatusMessage. Caller must hold p.mu.
+func (p *funscriptPlayer) status(state string, message string) PlaybackStatusMessage {
+	return PlaybackStatusMessage{
+		Type:       "playback",
+		State:      state,
+		PositionMs: int64(p.currentMs()),
+		DurationMs: p.script.durationMs(),
+		Rate:       p.rate,
+		Loop:       p.loop,
+		Actions:    len(p.script.Actions),
+		Message:    message,
+	}
+}
+
+// run sends one LinearCmd per action until the script ends or stop is closed.
+func (p *funscriptPlayer) run(stop chan struct{}) {
+	lastPos := -1.0 // Script position of the previous command, unknown at first
+	for {
+		p.mu.Lock()
+		if p.stop != stop {
+			p.mu.Unlock()
+			return // Superseded by seek/speed/pause
+		}
+		now := p.currentMs()
+		actions := p.script.Actions
+		i := sort.Search(len(actions), func(i int) bool { return float64(actions[i].At) > now })
+		if i == len(actions) {
+			if p.loop {
+				p.positionMs = 0
+				p.startedAt = time.Now()
+				p.mu.Unlock()
+				continue
+			}
+			p.halt()
+			p.positionMs = float64(p.script.durationMs())
+			finished := p.status("finished", "")
+			p.mu.Unlock()
+			p.room.broadcastPlayback(finished)
+			return
+		}
+		next := actions[i]
+		wait := time.Duration((float64(next.At) - now) / p.rate * float64(time.Millisecond))
+		device := p.device
+		p.mu.Unlock()
+
+		// Moves faster than minSafetyDuration are skipped; the wall clock keeps the script in sync
+		wait = max(wait, time.Duration(minSafetyDuration)*time.Millisecond)
+		pos := next.Pos / 100
+		speed := 0.0
+		if lastPos >= 0 {
+			speed = math.Min(1.0, math.Abs(pos-lastPos)/wait.Seconds()/assumedMaxRawSpeed)
+		}
+		msg := ControlMessage{
+			Type:       "control",
+			Position:   pos,
+			Speed:      speed,
+			DurationMs: uint32(wait.Milliseconds()),
+			Device:     device,
+		}
+		p.room.processControlMessage(&msg)
+		lastPos = msg.Position // May have been clamped by the safety profile
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// loadFunscript replaces the room's player with a new, paused one for script.
+func (r *Room) loadFunscript(script *Funscript, device *DeviceTarget) error {
+	if err := script.normalize(); err != nil {
+		return err
+	}
+	player := &funscriptPlayer{room: r, script: script, device: device, rate: 1.0}
+
+	r.mu.Lock()
+	old := r.player
+	r.player = player
+	r.mu.Unlock()
+	if old != nil {
+		old.mu.Lock()
+		old.halt()
+		old.mu.Unlock()
+	}
+
+	log.Printf("Key %s: Loaded funscript with %d actions (%dms)", r.key, len(script.Actions), script.durationMs())
+	player.mu.Lock()
+	loaded := player.status("loaded", "")
+	player.mu.Unlock()
+	r.broadcastPlayback(loaded)
+	return nil
+}
+
+// pausePlayback pauses a running script, e.g. on live input, emergency stop or a disconnect.
+func (r *Room) pausePlayback(reason string) {
+	r.mu.RLock()
+	player := r.player
+	r.mu.RUnlock()
+	if player == nil {
+		return
+	}
+
+	player.mu.Lock()
+	if !player.playing {
+		player.mu.Unlock()
+		return
+	}
+	player.halt()
+	paused := player.status("paused", reason)
+	player.mu.Unlock()
+
+	log.Printf("Key %s: Funscript playback paused: %s", r.key, reason)
+	r.broadcastPlayback(paused)
+}
+
+// stopPlayback stops and rewinds a loaded script, so only a new "play" starts it again.
+func (r *Room) stopPlayback(reason string) {
+	r.mu.RLock()
+	player := r.player
+	r.mu.RUnlock()
+	if player == nil {
+		return
+	}
+
+	player.mu.Lock()
+	if !player.playing && player.positionMs == 0 {
+		player.mu.Unlock()
+		return
+	}
+	player.halt()
+	player.positionMs = 0
+	stopped := player.status("stopped", reason)
+	player.mu.Unlock()
+
+	log.Printf("Key %s: Funscript playback stopped: %s", r.key, reason)
+	r.broadcastPlayback(stopped)
+}
+
+// stopScriptedMotion pauses funscript playback and cancels a replay or pattern, so live input or a stop takes over.
+func (r *Room) stopScriptedMotion(reason string) {
+	r.pausePlayback(reason)
+	r.stopReplay(reason)
+	r.stopPattern(reason)
+}
+
+// cancelScriptedMotion is stopScriptedMotion for emergency stops: the script is stopped, not paused.
+func (r *Room) cancelScriptedMotion(reason string) {
+	r.stopPlayback(reason)
+	r.stopReplay(reason)
+	r.stopPattern(reason)
+}
+
+// handlePlaybackMessage handles a controller's "funscript" and "playback" messages. Errors go back
+// to the controller that sent them.
+func (r *Room) handlePlaybackMessage(controller *Client, msg *ControlMessage) {
+	r.mu.RLock()
+	player := r.player
+	r.mu.RUnlock()
+
+	if msg.Type == "funscript" {
+		if msg.Script == nil {
+			r.sendStatusUpdate(controller, "playback_error", "funscript message without script")
+			return
+		}
+		if err := r.loadFunscript(msg.Script, msg.Device); err != nil {
+			log.Printf("Key %s: Invalid funscript from controller: %v", r.key, err)
+			r.sendStatusUpdate(controller, "playback_error", err.Error())
+		}
+		return
+	}
+
+	if player == nil {
+		r.sendStatusUpdate(controller, "playback_error", "no funscript loaded")
+		return
+	}
+
+	if msg.Action == "play" {
+		r.stopReplay("funscript playback")
+		r.stopPattern("funscript playback")
+	}
+
+	player.mu.Lock()
+	state := "paused"
+	switch msg.Action {
+	case "play":
+		r.mu.RLock()
+		locked := r.locked // Checked under player.mu, so an emergency stop either sees the player running or refuses it
+		r.mu.RUnlock()
+		if locked {
+			player.mu.Unlock()
+			r.sendStatusUpdate(controller, "playback_error", errRoomLocked.Error())
+			return
+		}
+		if !player.playing {
+			if player.positionMs >= float64(player.script.durationMs()) {
+				player.positionMs = 0 // Play again after the end
+			}
+			player.start()
+		}
+	case "pause":
+		player.halt()
+	case "stop":
+		player.halt()
+		player.positionMs = 0
+		state = "stopped"
+	case "seek":
+		wasPlaying := player.playing
+		player.halt()
+		player.positionMs = math.Min(float64(msg.PositionMs), float64(player.script.durationMs()))
+		if wasPlaying {
+			player.start()
+		}
+	case "speed":
+		if msg.Rate < minPlaybackRate || msg.Rate > maxPlaybackRate {
+			player.mu.Unlock()
+			r.sendStatusUpdate(controller, "playback_error", fmt.Sprintf("rate must be between %.1f and %.1f", minPlaybackRate, maxPlaybackRate))
+			return
+		}
+		wasPlaying := player.playing
+		player.halt()
+		player.rate = msg.Rate
+		if wasPlaying {
+			player.start()
+		}
+	case "loop":
+		player.loop = msg.Loop == nil || *msg.Loop
+	default:
+		player.mu.Unlock()
+		r.sendStatusUpdate(controller, "playback_error", fmt.Sprintf("unknown playback action %q", msg.Action))
+		return
+	}
+	if player.playing {
+		state = "playing"
+	}
+	update := player.status(state, "")
+	player.mu.Unlock()
+
+	log.Printf("Key %s: Funscript playback %s: %s at %dms, rate %.2f, loop %v", r.key, msg.Action, update.State, update.PositionMs, update.Rate, update.Loop)
+	if msg.Action == "pause" || msg.Action == "stop" {
+		r.mu.RLock()
+		beikongduan := r.client
+		targets, err := r.resolveTargets(player.device, "stop")
+		r.mu.RUnlock()
+		if err == nil {
+			r.stopDevices(beikongduan, targets)
+		}
+	}
+	r.broadcastPlayback(update)
+}
+
+// broadcastPlayback sends a playback status to the controllers and the client.
+func (r *Room) broadcastPlayback(status PlaybackStatusMessage) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.sendToControllers(status, "playback status")
+	r.sendMessage(r.client, status, "playback status")
+}
+
+// parseDeviceTarget parses a device index or "all" from a query parameter; "" means the default device.
+func parseDeviceTarget(value string) (*DeviceTarget, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if value == "all" {
+		return &DeviceTarget{All: true}, nil
+	}
+	index, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device %q", value)
+	}
+	return &DeviceTarget{Index: uint32(index)}, nil
+}
+
+// handleFunscriptUpload loads a funscript into a room: POST /api/funscript?key=ROOM[&device=N|all].
+// Owned rooms also need ?invite= or ?owner=, like a controller joining them (see authorizeRequest).
+// Playback is then started by the controller with a "playback" message.
+func handleFunscriptUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.URL.Query().Get("key")
+	device, err := parseDeviceTarget(r.URL.Query().Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	roomsMu.RLock()
+	room, ok := rooms[key]
+	var authErr error
+	if ok {
+		_, authErr = authorizeRequest(room, key, r)
+	}
+	roomsMu.RUnlock()
+	if key == "" || !ok {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+	if authErr != nil {
+		http.Error(w, authErr.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxFunscriptBytes))
+	if err != nil {
+		http.Error(w, "funscript too large or unreadable", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var script Funscript
+	if err := json.Unmarshal(body, &script); err != nil {
+		http.Error(w, "invalid funscript JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := room.loadFunscript(&script, device); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"actions":    len(script.Actions),
+		"durationMs": script.durationMs(),
+	})
+}
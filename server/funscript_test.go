@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFunscriptWithoutDurationRejected(t *testing.T) {
+	script := Funscript{Actions: []FunscriptAction{{At: 0, Pos: 10}, {At: 0, Pos: 90}}}
+	if err := script.normalize(); err == nil {
+		t.Fatal("a script with every action at 0ms was accepted; looping it would spin")
+	}
+
+	script = Funscript{Actions: []FunscriptAction{{At: 100, Pos: 10}, {At: 0, Pos: 90}}}
+	if err := script.normalize(); err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	if script.durationMs() != 100 {
+		t.Fatalf("durationMs = %d, want 100", script.durationMs())
+	}
+}
+
+func TestFunscriptRange(t *testing.T) {
+	script := Funscript{Range: 50, Actions: []FunscriptAction{{At: 0, Pos: 0}, {At: 100, Pos: 25}, {At: 200, Pos: 60}}}
+	if err := script.normalize(); err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	for i, want := range []float64{0, 50, 100} {
+		if pos := script.Actions[i].Pos; pos != want {
+			t.Errorf("action %d at %v, want %v scaled to range 50", i, pos, want)
+		}
+	}
+
+	script = Funscript{Range: 90, Inverted: true, Actions: []FunscriptAction{{At: 0, Pos: 0}, {At: 100, Pos: 45}}}
+	if err := script.normalize(); err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	if script.Actions[0].Pos != 100 || script.Actions[1].Pos != 50 {
+		t.Fatalf("inverted actions at %v and %v, want 100 and 50", script.Actions[0].Pos, script.Actions[1].Pos)
+	}
+
+	script = Funscript{Range: -1, Actions: []FunscriptAction{{At: 0, Pos: 0}, {At: 100, Pos: 45}}}
+	if err := script.normalize(); err == nil {
+		t.Fatal("a negative range was accepted")
+	}
+}
+
+func TestFunscriptUpload(t *testing.T) {
+	srv := newTestServer(t)
+	room := addRoom(t, "upload", "")
+
+	upload := func(key string, body string) int {
+		t.Helper()
+		resp, err := http.Post(srv.URL+"/api/funscript?key="+key, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("upload: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := upload("missing", `{"actions":[{"at":0,"pos":0},{"at":500,"pos":100}]}`); code != http.StatusNotFound {
+		t.Fatalf("upload to a missing room: status %d, want %d", code, http.StatusNotFound)
+	}
+	if code := upload("upload", `{"actions":[]}`); code != http.StatusBadRequest {
+		t.Fatalf("upload without actions: status %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := upload("upload", `{"actions":[{"at":0,"pos":0},{"at":500,"pos":100}]}`); code != http.StatusOK {
+		t.Fatalf("upload: status %d, want %d", code, http.StatusOK)
+	}
+
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	if room.player == nil || room.player.script.durationMs() != 500 {
+		t.Fatal("the funscript was not loaded")
+	}
+}
+
+func TestFunscriptUploadNeedsInvite(t *testing.T) {
+	srv := newTestServer(t)
+	room := addRoom(t, "upload-owned", "owner-secret")
+	invite, _ := newInvite("upload-owned", room.owner, time.Minute)
+
+	upload := func(query string) int {
+		t.Helper()
+		resp, err := http.Post(srv.URL+"/api/funscript?key=upload-owned"+query, "application/json",
+			strings.NewReader(`{"actions":[{"at":0,"pos":0},{"at":500,"pos":100}]}`))
+		if err != nil {
+			t.Fatalf("upload: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := upload(""); code != http.StatusUnauthorized {
+		t.Fatalf("upload without invite: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := upload("&owner=wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("upload with a wrong owner secret: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := upload("&invite=" + url.QueryEscape(invite)); code != http.StatusOK {
+		t.Fatalf("upload with invite: status %d, want %d", code, http.StatusOK)
+	}
+	if code := upload("&owner=owner-secret"); code != http.StatusOK {
+		t.Fatalf("upload with the owner secret: status %d, want %d", code, http.StatusOK)
+	}
+}
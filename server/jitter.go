@@ -0,0 +1,233 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	jitterWindow          = 64                     // Transit samples used for offset and jitter estimates
+	jitterPercentile      = 0.95                   // Share of messages the adaptive delay should absorb
+	defaultJitterMaxDelay = 200 * time.Millisecond // Upper bound for the adaptive delay
+	jitterReportInterval  = time.Second            // Max rate of jitter_buffer status updates
+)
+
+// bufferedCommand is a timestamped controller message waiting for its release time.
+type bufferedCommand struct {
+	msg     ControlMessage
+	release time.Time
+}
+
+// jitterBuffer holds timestamped controller messages for a small adaptive delay, so that network
+// jitter does not turn into uneven motion. The controller's clock offset is estimated as the
+// minimum transit time (arrival - sentAt) over recent messages; the delay covers the spread of
+// transit times above that minimum.
+type jitterBuffer struct {
+	room     *Room
+	maxDelay time.Duration
+
+	mu          sync.Mutex
+	transits    []int64 // Recent arrival - sentAt, in ms (includes the clock offset)
+	delay       time.Duration
+	queue       []bufferedCommand // Ordered by release time
+	timer       *time.Timer
+	lastSentAt  int64 // sentAt of the last released message, older arrivals are stale
+	lastReport  time.Time
+	closed      bool
+	late, stale int // Counters for the status report
+}
+
+func newJitterBuffer(room *Room, maxDelay time.Duration) *jitterBuffer {
+	if maxDelay <= 0 || maxDelay > time.Second {
+		maxDelay = defaultJitterMaxDelay
+	}
+	return &jitterBuffer{room: room, maxDelay: maxDelay}
+}
+
+// push queues a controller message according to its sentAt timestamp. Messages without a
+// timestamp are released right away. Caller must not hold r.mu.
+func (b *jitterBuffer) push(msg *ControlMessage, arrival time.Time) {
+	if msg.SentAt == 0 {
+		b.room.processControlMessage(msg)
+		return
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		b.room.processControlMessage(msg)
+		return
+	}
+	if msg.SentAt <= b.lastSentAt {
+		b.stale++
+		b.mu.Unlock()
+		log.Printf("Key %s: Jitter buffer dropped stale message sent at %d", b.room.key, msg.SentAt)
+		return
+	}
+
+	transit := arrival.UnixMilli() - msg.SentAt
+	b.transits = append(b.transits, transit)
+	if len(b.transits) > jitterWindow {
+		b.transits = b.transits[1:]
+	}
+	base, delay := b.estimate()
+	b.delay = delay
+
+	release := time.UnixMilli(msg.SentAt + base).Add(delay)
+	if release.Before(arrival) {
+		b.late++
+		release = arrival
+	}
+	i := sort.Search(len(b.queue), func(i int) bool { return b.queue[i].release.After(release) })
+	b.queue = append(b.queue, bufferedCommand{})
+	copy(b.queue[i+1:], b.queue[i:])
+	b.queue[i] = bufferedCommand{msg: *msg, release: release}
+	b.scheduleLocked()
+	b.mu.Unlock()
+}
+
+// estimate returns the minimum transit (clock offset plus fastest path) and the adaptive delay.
+// Caller must hold b.mu.
+func (b *jitterBuffer) estimate() (int64, time.Duration) {
+	base := b.transits[0]
+	for _, t := range b.transits {
+		base = min(base, t)
+	}
+	spreads := make([]int64, len(b.transits))
+	for i, t := range b.transits {
+		spreads[i] = t - base
+	}
+	sort.Slice(spreads, func(i, j int) bool { return spreads[i] < spreads[j] })
+	index := int(math.Ceil(float64(len(spreads))*jitterPercentile)) - 1
+	delay := time.Duration(spreads[max(index, 0)]) * time.Millisecond
+	return base, min(delay, b.maxDelay)
+}
+
+// scheduleLocked arms the timer for the head of the queue. Caller must hold b.mu.
+func (b *jitterBuffer) scheduleLocked() {
+	if len(b.queue) == 0 {
+		return
+	}
+	wait := time.Until(b.queue[0].release)
+	if b.timer == nil {
+		b.timer = time.AfterFunc(wait, b.releaseDue)
+	} else {
+		b.timer.Reset(wait)
+	}
+}
+
+// releaseDue forwards every message whose release time has come, in order.
+func (b *jitterBuffer) releaseDue() {
+	b.mu.Lock()
+	now := time.Now()
+	var due []ControlMessage
+	for len(b.queue) > 0 && !b.queue[0].release.After(now) {
+		due = append(due, b.queue[0].msg)
+		b.lastSentAt = b.queue[0].msg.SentAt
+		b.queue = b.queue[1:]
+	}
+	b.scheduleLocked()
+	report := time.Since(b.lastReport) >= jitterReportInterval
+	status := b.statusLocked()
+	if report {
+		b.lastReport = now
+	}
+	b.mu.Unlock()
+
+	for i := range due {
+		b.room.processControlMessage(&due[i])
+	}
+	if report {
+		b.room.mu.RLock()
+		b.room.sendToControllers(status, "jitter buffer status")
+		b.room.mu.RUnlock()
+	}
+}
+
+// statusLocked reports the buffer depth and delay as a status update. Caller must hold b.mu.
+func (b *jitterBuffer) statusLocked() StatusUpdateMessage {
+	depth := len(b.queue)
+	delayMs := b.delay.Milliseconds()
+	return StatusUpdateMessage{
+		Type:          "status",
+		State:         "jitter_buffer",
+		BufferDepth:   &depth,
+		BufferDelayMs: &delayMs,
+		BufferLate:    b.late,
+		BufferStale:   b.stale,
+	}
+}
+
+// flush drops every held message, e.g. because a stop overtakes them, and returns how many were dropped.
+func (b *jitterBuffer) flush() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dropped := len(b.queue)
+	b.queue = nil
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	return dropped
+}
+
+// close flushes the buffer and makes further pushes pass straight through.
+func (b *jitterBuffer) close() {
+	b.flush()
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+}
+
+// submitControlMessage forwards live controller input, through the jitter buffer when it is enabled.
+// Stops bypass the buffer and discard the motion it still holds. In "average" mode the buffer is
+// bypassed as well: its clock offset belongs to one controller, and blended input has no single sender.
+func (r *Room) submitControlMessage(msg *ControlMessage, arrival time.Time) {
+	r.mu.RLock()
+	buffer := r.jitter
+	averaging := r.arbitration.mode == "average"
+	r.mu.RUnlock()
+
+	if buffer == nil || averaging {
+		r.processControlMessage(msg)
+		return
+	}
+	if msg.Type == "stop" {
+		if dropped := buffer.flush(); dropped > 0 {
+			log.Printf("Key %s: Stop discarded %d buffered command(s)", r.key, dropped)
+		}
+		r.processControlMessage(msg)
+		return
+	}
+	buffer.push(msg, arrival)
+}
+
+// handleJitterBufferMessage enables or disables the room's jitter buffer ("action": "enable"/"disable").
+func (r *Room) handleJitterBufferMessage(msg *ControlMessage) {
+	r.mu.Lock()
+	old := r.jitter
+	r.jitter = nil
+	if msg.Action == "enable" {
+		r.jitter = newJitterBuffer(r, time.Duration(msg.MaxDelayMs)*time.Millisecond)
+	}
+	current := r.jitter
+	r.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if current != nil {
+		log.Printf("Key %s: Jitter buffer enabled (max delay %v)", r.key, current.maxDelay)
+		current.mu.Lock()
+		status := current.statusLocked()
+		current.mu.Unlock()
+		r.sendToControllers(status, "jitter buffer status")
+	} else {
+		log.Printf("Key %s: Jitter buffer disabled", r.key)
+		r.sendStatusToControllers("jitter_buffer_disabled", "")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitterBufferEstimate(t *testing.T) {
+	b := newJitterBuffer(newTestRoom("jitter"), 50*time.Millisecond)
+	b.transits = []int64{120, 100, 110, 105, 130}
+	base, delay := b.estimate()
+	if base != 100 || delay != 30*time.Millisecond {
+		t.Fatalf("estimate = %d, %v, want base 100 and a 30ms delay", base, delay)
+	}
+
+	// The delay never exceeds the configured maximum
+	b.transits = append(b.transits, 400)
+	if _, delay := b.estimate(); delay != 50*time.Millisecond {
+		t.Fatalf("delay %v, want the 50ms maximum", delay)
+	}
+
+	if b := newJitterBuffer(nil, 5*time.Second); b.maxDelay != defaultJitterMaxDelay {
+		t.Fatalf("max delay %v, want the default %v for an out of range value", b.maxDelay, defaultJitterMaxDelay)
+	}
+}
+
+func TestJitterBufferFlush(t *testing.T) {
+	b := newJitterBuffer(newTestRoom("jitter-flush"), time.Second)
+	b.transits = []int64{0}
+	arrival := time.Now()
+	b.push(&ControlMessage{Type: "control", Position: 0.5, SentAt: arrival.UnixMilli() + 500}, arrival) // Held for 500ms
+	if dropped := b.flush(); dropped != 1 {
+		t.Fatalf("flush dropped %d message(s), want 1", dropped)
+	}
+
+	// Once closed, messages pass straight through instead of being queued
+	b.close()
+	b.push(&ControlMessage{Type: "control", Position: 0.5, SentAt: arrival.UnixMilli() + 500}, arrival)
+	if len(b.queue) != 0 {
+		t.Fatalf("closed buffer queued %d message(s)", len(b.queue))
+	}
+}
+
+func TestJitterBufferReorders(t *testing.T) {
+	client, controller := joinWatchdogRoom(t, "jitter-order", nil)
+	if err := controller.WriteJSON(ControlMessage{Type: "jitterBuffer", Action: "enable"}); err != nil {
+		t.Fatalf("enable: %v", err)
+	}
+	waitStatus(t, controller, "jitter_buffer")
+
+	now := time.Now().UnixMilli()
+	if err := controller.WriteJSON(ControlMessage{Type: "control", Position: 0.1, SentAt: now - 150}); err != nil {
+		t.Fatalf("send control: %v", err)
+	}
+	if cmd := readLinearCmd(t, client); cmd.Vectors[0].Position != 0.1 {
+		t.Fatalf("moved to %v, want 0.1 right away", cmd.Vectors[0].Position)
+	}
+
+	for _, msg := range []ControlMessage{
+		{Type: "control", Position: 0.5, SentAt: now},       // 150ms faster than the first, held for the spread
+		{Type: "control", Position: 0.3, SentAt: now - 40},  // Overtook 0.5 on the way, released before it
+		{Type: "control", Position: 0.9, SentAt: now - 200}, // Older than what was already released: stale
+	} {
+		if err := controller.WriteJSON(msg); err != nil {
+			t.Fatalf("send control: %v", err)
+		}
+	}
+
+	for _, want := range []float64{0.3, 0.5} {
+		if cmd := readLinearCmd(t, client); cmd.Vectors[0].Position != want {
+			t.Fatalf("moved to %v, want %v", cmd.Vectors[0].Position, want)
+		}
+	}
+	room := lookupRoom("jitter-order")
+	room.mu.RLock()
+	buffer := room.jitter
+	room.mu.RUnlock()
+	buffer.mu.Lock()
+	stale := buffer.stale
+	buffer.mu.Unlock()
+	if stale != 1 {
+		t.Fatalf("%d stale message(s), want 1", stale)
+	}
+
+	controller.Close()
+	eventually(t, 2*time.Second, "the controller to leave", func() bool {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return !room.controllerConnected
+	})
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	latencyWindow      = 256              // Samples per leg used for the percentiles
+	statsInterval      = 2 * time.Second  // Max rate of stats messages
+	commandAckTimeout  = 10 * time.Second // Commands without a "forwarded" ack by then count as unacknowledged
+	maxPendingCommands = 1024             // Pending commands are pruned once there are more than this
+
+	// Server command IDs stay clear of the low IDs the client uses for its own Buttplug requests
+	commandIDBase         uint = 1 << 28
+	deviceErrorInterval        = time.Second // Max rate of device_error status updates per room
+	backlogReportInterval      = time.Second // Max rate of client_backlog status updates per room
+)
+
+// buttplugErrorTypes names the error codes of Buttplug's Error message.
+var buttplugErrorTypes = map[int]string{
+	0: "ERROR_UNKNOWN",
+	1: "ERROR_INIT",
+	2: "ERROR_PING",
+	3: "ERROR_MSG",
+	4: "ERROR_DEVICE",
+}
+
+// LatencyStats are rolling percentiles of one leg of the command path, in milliseconds.
+type LatencyStats struct {
+	Count int     `json:"count"` // Samples in the window
+	P50Ms float64 `json:"p50Ms"`
+	P95Ms float64 `json:"p95Ms"`
+	P99Ms float64 `json:"p99Ms"`
+}
+
+// StatsMessage publishes a room's command latencies to the controller and the client.
+type StatsMessage struct {
+	Type               string        `json:"type"`                         // Always "stats"
+	ControllerToServer *LatencyStats `json:"controllerToServer,omitempty"` // Controller sentAt to server arrival, needs a synced controller clock
+	ServerToClient     *LatencyStats `json:"serverToClient,omitempty"`     // Server send to the client handing the command to Intiface
+	ClientToDevice     *LatencyStats `json:"clientToDevice,omitempty"`     // Hand-off to Intiface until its Ok
+	Unacknowledged     int           `json:"unacknowledged"`               // Commands the client never acknowledged
+	Coalesced          int           `json:"coalesced"`                    // Commands replaced by a newer one while the client's send buffer was full
+	Dropped            int           `json:"dropped"`                      // Commands dropped because the client's send buffer was full
+}
+
+// latencySamples is a sliding window of latency samples in milliseconds.
+type latencySamples struct {
+	samples []float64
+}
+
+func (l *latencySamples) add(ms float64) {
+	l.samples = append(l.samples, math.Max(0, ms)) // Clock estimates can push a tiny latency below zero
+	if len(l.samples) > latencyWindow {
+		l.samples = l.samples[1:]
+	}
+}
+
+// stats returns the window's percentiles, or nil if there are no samples.
+func (l *latencySamples) stats() *LatencyStats {
+	if len(l.samples) == 0 {
+		return nil
+	}
+	sorted := append([]float64(nil), l.samples...)
+	sort.Float64s(sorted)
+	percentile := func(p float64) float64 {
+		index := int(math.Ceil(float64(len(sorted))*p)) - 1
+		return math.Round(sorted[max(index, 0)]*10) / 10
+	}
+	return &LatencyStats{Count: len(sorted), P50Ms: percentile(0.50), P95Ms: percentile(0.95), P99Ms: percentile(0.99)}
+}
+
+// pendingCommand is a forwarded command waiting for the client's acknowledgements.
+type pendingCommand struct {
+	command   string // Buttplug message name, e.g. "LinearCmd"
+	device    uint32
+	sent      time.Time
+	forwarded float64 // Client clock of the "forwarded" ack (Unix ms), 0 until it arrives
+}
+
+// commandTracker allocates the IDs of forwarded commands, which are used as their Buttplug message
+// IDs, and turns the client's "commandAck" messages into latency samples.
+type commandTracker struct {
+	mu                 sync.Mutex
+	nextID             uint
+	pending            map[uint]pendingCommand
+	controllerToServer latencySamples
+	serverToClient     latencySamples
+	clientToDevice     latencySamples
+	unacknowledged     int
+	lastPublished      time.Time
+	lastDeviceError    time.Time
+	suppressedErrors   int // Device errors not reported since the last device_error update
+	coalesced          int
+	dropped            int
+	lastBacklogReport  time.Time
+}
+
+// allocate returns a new command ID from the server's range, so Intiface's replies can be matched
+// to the command they answer.
+func (t *commandTracker) allocate() uint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.nextID < commandIDBase || t.nextID >= math.MaxUint32 {
+		t.nextID = commandIDBase // Buttplug IDs are 32 bit
+	}
+	t.nextID++
+	return t.nextID
+}
+
+// sent starts waiting for the acknowledgements of a command queued for the client.
+func (t *commandTracker) sent(id uint, command string, device uint32, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending == nil {
+		t.pending = make(map[uint]pendingCommand)
+	}
+	t.pending[id] = pendingCommand{command: command, device: device, sent: at}
+	if len(t.pending) > maxPendingCommands {
+		t.pruneLocked(at)
+	}
+}
+
+// pruneLocked forgets commands that are too old to still be acknowledged. Caller must hold t.mu.
+func (t *commandTracker) pruneLocked(now time.Time) {
+	for id, command := range t.pending {
+		if now.Sub(command.sent) < commandAckTimeout {
+			continue
+		}
+		if command.forwarded == 0 {
+			t.unacknowledged++
+		}
+		delete(t.pending, id) // Intiface does not reply to every command, a missing Ok is not counted
+	}
+}
+
+// forget stops waiting for a command that was never sent.
+func (t *commandTracker) forget(id uint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, id)
+}
+
+// forgetPending drops all pending commands, e.g. because the client that should acknowledge them left.
+func (t *commandTracker) forgetPending() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = nil
+}
+
+// observeUpstream records a controller to server latency sample.
+func (t *commandTracker) observeUpstream(latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.controllerToServer.add(float64(latency.Microseconds()) / 1000)
+}
+
+// ack records a client acknowledgement and returns the acknowledged command. at is on the client's
+// clock, arrival on the server's.
+func (t *commandTracker) ack(client *Client, id uint, stage string, at float64, arrival time.Time) (pendingCommand, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	command, ok := t.pending[id]
+	if !ok {
+		return pendingCommand{}, false // Unknown, already acknowledged or one of the client's own requests
+	}
+
+	switch stage {
+	case "forwarded":
+		if command.forwarded != 0 {
+			return pendingCommand{}, false
+		}
+		var latency time.Duration
+		if _, _, synced := client.clockEstimate(); synced && at != 0 {
+			latency = client.serverTime(at).Sub(command.sent)
+		} else {
+			latency = arrival.Sub(command.sent) / 2 // No shared clock, assume the ack took as long as the command
+		}
+		t.serverToClient.add(float64(latency.Microseconds()) / 1000)
+		command.forwarded = at
+		t.pending[id] = command
+	case "ok":
+		if command.forwarded != 0 && at != 0 {
+			t.clientToDevice.add(at - command.forwarded) // Both on the client's clock
+		}
+		delete(t.pending, id)
+	case "error":
+		delete(t.pending, id)
+	default:
+		return pendingCommand{}, false
+	}
+	return command, true
+}
+
+// noteBacklog forgets commands that were coalesced or dropped on a full send buffer, counts them
+// and reports whether a client_backlog status is due.
+func (t *commandTracker) noteBacklog(replaced []uint, dropped uint, now time.Time) (int, int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, id := range replaced {
+		delete(t.pending, id)
+	}
+	t.coalesced += len(replaced)
+	if dropped != 0 {
+		delete(t.pending, dropped)
+		t.dropped++
+	}
+	if now.Sub(t.lastBacklogReport) < backlogReportInterval {
+		return t.coalesced, t.dropped, false
+	}
+	t.lastBacklogReport = now
+	return t.coalesced, t.dropped, true
+}
+
+// deviceErrorDue reports whether a device error may be sent to the controller now, and how many
+// were suppressed before it.
+func (t *commandTracker) deviceErrorDue(now time.Time) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.lastDeviceError) < deviceErrorInterval {
+		t.suppressedErrors++
+		return 0, false
+	}
+	t.lastDeviceError = now
+	suppressed := t.suppressedErrors
+	t.suppressedErrors = 0
+	return suppressed, true
+}
+
+// statsDue returns the current stats if none were published for statsInterval.
+func (t *commandTracker) statsDue(now time.Time) (StatsMessage, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.lastPublished) < statsInterval {
+		return StatsMessage{}, false
+	}
+	t.lastPublished = now
+	t.pruneLocked(now)
+	return StatsMessage{
+		Type:               "stats",
+		ControllerToServer: t.controllerToServer.stats(),
+		ServerToClient:     t.serverToClient.stats(),
+		ClientToDevice:     t.clientToDevice.stats(),
+		Unacknowledged:     t.unacknowledged,
+		Coalesced:          t.coalesced,
+		Dropped:            t.dropped,
+	}, true
+}
+
+// sendCommand queues a Buttplug command for the client without blocking and tracks its
+// acknowledgements. When the client's send buffer is full, motion commands are coalesced and the
+// controller is told about the backlog. It reports whether the command was queued.
+func (r *Room) sendCommand(beikongduan *Client, id uint, deviceIndex uint32, cmdJSON []byte) bool {
+	if beikongduan == nil {
+		return false
+	}
+	name := commandName(cmdJSON)
+	now := time.Now()
+	r.commands.sent(id, name, deviceIndex, now) // Before queuing, so even an immediate ack finds it
+	result := beikongduan.queueCommand(id, deviceIndex, name, cmdJSON)
+	if result.queued && len(result.replaced) == 0 {
+		return true
+	}
+
+	var dropped uint
+	if !result.queued {
+		dropped = id
+	}
+	coalesced, droppedTotal, due := r.commands.noteBacklog(result.replaced, dropped, now)
+	if due {
+		log.Printf("Key %s: Client send buffer full: %d command(s) coalesced, %d dropped", r.key, coalesced, droppedTotal)
+		r.mu.RLock()
+		r.sendToControllers(StatusUpdateMessage{
+			Type:      "status",
+			State:     "client_backlog",
+			Message:   "client send buffer full, coalescing motion commands",
+			Coalesced: coalesced,
+			Dropped:   droppedTotal,
+		}, "status update 'client_backlog'")
+		r.mu.RUnlock()
+	}
+	return result.queued
+}
+
+// commandName returns the name of the Buttplug command in a wrapped command message.
+func commandName(cmdJSON []byte) string {
+	var containers []map[string]json.RawMessage
+	if err := json.Unmarshal(cmdJSON, &containers); err != nil || len(containers) == 0 {
+		return ""
+	}
+	for name := range containers[0] {
+		return name
+	}
+	return ""
+}
+
+// recordUpstreamLatency measures how long a timestamped controller message took to reach the server.
+// It needs the controller's clock offset from timeSync.
+func (r *Room) recordUpstreamLatency(controller *Client, msg *ControlMessage, arrival time.Time) {
+	if msg.SentAt == 0 {
+		return
+	}
+	if _, _, synced := controller.clockEstimate(); !synced {
+		return
+	}
+	r.commands.observeUpstream(arrival.Sub(controller.serverTime(float64(msg.SentAt))))
+}
+
+// handleCommandAck records the client's acknowledgement of a forwarded command and publishes stats
+// when they are due.
+func (r *Room) handleCommandAck(client *Client, msg *MessageFromClient, arrival time.Time) {
+	command, ok := r.commands.ack(client, msg.CommandID, msg.Stage, msg.At, arrival)
+	if !ok {
+		return
+	}
+	if msg.Stage == "error" {
+		r.reportDeviceError(msg, command, arrival)
+	}
+	stats, due := r.commands.statsDue(arrival)
+	if !due {
+		return
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.sendToControllers(stats, "stats")
+	r.sendMessage(r.client, stats, "stats")
+}
+
+// reportDeviceError translates Intiface's Error reply to a forwarded command into a "device_error"
+// status for the controllers.
+func (r *Room) reportDeviceError(msg *MessageFromClient, command pendingCommand, arrival time.Time) {
+	errorType, known := buttplugErrorTypes[msg.ErrorCode]
+	if !known {
+		errorType = buttplugErrorTypes[0]
+	}
+	log.Printf("Key %s: Intiface rejected %s %d for DeviceIndex %d: %s (%s)", r.key, command.command, msg.CommandID, command.device, msg.ErrorMessage, errorType)
+
+	suppressed, due := r.commands.deviceErrorDue(arrival)
+	if !due {
+		return
+	}
+	message := msg.ErrorMessage
+	if suppressed > 0 {
+		message = fmt.Sprintf("%s (%d more error(s) suppressed)", message, suppressed)
+	}
+	device := command.device
+	code := msg.ErrorCode
+	status := StatusUpdateMessage{
+		Type:        "status",
+		State:       "device_error",
+		Message:     message,
+		CommandID:   msg.CommandID,
+		Command:     command.command,
+		DeviceIndex: &device,
+		ErrorCode:   &code,
+		ErrorType:   errorType,
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.sendToControllers(status, "device error")
+}
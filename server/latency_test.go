@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLatencySamples(t *testing.T) {
+	var l latencySamples
+	if l.stats() != nil {
+		t.Fatal("stats without samples")
+	}
+	for i := 1; i <= 100; i++ {
+		l.add(float64(i))
+	}
+	l.add(-3) // Clamped to 0
+	if s := l.stats(); s.Count != 101 || s.P50Ms != 50 || s.P95Ms != 95 || s.P99Ms != 99 {
+		t.Fatalf("stats %+v, want 101 samples with p50 50, p95 95 and p99 99", s)
+	}
+
+	for i := 0; i < latencyWindow; i++ {
+		l.add(7)
+	}
+	if s := l.stats(); s.Count != latencyWindow || s.P99Ms != 7 {
+		t.Fatalf("stats %+v, want only the last %d samples", s, latencyWindow)
+	}
+}
+
+func TestCommandTracker(t *testing.T) {
+	var tracker commandTracker
+	client := &Client{Type: "client"} // No timeSync: the ack is assumed to take as long as the command
+	sent := time.Now()
+
+	id := tracker.allocate()
+	if id <= commandIDBase {
+		t.Fatalf("allocated ID %d, want one above the client's range", id)
+	}
+	tracker.sent(id, "LinearCmd", 0, sent)
+	if _, ok := tracker.ack(client, id, "forwarded", 5000, sent.Add(40*time.Millisecond)); !ok {
+		t.Fatal("forwarded ack was not recorded")
+	}
+	if _, ok := tracker.ack(client, id, "forwarded", 5000, sent.Add(40*time.Millisecond)); ok {
+		t.Fatal("a repeated forwarded ack was recorded")
+	}
+	if command, ok := tracker.ack(client, id, "ok", 5012.5, sent.Add(60*time.Millisecond)); !ok || command.command != "LinearCmd" {
+		t.Fatalf("ok ack returned %+v, %v, want the LinearCmd", command, ok)
+	}
+	if _, ok := tracker.ack(client, id, "ok", 5013, sent.Add(70*time.Millisecond)); ok {
+		t.Fatal("an ack for a finished command was recorded")
+	}
+
+	// A command that is never acknowledged counts once it times out
+	tracker.sent(tracker.allocate(), "LinearCmd", 0, sent)
+	stats, due := tracker.statsDue(sent.Add(commandAckTimeout))
+	if !due {
+		t.Fatal("no stats due")
+	}
+	if stats.ServerToClient == nil || stats.ServerToClient.P50Ms != 20 {
+		t.Fatalf("server to client %+v, want 20ms", stats.ServerToClient)
+	}
+	if stats.ClientToDevice == nil || stats.ClientToDevice.P50Ms != 12.5 {
+		t.Fatalf("client to device %+v, want 12.5ms", stats.ClientToDevice)
+	}
+	if stats.ControllerToServer != nil || stats.Unacknowledged != 1 {
+		t.Fatalf("stats %+v, want no upstream samples and one unacknowledged command", stats)
+	}
+	if _, due := tracker.statsDue(sent.Add(commandAckTimeout + time.Second)); due {
+		t.Fatalf("stats due again within %v", statsInterval)
+	}
+}
+
+func TestCommandIDsWrap(t *testing.T) {
+	tracker := commandTracker{nextID: math.MaxUint32 - 1}
+	if id := tracker.allocate(); id != math.MaxUint32 {
+		t.Fatalf("allocated %d, want %d", id, uint(math.MaxUint32))
+	}
+	if id := tracker.allocate(); id != commandIDBase+1 {
+		t.Fatalf("allocated %d after the last 32 bit ID, want %d", id, commandIDBase+1)
+	}
+}
+
+func TestDeviceErrorReported(t *testing.T) {
+	client, controller := joinWatchdogRoom(t, "device-error", nil)
+	room := lookupRoom("device-error")
+
+	fail := func(position float64) {
+		t.Helper()
+		if err := controller.WriteJSON(ControlMessage{Type: "control", Position: position, Speed: 0.5}); err != nil {
+			t.Fatalf("send control: %v", err)
+		}
+		cmd := readLinearCmd(t, client)
+		ack := MessageFromClient{Type: "commandAck", CommandID: cmd.Id, Stage: "error", ErrorCode: 4, ErrorMessage: "device disconnected"}
+		if err := client.WriteJSON(ack); err != nil {
+			t.Fatalf("send commandAck: %v", err)
+		}
+	}
+
+	fail(0.4)
+	msg := waitStatus(t, controller, "device_error")
+	var status StatusUpdateMessage
+	if err := json.Unmarshal(mustMarshal(t, msg), &status); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if status.Command != "LinearCmd" || status.DeviceIndex == nil || *status.DeviceIndex != 0 || status.ErrorType != "ERROR_DEVICE" || status.Message != "device disconnected" {
+		t.Fatalf("device_error %+v, want ERROR_DEVICE for the LinearCmd to device 0", status)
+	}
+
+	// Errors right after the first one are counted and folded into the next report
+	fail(0.6)
+	eventually(t, 2*time.Second, "the second error to be suppressed", func() bool {
+		room.commands.mu.Lock()
+		defer room.commands.mu.Unlock()
+		return room.commands.suppressedErrors == 1
+	})
+
+	controller.Close()
+	eventually(t, 2*time.Second, "the controller to leave", func() bool {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return !room.controllerConnected
+	})
+}
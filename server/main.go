@@ -2,13 +2,18 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
 	"os"            // Added for file operations
 	"path/filepath" // Added for path joining
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -17,32 +22,85 @@ import (
 // Client represents a single websocket connection along with its type.
 type Client struct {
 	conn         *websocket.Conn
-	Type         string    // "controller" or "client"
+	Type         string    // "controller", "client" or "spectator"
 	lastPingTime time.Time // Track last heartbeat time
-	send         chan []byte // Buffered channel for outbound messages
+	send         chan outboundMessage // Buffered channel for outbound messages
+	priority     chan outboundMessage // Stops and safety notices, always written before send
+	held         chan struct{}        // Signalled when commands are held in the overflow
+
+	clock    clockSync       // Clock offset and round trip from timeSync exchanges
+	overflow commandOverflow // Commands waiting for room in the send buffer
+
+	id       string // Room identity of a controller, e.g. "controller-2"
+	name     string // Display name a controller chose with ?name=
+	rank     int    // Controller priority from ?priority=, used in "priority" arbitration mode
+
+	connectedAt time.Time
+	received    atomic.Uint64 // Messages read from the connection
+	sent        atomic.Uint64 // Messages written to the connection
 }
 
-// writePump pumps messages from the send channel to the websocket connection.
+// writePump pumps messages from the priority and send channels to the websocket connection.
+// The priority channel is always drained first.
 func (c *Client) writePump() {
 	ticker := time.NewTicker(54 * time.Second)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
 	}()
+
+	write := func(message outboundMessage) error {
+		if c.superseded(message) {
+			return nil // Motion that a stop for the device already overtook
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := c.conn.WriteMessage(websocket.TextMessage, message.data); err != nil {
+			return err
+		}
+		c.sent.Add(1)
+		return nil
+	}
 	
 	for {
 		select {
+		case message := <-c.priority:
+			if err := write(message); err != nil {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+		case message := <-c.priority:
+			if err := write(message); err != nil {
+				return
+			}
+
+		case <-c.held:
+			for _, held := range c.takeOverflow() {
+				if err := write(held); err != nil {
+					return
+				}
+			}
+
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if !ok {
 				// The send channel was closed.
+				c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 			
-			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			if err := write(message); err != nil {
 				return
 			}
+			// Commands that overflowed the send buffer go out once it is drained
+			for _, held := range c.takeOverflow() {
+				if err := write(held); err != nil {
+					return
+				}
+			}
 			
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
@@ -56,14 +114,35 @@ func (c *Client) writePump() {
 // Room represents a single session identified by a key.
 // It holds the controller and client connections for that session, along with connection status.
 type Room struct {
-	key                   string
-	controller            *Client
-	client                *Client
-	clientDeviceIndex     *uint32 // Use pointer to allow nil. Non-nil implies device selected.
-	lastCommandedPosition float64 // Store the last position sent to the device for this room
-	controllerConnected   bool    // Track if controller is currently connected
-	clientConnected       bool    // Track if client is currently connected
-	mu                    sync.RWMutex
+	key                    string
+	controller             *Client
+	client                 *Client
+	clientDeviceIndex      *uint32                       // Default device for commands without a target. Nil if none selected.
+	devices                map[uint32]DeviceInfo         // All devices reported by the client, keyed by device index
+	lastCommandedPositions map[uint32]map[uint32]float64 // Last position sent to each device axis (device index -> axis index -> position)
+	planners               map[uint32]TrajectoryPlanner  // Trajectory planner per device with motion limits
+	plannerLimits          map[uint32]MotionLimits       // Limits each planner was built with
+	safety                 safetyState                   // Safety profile pushed by the client and its enforcement state
+	locked                 bool                          // Set by the client's emergency stop, drops controller commands until unlocked
+	watchdog               watchdogState                 // Dead-man watchdog for stalled controller input
+	player                 *funscriptPlayer              // Loaded funscript, nil if none
+	recorder               *sessionRecorder              // Running recording of controller input, nil if none
+	replayStop             chan struct{}                 // Closed to cancel the running replay, nil if none
+	pattern                *patternGenerator             // Running pattern generator, nil if none
+	jitter                 *jitterBuffer                 // Jitter buffer for live controller input, nil if disabled
+	commands               commandTracker                // Command IDs and latencies from the client's acknowledgements
+	resume                 map[string]*resumeSlot        // Resume tokens and grace periods per role, nil if resuming is disabled
+	owner                  []byte                        // SHA-256 of the owner secret, nil if anyone with the key may join
+	takeover               string                        // Takeover policy chosen by the client, empty for the server default
+	waiting                []*waitingController          // Controllers waiting for approval or their turn, oldest first
+	takeoverSeq            uint64                        // Last takeover request ID
+	arbitration            arbitrationState              // Multi-controller mode and its controllers
+	spectators             map[*Client]bool              // Read-only connections watching the room
+	spectatorSeq           int                           // Last spectator ID number
+	baseSafety             *SafetyProfile                // Profile from POST /api/rooms, in force until the client pushes its own
+	controllerConnected    bool                          // Track if controller is currently connected
+	clientConnected        bool                          // Track if client is currently connected
+	mu                     sync.RWMutex
 }
 
 // StatusUpdateMessage defines the structure for status updates sent to clients/controllers.
@@ -71,6 +150,32 @@ type StatusUpdateMessage struct {
 	Type    string `json:"type"`    // Always "status"
 	State   string `json:"state"`   // e.g., "waiting_client", "waiting_toy", "ready", "client_disconnected", "controller_disconnected", "controller_present", "waiting_controller"
 	Message string `json:"message"` // Optional: More descriptive message (currently unused)
+
+	// Jitter buffer state, included in "jitter_buffer" updates
+	BufferDepth   *int   `json:"bufferDepth,omitempty"`   // Commands currently held
+	BufferDelayMs *int64 `json:"bufferDelayMs,omitempty"` // Current adaptive delay
+	BufferLate    int    `json:"bufferLate,omitempty"`    // Commands that arrived after their release time
+	BufferStale   int    `json:"bufferStale,omitempty"`   // Commands dropped because a newer one was already released
+
+	// Intiface error for a forwarded command, included in "device_error" updates
+	CommandID   uint    `json:"commandId,omitempty"`   // Buttplug Id of the failed command
+	Command     string  `json:"command,omitempty"`     // e.g. "LinearCmd"
+	DeviceIndex *uint32 `json:"deviceIndex,omitempty"` // Device the command was sent to
+	ErrorCode   *int    `json:"errorCode,omitempty"`   // Buttplug error code
+	ErrorType   string  `json:"errorType,omitempty"`   // e.g. "ERROR_DEVICE"
+
+	// Send buffer backlog totals, included in "client_backlog" updates
+	Coalesced int `json:"coalesced,omitempty"` // Commands replaced by a newer one for the same device
+	Dropped   int `json:"dropped,omitempty"`   // Commands dropped because too many were waiting
+
+	// Controller takeover, included in "takeover_request" and "controller_queued" updates
+	RequestID     uint64 `json:"requestId,omitempty"`     // Answer with {"type":"takeoverDecision","requestId":...,"approve":...}
+	QueuePosition int    `json:"queuePosition,omitempty"` // 1 = next in line
+
+	// Multi-controller roster, included in "controllers" updates
+	Arbitration string           `json:"arbitration,omitempty"` // "turns", "average" or "priority"
+	Controllers []ControllerInfo `json:"controllers,omitempty"` // In join order, which is the turn order
+	Self        string           `json:"self,omitempty"`        // ID of the receiving controller
 }
 
 // Global map to store active rooms, keyed by the unique key.
@@ -88,17 +193,110 @@ var upgrader = websocket.Upgrader{
 
 // ControlMessage represents messages from Controller (Precision Mode)
 type ControlMessage struct {
-	Type             string  `json:"type"`             // "control", "stop"
+	Type             string  `json:"type"`             // "control", "stop", "vibrate", "rotate", "scalar"
 	Position         float64 `json:"position"`         // 0.0 - 1.0
 	Speed            float64 `json:"speed"`            // 0.0 - 1.0 (Client calculated, ignored for duration)
 	SampleIntervalMs uint32  `json:"sampleIntervalMs"` // Client's sample interval
 	IsFinal          bool    `json:"isFinal,omitempty"` // True for final positioning command
+
+	// Targeting for multi-device rooms and multi-axis strokers
+	Device *DeviceTarget `json:"device,omitempty"` // Target device index or "all"; nil uses the room's default device
+	Axes   []AxisCommand `json:"axes,omitempty"`   // Optional per-axis targets for "control", overrides Position/Speed
+
+	// Scripted moves (funscript playback) carry their own timing
+	DurationMs uint32 `json:"durationMs,omitempty"` // Overrides the computed LinearCmd duration; Speed may still lengthen it
+
+	// Jitter buffer: controller timestamps and the "jitterBuffer" message
+	SentAt     int64  `json:"sentAt,omitempty"`     // Controller clock (Unix ms) when the message was sent
+	MaxDelayMs uint32 `json:"maxDelayMs,omitempty"` // Upper bound for the adaptive delay when enabling the buffer
+
+	TimeSyncStamps // Clock synchronization ("timeSync")
+
+	// Fields used by "vibrate", "rotate" and "scalar" messages
+	Intensity     float64           `json:"intensity,omitempty"`     // 0.0 - 1.0, applied to ActuatorIndex when Actuators is empty
+	ActuatorIndex uint32            `json:"actuatorIndex,omitempty"` // Actuator addressed by Intensity (defaults to 0)
+	Clockwise     bool              `json:"clockwise,omitempty"`     // Rotation direction for "rotate"
+	ActuatorType  string            `json:"actuatorType,omitempty"`  // Buttplug ActuatorType for "scalar" (defaults to "Vibrate")
+	Actuators     []ActuatorCommand `json:"actuators,omitempty"`     // Optional per-actuator values, overrides Intensity/ActuatorIndex
+
+	// Fields used by "funscript" (load), "playback", "record" and "replay" messages
+	Script     *Funscript `json:"script,omitempty"`     // Funscript to load for "funscript"
+	Action     string     `json:"action,omitempty"`     // "play", "pause", "seek", "speed", "loop", "stop" for "playback"; "start", "stop" for "record"/"replay"
+	Recording  string     `json:"recording,omitempty"`  // Recording name for "replay"
+	PositionMs uint32     `json:"positionMs,omitempty"` // Script time to seek to
+	Rate       float64    `json:"rate,omitempty"`       // Speed multiplier for "speed"
+	Loop       *bool      `json:"loop,omitempty"`       // Loop setting for "loop"
+
+	// Server-generated motion for "pattern" messages (Action "stop" ends it)
+	Pattern *PatternParams `json:"pattern,omitempty"`
+}
+
+// AxisCommand is the target of a single linear axis in a multi-axis "control" message.
+type AxisCommand struct {
+	Index    uint32  `json:"index"`    // Linear actuator index within the device
+	Position float64 `json:"position"` // 0.0 - 1.0
+	Speed    float64 `json:"speed"`    // 0.0 - 1.0
+}
+
+// linearAxes returns the per-axis targets carried by a "control" message.
+// A message without an explicit Axes list drives axis 0 with Position/Speed.
+func (m *ControlMessage) linearAxes() []AxisCommand {
+	if len(m.Axes) > 0 {
+		return m.Axes
+	}
+	return []AxisCommand{{Index: 0, Position: m.Position, Speed: m.Speed}}
+}
+
+// ActuatorCommand addresses a single actuator of a device in "vibrate", "rotate" and "scalar" messages.
+type ActuatorCommand struct {
+	Index        uint32  `json:"index"`                  // Actuator index within the device
+	Intensity    float64 `json:"intensity"`              // 0.0 - 1.0
+	Clockwise    bool    `json:"clockwise,omitempty"`    // Only used by "rotate"
+	ActuatorType string  `json:"actuatorType,omitempty"` // Only used by "scalar", falls back to the message's ActuatorType
+}
+
+// actuatorCommands returns the per-actuator values carried by the message.
+// A message without an explicit Actuators list addresses a single actuator.
+func (m *ControlMessage) actuatorCommands() []ActuatorCommand {
+	if len(m.Actuators) > 0 {
+		return m.Actuators
+	}
+	return []ActuatorCommand{{
+		Index:        m.ActuatorIndex,
+		Intensity:    m.Intensity,
+		Clockwise:    m.Clockwise,
+		ActuatorType: m.ActuatorType,
+	}}
 }
 
 // MessageFromClient defines messages received FROM the client/beikongduan
 type MessageFromClient struct {
-	Type  string  `json:"type"`  // "setDeviceIndex"
-	Index *uint32 `json:"index"` // Pointer to handle null
+	Type    string         `json:"type"`              // "setDeviceIndex", "deviceList", "safetyProfile", "emergencyStop", "unlock", "timeSync", "commandAck", "createInvite", "takeoverPolicy", "takeoverDecision", "arbitration"
+	Index   *uint32        `json:"index"`             // Pointer to handle null
+	Devices []DeviceInfo   `json:"devices,omitempty"` // Full device list for "deviceList"
+	Profile *SafetyProfile `json:"profile,omitempty"` // Limits for "safetyProfile", nil clears them
+	TimeSyncStamps                                     // Clock synchronization ("timeSync")
+
+	// Acknowledgement of a forwarded command ("commandAck")
+	CommandID uint    `json:"id,omitempty"`    // Buttplug Id of the command
+	Stage     string  `json:"stage,omitempty"` // "forwarded" (handed to Intiface), "ok" or "error" (Intiface's reply)
+	At        float64 `json:"at,omitempty"`    // Client clock (Unix ms) when the stage was reached
+
+	// Intiface's Error reply, for "commandAck" with stage "error"
+	ErrorCode    int    `json:"errorCode,omitempty"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+
+	// Requested validity of a controller invite ("createInvite"), capped by -invite-ttl
+	TTLSec int64 `json:"ttlSec,omitempty"`
+
+	// Controller takeover ("takeoverPolicy", "takeoverDecision")
+	Policy    string `json:"policy,omitempty"`    // "replace", "reject", "approve" or "queue"
+	RequestID uint64 `json:"requestId,omitempty"` // Request being answered
+	Approve   bool   `json:"approve,omitempty"`
+
+	// Multi-controller arbitration ("arbitration")
+	Mode   string `json:"mode,omitempty"`   // "turns", "average", "priority", or empty for a single controller
+	TurnMs int64  `json:"turnMs,omitempty"` // Turn length in "turns" mode
 }
 
 // Handle incoming websocket requests
@@ -107,9 +305,9 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 
 	// Validate client type
-	if clientType != "controller" && clientType != "client" {
+	if clientType != "controller" && clientType != "client" && clientType != "spectator" {
 		log.Printf("Invalid client type: %s", clientType)
-		http.Error(w, "Invalid client type specified. Use ?type=controller or ?type=client", http.StatusBadRequest)
+		http.Error(w, "Invalid client type specified. Use ?type=controller, ?type=client or ?type=spectator", http.StatusBadRequest)
 		return
 	}
 
@@ -127,63 +325,80 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 	}
 	defer ws.Close()
 
+	// Find or create room
+	roomsMu.Lock() // Lock global map for read/write access
+	room, ok := rooms[key]
+	if err := checkRoomKey(key); err != nil {
+		roomsMu.Unlock()
+		log.Printf("Key %s: Rejected %s: %v", key, clientType, err)
+		rejectConnection(ws, closeRoomNotFound, err.Error())
+		return
+	}
+	if !ok && createdRooms[key] != nil {
+		room = newRoom(key) // Joins are checked against the settings the room was created with
+	}
+	if room == nil && clientType == "spectator" {
+		roomsMu.Unlock()
+		log.Printf("Key %s: Rejected spectator: room does not exist", key)
+		rejectConnection(ws, closeRoomNotFound, "room does not exist")
+		return
+	}
+	owner := r.URL.Query().Get("owner")
+	evicted, err := authorizeJoin(room, key, clientType, owner, r.URL.Query().Get("invite"))
+	if err != nil {
+		roomsMu.Unlock()
+		log.Printf("Key %s: Rejected %s: %v", key, clientType, err)
+		rejectConnection(ws, closeUnauthorized, err.Error())
+		return
+	}
+	if !ok {
+		log.Printf("Creating new room for key: %s", key)
+		if room == nil {
+			room = newRoom(key)
+		}
+		if room.owner == nil && clientType == "client" && owner != "" {
+			room.owner = hashOwnerSecret(owner) // Controllers need an invite from now on
+		}
+		rooms[key] = room
+	}
+	roomsMu.Unlock() // Unlock global map
+
 	currentClient := &Client{
 		conn:         ws,
 		Type:         clientType,
 		lastPingTime: time.Now(),
-		send:         make(chan []byte, 256),
+		connectedAt:  time.Now(),
+		send:         make(chan outboundMessage, 256),
+		priority:     make(chan outboundMessage, priorityBufferSize),
+		held:         make(chan struct{}, 1),
 	}
 	
 	// Start the write pump goroutine
 	go currentClient.writePump()
 	log.Printf("Client Connected: Type=%s, Key=%s", clientType, key)
 
-	// Find or create room
-	roomsMu.Lock() // Lock global map for read/write access
-	room, ok := rooms[key]
-	if !ok {
-		log.Printf("Creating new room for key: %s", key)
-		room = &Room{
-			key:                   key,
-			lastCommandedPosition: -1.0, // Initialize room-specific state
-			controllerConnected:   false,
-			clientConnected:       false,
-		}
-		rooms[key] = room
+	if clientType == "spectator" {
+		room.spectate(currentClient) // Read-only, takes no role in the room
+		return
 	}
-	roomsMu.Unlock() // Unlock global map
+
+	// A reconnect within the grace period takes over the dropped connection's room state
+	resumed := room.reclaimRole(clientType, r.URL.Query().Get("resume"))
 
 	// Register client within the specific room and send initial status updates
+	releasedGrace := false // A new controller took the place of one within its grace period
+	tookOver := false      // A new controller with a higher priority took control from another one
 	room.mu.Lock()
 	if clientType == "controller" {
-		if room.controller != nil {
-			log.Printf("Key %s: Replacing existing controller connection", key)
-			// Don't send disconnect to client here, the old controller's defer will handle it if needed
-			room.controller.conn.Close() // Close old connection
-		}
-		room.controller = currentClient
-		room.controllerConnected = true
-
-		// Determine initial state for the new controller
-		clientConnected := room.clientConnected
-		deviceSelected := room.clientDeviceIndex != nil
-		initialControllerState := "unknown" // Should not happen
-		if !clientConnected {
-			initialControllerState = "waiting_client"
-		} else if !deviceSelected {
-			initialControllerState = "waiting_toy"
-		} else {
-			initialControllerState = "ready"
-		}
-		// Send initial state to the new controller (outside lock if possible, but needs room state)
-		// Send it here for simplicity, before unlocking
-		room.sendStatusUpdate(currentClient, initialControllerState, "")
-
-		// Notify client (if connected) that controller is present
-		if room.client != nil {
-			room.sendStatusUpdate(room.client, "controller_present", "")
+		priority, _ := strconv.Atoi(r.URL.Query().Get("priority"))
+		room.nameController(currentClient, r.URL.Query().Get("name"), priority)
+		if room.arbitration.mode != "" {
+			tookOver = room.joinController(currentClient, resumed) // Several controllers share the room
+		} else if admitted, released := room.admitController(currentClient); admitted {
+			// A newcomer to an occupied room is handled by the room's takeover policy
+			room.registerController(currentClient, resumed)
+			releasedGrace = released
 		}
-
 	} else { // clientType == "client"
 		if room.client != nil {
 			log.Printf("Key %s: Replacing existing client/beikongduan connection", key)
@@ -192,8 +407,11 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 		}
 		room.client = currentClient
 		room.clientConnected = true
-		room.clientDeviceIndex = nil      // Reset device index when new client connects
-		room.lastCommandedPosition = -1.0 // Reset position
+		room.sendSession(currentClient, resumed)
+		if !resumed {
+			room.resetDevices()                    // Reset devices and positions when new client connects
+			room.setSafetyProfile(room.baseSafety) // The new client pushes its own safety profile
+		}
 
 		// Determine initial state for the new client
 		controllerConnected := room.controllerConnected
@@ -205,71 +423,115 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 		}
 		room.sendStatusUpdate(currentClient, initialClientState, "")
 
-		// Notify controller (if connected) that client is connected
-		if room.controller != nil {
-			room.sendStatusUpdate(room.controller, "client_connected", "")
+		// Notify controllers (if connected) that client is connected
+		if resumed {
+			room.sendStatusToControllers("client_reconnected", "")
+			if room.locked {
+				room.sendStatusToControllers("locked", "")
+			} else if room.hasDevice() {
+				room.sendStatusToControllers("ready", "")
+			} else {
+				room.sendStatusToControllers("waiting_toy", "")
+			}
+		} else {
+			room.sendStatusToControllers("client_connected", "")
 			// If client connected but no device selected yet, controller should wait for toy
-			if room.clientDeviceIndex == nil {
-				room.sendStatusUpdate(room.controller, "waiting_toy", "")
+			if !room.hasDevice() {
+				room.sendStatusToControllers("waiting_toy", "")
 			}
 		}
 	}
 	room.mu.Unlock()
+	if releasedGrace {
+		room.finishRecording() // The dropped controller's recording ends with its place
+	}
+	if tookOver {
+		room.restAfterHandover(fmt.Sprintf("%s has priority and takes control", currentClient.id))
+	}
+
+	// Connections that joined the open room this client just claimed have no invite. They are sent
+	// away once the client holds the room, so their departure cannot remove it.
+	closeEvicted(evicted)
 
 	// Unregister client on disconnect, update status, notify other party, and potentially clean up room
 	defer func() {
 		// Close the send channel to signal writePump to exit
-		close(currentClient.send)
-		
+		currentClient.closeSend()
+
 		room.mu.Lock()
 		var otherParty *Client = nil
-		var disconnectStatusForOtherParty string = ""
-		var finalStatusForOtherParty string = "" // e.g., waiting_client after client disconnects
+		var nextController *Client // Waiting controller that takes over from this one
+		current := false
+		wasActive, othersRemain := false, false // Multi-controller rooms: this controller drove the devices / others are still connected
+		if clientType == "controller" && room.arbitration.mode != "" {
+			wasActive, othersRemain = room.leaveController(currentClient)
+		}
 
-		if clientType == "controller" && room.controller == currentClient {
+		if othersRemain {
+			log.Printf("Key %s: Controller %s disconnected, %d remain", key, currentClient.id, len(room.arbitration.controllers))
+			if wasActive && room.jitter != nil {
+				room.jitter.flush() // Held input must not play out for the next controller
+			}
+		} else if clientType == "controller" && room.controller == currentClient {
 			log.Printf("Key %s: Controller disconnected", key)
 			room.controller = nil
 			room.controllerConnected = false
+			if room.jitter != nil {
+				room.jitter.flush() // Held input must not play out after the controller is gone
+			}
 			otherParty = room.client
-			disconnectStatusForOtherParty = "controller_disconnected"
-			// Client state doesn't change further here, it just knows controller left
+			nextController = room.nextWaitingController()
+			current = true
+		} else if clientType == "controller" && room.removeWaitingController(currentClient) {
+			log.Printf("Key %s: Waiting controller left", key)
 		} else if clientType == "client" && room.client == currentClient {
 			log.Printf("Key %s: Client/Beikongduan disconnected", key)
 			room.client = nil
 			room.clientConnected = false
-			room.clientDeviceIndex = nil      // Clear index for this room
-			room.lastCommandedPosition = -1.0 // Reset last commanded position for this room
+			room.disarmWatchdog()         // Nothing left to stop
+			room.commands.forgetPending() // Nobody left to acknowledge them
 			otherParty = room.controller
-			disconnectStatusForOtherParty = "client_disconnected"
-			finalStatusForOtherParty = "waiting_client" // Controller goes back to waiting for a client
+			current = true
 		}
 
-		// Send status updates outside the main lock if possible, but need otherParty
-		if otherParty != nil {
-			room.sendStatusUpdate(otherParty, disconnectStatusForOtherParty, "")
-			if finalStatusForOtherParty != "" {
-				room.sendStatusUpdate(otherParty, finalStatusForOtherParty, "")
+		// Within the grace period the room keeps its devices and state for a resuming connection,
+		// unless a waiting controller takes over right away
+		grace := current && nextController == nil && room.startGrace(clientType)
+		if grace && clientType == "client" {
+			room.sendStatusToControllers("client_reconnecting", "")
+		} else if grace {
+			room.sendStatusUpdate(otherParty, "controller_reconnecting", "")
+		}
+		room.mu.Unlock()
+
+		if othersRemain {
+			if wasActive {
+				// Whoever takes over starts from rest, like after a turn change
+				room.stopScriptedMotion("controller disconnected")
+				room.safeStop("watchdog_stop", "controller disconnected")
 			}
+			return
 		}
 
-		// Check if room is now empty (using the boolean flags is safer)
-		controllerStillConnected := room.controllerConnected
-		clientStillConnected := room.clientConnected
-		room.mu.Unlock() // Unlock room mutex before potentially locking global mutex
+		if !current {
+			return // Replaced by a newer connection, which owns the room state now
+		}
 
-		// Cleanup room if empty
-		if !controllerStillConnected && !clientStillConnected {
-			roomsMu.Lock()
-			// Double-check inside the lock
-			room.mu.RLock()
-			isEmpty := !room.controllerConnected && !room.clientConnected
-			room.mu.RUnlock()
+		// A controller that drops out (or times out) mid-stroke must not leave the device running,
+		// even if it comes back within the grace period
+		if clientType == "controller" {
+			room.stopScriptedMotion("controller disconnected")
+			room.safeStop("watchdog_stop", "controller disconnected")
+		} else {
+			room.stopScriptedMotion("client disconnected")
+		}
 
-			if isEmpty {
-				log.Printf("Key %s: Room is empty, removing.", key)
-				delete(rooms, key)
+		if !grace {
+			room.releaseRole(clientType)
+			if nextController != nil {
+				room.promoteController(nextController)
 			}
-			roomsMu.Unlock()
+			room.removeIfEmpty()
 		}
 	}()
 
@@ -281,6 +543,63 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// registerController makes c the room's controller and sends it the current room state.
+// Caller must hold r.mu.
+func (r *Room) registerController(c *Client, resumed bool) {
+	r.controller = c
+	r.controllerConnected = true
+	r.sendSession(c, resumed)
+	r.sendControllerState(c)
+
+	// Notify client (if connected) that controller is present
+	if r.client != nil {
+		r.sendStatusUpdate(r.client, "controller_present", "")
+	}
+}
+
+// sendControllerState sends a joining controller the room's state, devices and safety profile.
+// Caller must hold r.mu.
+func (r *Room) sendControllerState(c *Client) {
+	// Determine initial state for the new controller
+	clientConnected := r.clientConnected
+	deviceSelected := r.hasDevice()
+	initialControllerState := "unknown" // Should not happen
+	if r.locked {
+		initialControllerState = "locked"
+	} else if !clientConnected {
+		initialControllerState = "waiting_client"
+	} else if !deviceSelected {
+		initialControllerState = "waiting_toy"
+	} else {
+		initialControllerState = "ready"
+	}
+	// Send initial state to the new controller (outside lock if possible, but needs room state)
+	// Send it here for simplicity, before unlocking
+	r.sendStatusUpdate(c, initialControllerState, "")
+	if deviceSelected {
+		r.sendMessage(c, r.deviceListMessage(), "devices")
+	}
+	if r.safety.profile != nil {
+		r.sendMessage(c, SafetyProfileMessage{Type: "safety", Profile: r.safety.profile}, "safety profile")
+	}
+}
+
+// removeIfEmpty deletes the room once nobody is connected and no dropped connection may still resume.
+func (r *Room) removeIfEmpty() {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	r.mu.RLock()
+	isEmpty := !r.controllerConnected && !r.clientConnected && !r.inGrace()
+	r.mu.RUnlock()
+
+	if isEmpty && rooms[r.key] == r {
+		log.Printf("Key %s: Room is empty, removing.", r.key)
+		delete(rooms, r.key)
+		r.dismissSpectators()
+	}
+}
+
 // Reads messages from the controller and forwards commands to the client/beikongduan within the same room.
 func handleControllerMessages(controller *Client, room *Room) { // Added room parameter
 	defer func() {
@@ -291,6 +610,7 @@ func handleControllerMessages(controller *Client, room *Room) { // Added room pa
 	for {
 		var msg ControlMessage
 		err := controller.conn.ReadJSON(&msg)
+		arrival := time.Now()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("Key %s: Controller read error: %v", room.key, err)
@@ -301,77 +621,195 @@ func handleControllerMessages(controller *Client, room *Room) { // Added room pa
 			break
 		}
 
+		controller.received.Add(1)
 		log.Printf("Key %s: Received from controller: %+v", room.key, msg)
 
-		var buttplugCmdJSON []byte
-		var constructErr error
+		if msg.Type == "ping" {
+			// Handle heartbeat ping (before device checks, so heartbeats work while waiting for a toy)
+			room.mu.Lock()
+			if room.isRoomController(controller) {
+				controller.lastPingTime = time.Now()
+				log.Printf("Key %s: Received ping from controller, updated lastPingTime", room.key)
+			}
+			room.mu.Unlock()
+			continue // Don't need to forward ping to client
+		}
 
-		// Get target device index and last position safely from the room
+		// A controller waiting for approval or its turn may only keep its clock in sync
 		room.mu.RLock()
-		targetIndex := room.clientDeviceIndex
-		currentLastPos := room.lastCommandedPosition // Read last commanded position for this room
+		active := room.acceptsInput(controller)
 		room.mu.RUnlock()
-
-		if targetIndex == nil {
-			log.Printf("Key %s: Command dropped: Client device index not set in this room.", room.key)
+		if !active && msg.Type != "timeSync" {
+			log.Printf("Key %s: Ignoring %s from %s, it does not have control", room.key, msg.Type, controller.id)
 			continue
 		}
 
 		switch msg.Type {
-		case "ping":
-			// Handle heartbeat ping
-			room.mu.Lock()
-			if room.controller == controller {
-				controller.lastPingTime = time.Now()
-				log.Printf("Key %s: Received ping from controller, updated lastPingTime", room.key)
-			}
-			room.mu.Unlock()
-			continue // Don't need to forward ping to client
-		case "control":
-			log.Printf("Key %s: Constructing LinearCmd for DeviceIndex %d: Pos=%.2f, Speed=%.2f, Interval=%dms, IsFinal=%v",
-				room.key, *targetIndex, msg.Position, msg.Speed, msg.SampleIntervalMs, msg.IsFinal)
-			// Pass interval, speed, last position, and isFinal flag to calculate Duration
-			buttplugCmdJSON, constructErr = constructLinearCmd(*targetIndex, msg.Position, msg.Speed, msg.SampleIntervalMs, currentLastPos, msg.IsFinal)
-			if constructErr != nil {
-				log.Printf("Key %s: Error constructing LinearCmd: %v", room.key, constructErr)
-				continue
-			}
-		case "stop":
-			log.Printf("Key %s: Constructing StopDeviceCmd for DeviceIndex %d", room.key, *targetIndex)
-			buttplugCmdJSON, constructErr = constructStopCmd(*targetIndex)
-			if constructErr != nil {
-				log.Printf("Key %s: Error constructing StopDeviceCmd: %v", room.key, constructErr)
-				continue
-			}
+		case "funscript", "playback":
+			room.handlePlaybackMessage(controller, &msg)
+		case "record", "replay":
+			room.handleRecordMessage(controller, &msg)
+		case "pattern":
+			room.handlePatternMessage(controller, &msg)
+		case "jitterBuffer":
+			room.handleJitterBufferMessage(&msg)
+		case "timeSync":
+			room.handleTimeSync(controller, msg.TimeSyncStamps, arrival)
 		default:
-			log.Printf("Key %s: Unknown message type from controller: %s", room.key, msg.Type)
+			room.stopScriptedMotion("live control") // Live input takes over from a running script, replay or pattern
+			room.recordUpstreamLatency(controller, &msg, arrival)
+			room.blendPosition(controller, &msg)
+			room.recordControlMessage(&msg)
+			room.submitControlMessage(&msg, arrival)
+		}
+	}
+}
+
+// processControlMessage enforces the room's safety profile on a motion message, translates it into
+// Buttplug commands for each target device and forwards them to the client/beikongduan.
+func (r *Room) processControlMessage(msg *ControlMessage) {
+	// Resolve target devices, their last positions and the client safely from the room
+	r.mu.Lock()
+	if r.locked {
+		r.mu.Unlock()
+		log.Printf("Key %s: Command dropped: Room is locked by the client's emergency stop", r.key)
+		return
+	}
+	targets, targetErr := r.resolveTargets(msg.Device, msg.Type)
+	lastPositions := make(map[uint32]map[uint32]float64, len(targets))
+	planners := make(map[uint32]TrajectoryPlanner, len(targets))
+	for _, index := range targets {
+		lastPositions[index] = r.axisPositions(index)
+		planners[index] = r.planners[index]
+	}
+	var violations []string
+	var safetyErr error
+	if targetErr == nil {
+		violations, safetyErr = r.enforceSafety(msg, targets, lastPositions)
+	}
+	reportViolation := (len(violations) > 0 || safetyErr != nil) && r.shouldReportViolation()
+	maxSpeed := r.maxSpeed()
+	controller := r.controller
+	beikongduan := r.client // Get the client specific to this room
+	r.mu.Unlock()
+
+	if targetErr != nil {
+		log.Printf("Key %s: Command dropped: %v", r.key, targetErr)
+		return
+	}
+
+	if errors.Is(safetyErr, errSafetySessionExpired) {
+		log.Printf("Key %s: Command dropped: %v, stopping devices", r.key, safetyErr)
+		if reportViolation {
+			r.sendPriorityStatusUpdate(controller, "session_expired", safetyErr.Error())
+			r.sendPriorityStatusUpdate(beikongduan, "session_expired", safetyErr.Error())
+		}
+		r.stopDevices(beikongduan, targets)
+		return
+	}
+	if reportViolation {
+		state := "safety_violation"
+		detail := strings.Join(violations, "; ")
+		if safetyErr != nil {
+			detail = "rejected: " + detail
+		} else {
+			detail = "clamped: " + detail
+		}
+		r.sendPriorityStatusUpdate(controller, state, detail)
+		r.sendPriorityStatusUpdate(beikongduan, state, detail)
+	}
+	if safetyErr != nil {
+		log.Printf("Key %s: Command rejected by safety profile: %v", r.key, safetyErr)
+		return
+	}
+	if len(violations) > 0 {
+		log.Printf("Key %s: Command clamped by safety profile: %s", r.key, strings.Join(violations, "; "))
+	}
+
+	forwarded := false
+	for _, targetIndex := range targets {
+		commandID := r.commands.allocate()
+		buttplugCmdJSON, constructErr := constructCommand(msg, commandID, targetIndex, lastPositions[targetIndex], maxSpeed, planners[targetIndex])
+		if constructErr != nil {
+			log.Printf("Key %s: Error constructing command for DeviceIndex %d: %v", r.key, targetIndex, constructErr)
 			continue
 		}
 
 		// Forward the command to the client/beikongduan in the same room if connected
-		room.mu.RLock()
-		beikongduan := room.client // Get the client specific to this room
-		room.mu.RUnlock()
-
-		if beikongduan != nil && buttplugCmdJSON != nil {
-			// Non-blocking send to the client's send channel
-			select {
-			case beikongduan.send <- buttplugCmdJSON:
-				log.Printf("Key %s: Forwarded command to client/beikongduan: %s", room.key, string(buttplugCmdJSON))
-				// Update last commanded position for this room AFTER queuing
-				room.mu.Lock()
-				room.lastCommandedPosition = msg.Position
-				room.mu.Unlock()
-			default:
-				// Channel is full, drop the message
-				log.Printf("Key %s: Command dropped: Client send buffer full", room.key)
+		if beikongduan == nil {
+			log.Printf("Key %s: Command dropped: Client/Beikongduan not connected in this room.", r.key)
+			break
+		}
+		// Non-blocking send to the client's send channel
+		if r.sendCommand(beikongduan, commandID, targetIndex, buttplugCmdJSON) {
+			log.Printf("Key %s: Forwarded command to client/beikongduan: %s", r.key, string(buttplugCmdJSON))
+			forwarded = true
+			// Update last commanded positions for this device AFTER queuing (only linear commands move the stroker)
+			if msg.Type == "control" {
+				r.mu.Lock()
+				r.setAxisPositions(targetIndex, msg.linearAxes())
+				r.mu.Unlock()
 			}
-		} else if beikongduan == nil {
-			log.Printf("Key %s: Command dropped: Client/Beikongduan not connected in this room.", room.key)
+		} else {
+			// Channel is full, drop the message
+			log.Printf("Key %s: Command dropped: Client send buffer full", r.key)
+		}
+	}
+
+	if forwarded {
+		r.mu.Lock()
+		r.feedWatchdog(msg.Type)
+		r.mu.Unlock()
+	}
+}
+
+// stopDevices sends a StopDeviceCmd for each of the given devices to the client/beikongduan.
+func (r *Room) stopDevices(beikongduan *Client, devices []uint32) {
+	if beikongduan == nil {
+		return
+	}
+	for _, deviceIndex := range devices {
+		commandID := r.commands.allocate()
+		stopJSON, err := constructStopCmd(commandID, deviceIndex)
+		if err != nil {
+			log.Printf("Key %s: Error constructing StopDeviceCmd: %v", r.key, err)
+			continue
+		}
+		if r.sendCommand(beikongduan, commandID, deviceIndex, stopJSON) {
+			log.Printf("Key %s: Sent StopDeviceCmd for DeviceIndex %d", r.key, deviceIndex)
+		} else {
+			log.Printf("Key %s: StopDeviceCmd for DeviceIndex %d dropped: Client send buffer full", r.key, deviceIndex)
 		}
 	}
 }
 
+// constructCommand translates a controller message into the Buttplug command with message ID id for a single device.
+// lastPositions holds the device's last commanded position per axis; maxSpeed (0 = unlimited) caps linear moves
+// and planner (nil = none) shapes them to the device's motion limits.
+func constructCommand(msg *ControlMessage, id uint, deviceIndex uint32, lastPositions map[uint32]float64, maxSpeed float64, planner TrajectoryPlanner) ([]byte, error) {
+	switch msg.Type {
+	case "control":
+		log.Printf("Constructing LinearCmd for DeviceIndex %d: Axes=%+v, Interval=%dms, IsFinal=%v",
+			deviceIndex, msg.linearAxes(), msg.SampleIntervalMs, msg.IsFinal)
+		// Pass interval, per-axis speeds, last positions, and isFinal flag to calculate Durations
+		return constructLinearCmd(id, deviceIndex, msg.linearAxes(), msg.SampleIntervalMs, msg.DurationMs, lastPositions, msg.IsFinal, maxSpeed, planner)
+	case "vibrate":
+		log.Printf("Constructing vibrate ScalarCmd for DeviceIndex %d: Actuators=%+v", deviceIndex, msg.actuatorCommands())
+		return constructVibrateCmd(id, deviceIndex, msg.actuatorCommands())
+	case "rotate":
+		log.Printf("Constructing RotateCmd for DeviceIndex %d: Actuators=%+v", deviceIndex, msg.actuatorCommands())
+		return constructRotateCmd(id, deviceIndex, msg.actuatorCommands())
+	case "scalar":
+		log.Printf("Constructing ScalarCmd for DeviceIndex %d: Actuators=%+v", deviceIndex, msg.actuatorCommands())
+		return constructScalarCmd(id, deviceIndex, msg.actuatorCommands(), msg.ActuatorType)
+	case "stop":
+		log.Printf("Constructing StopDeviceCmd for DeviceIndex %d", deviceIndex)
+		return constructStopCmd(id, deviceIndex)
+	default:
+		return nil, fmt.Errorf("unknown message type from controller: %s", msg.Type)
+	}
+}
+
 // Handles messages received FROM the client/beikongduan within a specific room.
 func handleClientMessages(client *Client, room *Room) { // Added room parameter
 	defer func() {
@@ -382,6 +820,7 @@ func handleClientMessages(client *Client, room *Room) { // Added room parameter
 	for {
 		var msg MessageFromClient
 		err := client.conn.ReadJSON(&msg)
+		arrival := time.Now()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("Key %s: Client/Beikongduan read error: %v", room.key, err)
@@ -392,6 +831,7 @@ func handleClientMessages(client *Client, room *Room) { // Added room parameter
 			break
 		}
 
+		client.received.Add(1)
 		log.Printf("Key %s: Received from client/beikongduan: %+v", room.key, msg)
 
 		switch msg.Type {
@@ -406,44 +846,117 @@ func handleClientMessages(client *Client, room *Room) { // Added room parameter
 			room.mu.Lock() // Lock the specific room
 			if msg.Index == nil {
 				log.Printf("Key %s: Client reported device index removed/unset.", room.key)
+				if room.clientDeviceIndex != nil {
+					delete(room.devices, *room.clientDeviceIndex)
+					delete(room.lastCommandedPositions, *room.clientDeviceIndex) // Reset position for this device
+				}
 				room.clientDeviceIndex = nil
-				room.lastCommandedPosition = -1.0 // Reset position for this room
 			} else {
 				log.Printf("Key %s: Client reported device index: %d", room.key, *msg.Index)
 				newIndex := *msg.Index // Store a copy
-				// Reset position if device index changes within the room
+				// Reset position if the default device changes within the room
 				if room.clientDeviceIndex == nil || *room.clientDeviceIndex != newIndex {
 					log.Printf("Key %s: Device index changed (or was set), resetting last commanded position.", room.key)
-					room.lastCommandedPosition = -1.0
+					delete(room.lastCommandedPositions, newIndex)
 				} else {
 					log.Printf("Key %s: Device index (%d) remains the same.", room.key, newIndex)
 				}
+				if _, known := room.devices[newIndex]; !known {
+					room.devices[newIndex] = DeviceInfo{Index: newIndex} // Legacy clients never send a device list
+				}
 				room.clientDeviceIndex = &newIndex
 			}
-			// Notify controller about the device status change
-			controller := room.controller // Get controller reference while locked
-			deviceSelected := room.clientDeviceIndex != nil
 			room.mu.Unlock() // Unlock the specific room
 
-			if controller != nil {
-				if deviceSelected {
-					room.sendStatusUpdate(controller, "ready", "")
-				} else {
-					room.sendStatusUpdate(controller, "waiting_toy", "")
+			room.notifyDeviceChange(client)
+
+		case "deviceList":
+			room.mu.Lock()
+			log.Printf("Key %s: Client reported %d device(s): %+v", room.key, len(msg.Devices), msg.Devices)
+			room.setDeviceList(msg.Devices)
+			room.mu.Unlock()
+
+			room.notifyDeviceChange(client)
+
+		case "safetyProfile":
+			if msg.Profile != nil {
+				if err := msg.Profile.normalize(); err != nil {
+					log.Printf("Key %s: Invalid safety profile from client: %v", room.key, err)
+					room.sendStatusUpdate(client, "safety_profile_invalid", err.Error())
+					break
 				}
 			}
-			
-			// Also notify the client itself about the ready status
-			if deviceSelected && client != nil {
-				room.sendStatusUpdate(client, "ready", "")
+			room.mu.Lock()
+			log.Printf("Key %s: Client set safety profile: %+v", room.key, msg.Profile)
+			room.setSafetyProfile(msg.Profile)
+			controllers := room.controllerTargets()
+			room.mu.Unlock()
+
+			notice := SafetyProfileMessage{Type: "safety", Profile: msg.Profile}
+			room.sendMessage(client, notice, "safety profile")
+			for _, controller := range controllers {
+				room.sendMessage(controller, notice, "safety profile")
 			}
 
+		case "emergencyStop":
+			room.emergencyStop(client)
+
+		case "timeSync":
+			room.handleTimeSync(client, msg.TimeSyncStamps, arrival)
+
+		case "commandAck":
+			room.handleCommandAck(client, &msg, arrival)
+
+		case "unlock":
+			room.unlock(client)
+
+		case "createInvite":
+			room.handleCreateInvite(client, &msg)
+
+		case "takeoverPolicy":
+			room.setTakeoverPolicy(client, msg.Policy)
+
+		case "takeoverDecision":
+			room.decideTakeover(msg.RequestID, msg.Approve, "takeover denied by the client")
+
+		case "arbitration":
+			room.setArbitration(client, &msg)
+
 		default:
 			log.Printf("Key %s: Unknown message type from client/beikongduan: %s", room.key, msg.Type)
 		}
 	}
 }
 
+// notifyDeviceChange tells the controller (and the reporting client) about the room's current devices.
+func (r *Room) notifyDeviceChange(client *Client) {
+	r.mu.RLock()
+	controllers := r.controllerTargets() // Get controller references while locked
+	deviceSelected := r.hasDevice()
+	deviceList := r.deviceListMessage()
+	locked := r.locked
+	for _, spectator := range r.spectatorList() {
+		r.sendMessage(spectator, deviceList, "devices") // Under the lock, spectators close their send channel under it
+	}
+	r.mu.RUnlock()
+
+	for _, controller := range controllers {
+		r.sendMessage(controller, deviceList, "devices")
+		if locked {
+			r.sendStatusUpdate(controller, "locked", "")
+		} else if deviceSelected {
+			r.sendStatusUpdate(controller, "ready", "")
+		} else {
+			r.sendStatusUpdate(controller, "waiting_toy", "")
+		}
+	}
+
+	// Also notify the client itself about the ready status
+	if deviceSelected && client != nil {
+		r.sendStatusUpdate(client, "ready", "")
+	}
+}
+
 // sendStatusUpdate sends a status update message to a specific client in the room.
 // NOTE: This method assumes the caller handles locking if necessary to read room state
 // before calling. It does NOT lock the room mutex itself.
@@ -457,29 +970,70 @@ func (r *Room) sendStatusUpdate(targetClient *Client, state string, message stri
 		State:   state,
 		Message: message, // Can be empty
 	}
+	r.sendMessage(targetClient, statusMsg, "status update '"+state+"'")
+}
+
+// sendMessage marshals a server message (status, devices, ...) and queues it for a specific client.
+// Like sendStatusUpdate, it does NOT lock the room mutex itself.
+func (r *Room) sendMessage(targetClient *Client, msg interface{}, label string) {
+	r.queueMessage(targetClient, msg, label, false)
+}
+
+// sendPriorityStatusUpdate is sendStatusUpdate for safety notices (locks, violations, watchdog
+// stops), which overtake everything waiting in the target's send buffer.
+func (r *Room) sendPriorityStatusUpdate(targetClient *Client, state string, message string) {
+	statusMsg := StatusUpdateMessage{
+		Type:    "status",
+		State:   state,
+		Message: message,
+	}
+	r.queueMessage(targetClient, statusMsg, "priority status update '"+state+"'", true)
+}
+
+func (r *Room) queueMessage(targetClient *Client, msg interface{}, label string, priority bool) {
+	if targetClient == nil || targetClient.conn == nil {
+		return // Don't send if client is not connected or nil
+	}
 
 	// Convert to JSON
-	msgJSON, err := json.Marshal([]interface{}{statusMsg})
+	msgJSON, err := json.Marshal([]interface{}{msg})
 	if err != nil {
-		log.Printf("Key %s: Error marshaling status update: %v", r.key, err)
+		log.Printf("Key %s: Error marshaling %s: %v", r.key, label, err)
 		return
 	}
 
+	// The overflow lock keeps the send channel open while we queue, see closeSend
+	targetClient.overflow.mu.Lock()
+	defer targetClient.overflow.mu.Unlock()
+	if targetClient.overflow.closed {
+		return
+	}
+
+	if priority {
+		select {
+		case targetClient.priority <- outboundMessage{data: msgJSON}:
+			log.Printf("Key %s: Sent %s to %s", r.key, label, targetClient.Type)
+			return
+		default:
+			// Priority lane full, fall back to the send channel
+		}
+	}
+
 	// Non-blocking send to the client's send channel
 	select {
-	case targetClient.send <- msgJSON:
-		log.Printf("Key %s: Sent status update '%s' to %s", r.key, state, targetClient.Type)
+	case targetClient.send <- outboundMessage{data: msgJSON}:
+		log.Printf("Key %s: Sent %s to %s", r.key, label, targetClient.Type)
 	default:
 		// Channel is full, log but don't block
-		log.Printf("Key %s: Status update '%s' dropped for %s: send buffer full", r.key, state, targetClient.Type)
+		log.Printf("Key %s: %s dropped for %s: send buffer full", r.key, label, targetClient.Type)
 	}
 }
 
 // --- Buttplug Message Construction ---
 
 const (
-	ButtplugMsgID     uint   = 1  // Use a fixed ID for commands sent to the server
-	minSafetyDuration uint32 = 20 // Ensure duration is at least 20ms - reduced for better responsiveness
+	minSafetyDuration  uint32  = 20  // Ensure duration is at least 20ms - reduced for better responsiveness
+	assumedMaxRawSpeed float64 = 5.0 // Maximum physical speed (units per second) when speed=1.0
 )
 
 type ButtplugLinearVector struct {
@@ -499,6 +1053,40 @@ type ButtplugStopDeviceCmd struct {
 	DeviceIndex uint32 `json:"DeviceIndex"`
 }
 
+type ButtplugRotation struct {
+	Index     uint32  `json:"Index"`
+	Speed     float64 `json:"Speed"`
+	Clockwise bool    `json:"Clockwise"`
+}
+
+type ButtplugRotateCmd struct {
+	Id          uint               `json:"Id"`
+	DeviceIndex uint32             `json:"DeviceIndex"`
+	Rotations   []ButtplugRotation `json:"Rotations"`
+}
+
+type ButtplugScalar struct {
+	Index        uint32  `json:"Index"`
+	Scalar       float64 `json:"Scalar"`
+	ActuatorType string  `json:"ActuatorType"`
+}
+
+type ButtplugScalarCmd struct {
+	Id          uint             `json:"Id"`
+	DeviceIndex uint32           `json:"DeviceIndex"`
+	Scalars     []ButtplugScalar `json:"Scalars"`
+}
+
+// validActuatorTypes lists the ActuatorType values accepted by Buttplug's ScalarCmd.
+var validActuatorTypes = map[string]bool{
+	"Vibrate":   true,
+	"Rotate":    true,
+	"Oscillate": true,
+	"Constrict": true,
+	"Inflate":   true,
+	"Position":  true,
+}
+
 // Helper function to wrap a command message in the Buttplug array format
 func wrapButtplugMessage(command interface{}) ([]byte, error) {
 	var cmdMap map[string]interface{}
@@ -507,6 +1095,10 @@ func wrapButtplugMessage(command interface{}) ([]byte, error) {
 		cmdMap = map[string]interface{}{"LinearCmd": v}
 	case ButtplugStopDeviceCmd:
 		cmdMap = map[string]interface{}{"StopDeviceCmd": v}
+	case ButtplugRotateCmd:
+		cmdMap = map[string]interface{}{"RotateCmd": v}
+	case ButtplugScalarCmd:
+		cmdMap = map[string]interface{}{"ScalarCmd": v}
 	default:
 		return nil, fmt.Errorf("unknown buttplug command type: %T", command)
 	}
@@ -514,13 +1106,66 @@ func wrapButtplugMessage(command interface{}) ([]byte, error) {
 	return json.Marshal(messageArray)
 }
 
-// constructLinearCmd creates a Buttplug LinearCmd JSON message, calculating duration based on speed and position change.
-func constructLinearCmd(deviceIndex uint32, targetPosition float64, speed float64, sampleIntervalMs uint32, lastCommandedPosition float64, isFinal bool) ([]byte, error) {
-	pos := math.Max(0.0, math.Min(1.0, targetPosition)) // Clamp position
+// constructLinearCmd creates a Buttplug LinearCmd JSON message with one vector per axis,
+// calculating each axis' duration from its own speed and position change.
+// A non-zero durationMs replaces the calculated duration, unless the axis speed requires a longer move.
+// A non-zero maxSpeed lengthens durations so no axis moves faster than the room's safety profile allows.
+// A non-nil planner gets the final say and may lengthen moves further to respect the device's motion limits.
+func constructLinearCmd(id uint, deviceIndex uint32, axes []AxisCommand, sampleIntervalMs uint32, durationMs uint32, lastPositions map[uint32]float64, isFinal bool, maxSpeed float64, planner TrajectoryPlanner) ([]byte, error) {
+	if len(axes) == 0 {
+		return nil, fmt.Errorf("linear command requires at least one axis")
+	}
+
+	vectors := make([]ButtplugLinearVector, 0, len(axes))
+	for _, axis := range axes {
+		lastCommandedPosition, ok := lastPositions[axis.Index]
+		if !ok {
+			lastCommandedPosition = -1.0 // No previous position for this axis
+		}
+		pos := math.Max(0.0, math.Min(1.0, axis.Position)) // Clamp position
+		duration := computeLinearDuration(pos, axis.Speed, lastCommandedPosition, isFinal)
+		if durationMs > 0 {
+			duration = max(durationMs, minSafetyDuration)
+			if axis.Speed > 0 && lastCommandedPosition >= 0.0 {
+				// The speed may have been lowered by the safety profile
+				duration = max(duration, uint32(math.Ceil(math.Abs(pos-lastCommandedPosition)/(axis.Speed*assumedMaxRawSpeed)*1000)))
+			}
+		}
+		if maxSpeed > 0 {
+			// Safety limit wins over maxCalculatedDuration; an unknown start position may be a full stroke away
+			distance := 1.0
+			if lastCommandedPosition >= 0.0 {
+				distance = math.Abs(pos - lastCommandedPosition)
+			}
+			minDuration := uint32(math.Ceil(distance / (maxSpeed * assumedMaxRawSpeed) * 1000))
+			if duration < minDuration {
+				log.Printf("Duration %dms exceeds safety max speed %.3f, lengthening to %dms", duration, maxSpeed, minDuration)
+				duration = minDuration
+			}
+		}
+		if planner != nil {
+			planned := planner.Plan(axis.Index, pos, time.Duration(duration)*time.Millisecond, time.Now())
+			duration = uint32(planned.Milliseconds())
+		}
+		vectors = append(vectors, ButtplugLinearVector{
+			Index:    axis.Index,
+			Duration: duration,
+			Position: pos,
+		})
+	}
+
+	cmd := ButtplugLinearCmd{
+		Id:          id,
+		DeviceIndex: deviceIndex,
+		Vectors:     vectors,
+	}
+	return wrapButtplugMessage(cmd)
+}
 
+// computeLinearDuration calculates the movement duration (ms) of a single axis based on speed and position change.
+func computeLinearDuration(pos float64, speed float64, lastCommandedPosition float64, isFinal bool) uint32 {
 	var duration uint32
 	const maxCalculatedDuration uint32 = 120 // Max duration in ms - increased for smoother transitions
-	const assumedMaxRawSpeed float64 = 5.0  // Maximum physical speed (units per second) when speed=1.0
 	const minSpeedThreshold float64 = 0.05  // Minimum speed to avoid extremely long durations
 	const finalCommandDuration uint32 = 150 // Fixed duration for final positioning commands
 
@@ -572,25 +1217,85 @@ func constructLinearCmd(deviceIndex uint32, targetPosition float64, speed float6
 		// --- End Velocity-Aware Duration Calculation ---
 	}
 
-	cmd := ButtplugLinearCmd{
-		Id:          ButtplugMsgID,
+	return duration
+}
+
+// constructStopCmd creates a Buttplug StopDeviceCmd JSON message
+func constructStopCmd(id uint, deviceIndex uint32) ([]byte, error) {
+	cmd := ButtplugStopDeviceCmd{
+		Id:          id,
 		DeviceIndex: deviceIndex,
-		Vectors: []ButtplugLinearVector{
-			{
-				Index:    0, // Assuming single linear actuator at index 0
-				Duration: duration,
-				Position: pos,
-			},
-		},
 	}
 	return wrapButtplugMessage(cmd)
 }
 
-// constructStopCmd creates a Buttplug StopDeviceCmd JSON message
-func constructStopCmd(deviceIndex uint32) ([]byte, error) {
-	cmd := ButtplugStopDeviceCmd{
-		Id:          ButtplugMsgID,
+// clampIntensity limits an actuator intensity to the 0.0 - 1.0 range expected by Buttplug.
+func clampIntensity(intensity float64) float64 {
+	if math.IsNaN(intensity) {
+		return 0.0
+	}
+	return math.Max(0.0, math.Min(1.0, intensity))
+}
+
+// constructVibrateCmd creates a Buttplug ScalarCmd JSON message with one "Vibrate" scalar per actuator.
+// VibrateCmd is gone from message spec v3, which the client page speaks.
+func constructVibrateCmd(id uint, deviceIndex uint32, actuators []ActuatorCommand) ([]byte, error) {
+	if len(actuators) == 0 {
+		return nil, fmt.Errorf("vibrate command requires at least one actuator")
+	}
+	scalars := make([]ButtplugScalar, 0, len(actuators))
+	for _, a := range actuators {
+		scalars = append(scalars, ButtplugScalar{Index: a.Index, Scalar: clampIntensity(a.Intensity), ActuatorType: "Vibrate"})
+	}
+	cmd := ButtplugScalarCmd{
+		Id:          id,
+		DeviceIndex: deviceIndex,
+		Scalars:     scalars,
+	}
+	return wrapButtplugMessage(cmd)
+}
+
+// constructRotateCmd creates a Buttplug RotateCmd JSON message with one rotation per actuator.
+func constructRotateCmd(id uint, deviceIndex uint32, actuators []ActuatorCommand) ([]byte, error) {
+	if len(actuators) == 0 {
+		return nil, fmt.Errorf("rotate command requires at least one actuator")
+	}
+	rotations := make([]ButtplugRotation, 0, len(actuators))
+	for _, a := range actuators {
+		rotations = append(rotations, ButtplugRotation{Index: a.Index, Speed: clampIntensity(a.Intensity), Clockwise: a.Clockwise})
+	}
+	cmd := ButtplugRotateCmd{
+		Id:          id,
+		DeviceIndex: deviceIndex,
+		Rotations:   rotations,
+	}
+	return wrapButtplugMessage(cmd)
+}
+
+// constructScalarCmd creates a Buttplug ScalarCmd JSON message. Actuators without an explicit
+// ActuatorType use defaultType, which itself falls back to "Vibrate".
+func constructScalarCmd(id uint, deviceIndex uint32, actuators []ActuatorCommand, defaultType string) ([]byte, error) {
+	if len(actuators) == 0 {
+		return nil, fmt.Errorf("scalar command requires at least one actuator")
+	}
+	if defaultType == "" {
+		defaultType = "Vibrate"
+	}
+	scalars := make([]ButtplugScalar, 0, len(actuators))
+	for _, a := range actuators {
+		actuatorType := a.ActuatorType
+		if actuatorType == "" {
+			actuatorType = defaultType
+		}
+		if !validActuatorTypes[actuatorType] {
+			return nil, fmt.Errorf("unknown actuator type %q for actuator %d", actuatorType, a.Index)
+		}
+		scalars = append(scalars, ButtplugScalar{Index: a.Index, Scalar: clampIntensity(a.Intensity), ActuatorType: actuatorType})
+	}
+	cmd := ButtplugScalarCmd{
+		Id:          id,
 		DeviceIndex: deviceIndex,
+		Scalars:     scalars,
 	}
 	return wrapButtplugMessage(cmd)
 }
@@ -629,6 +1334,19 @@ func heartbeatChecker() {
 				log.Printf("Key %s: Controller heartbeat timeout (>%v) detected", room.key, timeout)
 			}
 			
+			for _, c := range room.arbitration.controllers {
+				if c != room.controller && time.Since(c.lastPingTime) > timeout {
+					connectionsToClose = append(connectionsToClose, c.conn)
+					log.Printf("Key %s: Controller %s heartbeat timeout (>%v) detected", room.key, c.id, timeout)
+				}
+			}
+			for _, w := range room.waiting {
+				if time.Since(w.client.lastPingTime) > timeout {
+					connectionsToClose = append(connectionsToClose, w.client.conn)
+					log.Printf("Key %s: Waiting controller heartbeat timeout (>%v) detected", room.key, timeout)
+				}
+			}
+			
 			// Check client heartbeat
 			if room.client != nil && time.Since(room.client.lastPingTime) > timeout {
 				connectionsToClose = append(connectionsToClose, room.client.conn)
@@ -649,6 +1367,40 @@ func heartbeatChecker() {
 // --- Main Function ---
 
 func main() {
+	// Subcommands run instead of the HTTP server and keep logging to stderr
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bridge":
+			runBridge(os.Args[2:])
+			return
+		case "fakeintiface":
+			runFakeIntiface(os.Args[2:])
+			return
+		}
+	}
+
+	flag.DurationVar(&watchdogTimeout, "watchdog", 0, "Stop a room's devices after this long without controller motion commands (0 = only on controller disconnect)")
+	flag.DurationVar(&resumeGrace, "resume-grace", 15*time.Second, "How long a room holds a dropped connection's place for a reconnect with its resume token (0 = reset right away)")
+	inviteSecretFlag := flag.String("invite-secret", "", "HMAC key for controller invite tokens (empty = random, invites end with the process)")
+	flag.DurationVar(&maxInviteTTL, "invite-ttl", 24*time.Hour, "Longest validity of a controller invite token")
+	flag.BoolVar(&requireInvites, "require-invites", false, "Only let clients with an owner secret create rooms, and controllers join with an invite")
+	flag.StringVar(&defaultTakeoverPolicy, "takeover", "replace", "What happens when a second controller joins: replace, reject, approve (the client decides) or queue")
+	flag.BoolVar(&requireCreatedRooms, "require-created-rooms", false, "Only accept room keys created with POST /api/rooms")
+	flag.DurationVar(&maxRoomTTL, "room-ttl", 24*time.Hour, "Lifetime of rooms created with POST /api/rooms, the default and the longest allowed")
+	flag.IntVar(&maxCreatedRooms, "max-created-rooms", 1000, "Most rooms created with POST /api/rooms alive at once (0 = no cap, the admin token is exempt)")
+	flag.IntVar(&createRoomRate, "create-room-rate", 10, "Rooms one address may create with POST /api/rooms per minute (0 = no limit, the admin token is exempt)")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token for the admin API under /api/admin/ (empty disables it)")
+	flag.IntVar(&spectatorRate, "spectator-rate", 10, "Most frames per second sent to each spectator")
+	flag.StringVar(&recordDir, "record-dir", "", "Directory for session recordings (empty disables recording and replay)")
+	flag.Parse()
+	if !takeoverPolicies[defaultTakeoverPolicy] {
+		log.Fatalf("Invalid -takeover policy %q", defaultTakeoverPolicy)
+	}
+	if spectatorRate <= 0 {
+		log.Fatalf("Invalid -spectator-rate %d, must be at least 1", spectatorRate)
+	}
+	initInviteSecret(*inviteSecretFlag)
+
 	// --- Log Setup ---
 	// Note: Paths are relative to the CWD where the executable is run (server/)
 	logDir := "./log"
@@ -678,6 +1430,20 @@ func main() {
 	// WebSocket handler
 	http.HandleFunc("/ws", handleConnections)
 
+	// Funscript upload for server-side playback
+	http.HandleFunc("/api/funscript", handleFunscriptUpload)
+
+	// Rooms with server-generated keys
+	http.HandleFunc("/api/rooms", handleCreateRoom)
+
+	// Admin API: list, stop, kick and close
+	http.HandleFunc("/api/admin/rooms", handleAdmin)
+	http.HandleFunc("/api/admin/rooms/", handleAdmin)
+
+	// Session recordings: list and replay
+	http.HandleFunc("/api/recordings", handleRecordings)
+	http.HandleFunc("/api/recordings/replay", handleRecordings)
+
 	// Serve style.css from the root directory with no-cache
 	http.Handle("/style.css", noCache(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "./style.css")
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"server/buttplugsim"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)            // The server logs every message
+	resumeGrace = 300 * time.Millisecond // Short enough for tests to wait out
+	maxRoomTTL = time.Hour
+	maxInviteTTL = time.Hour
+	spectatorRate = 10
+	initInviteSecret("")
+	os.Exit(m.Run())
+}
+
+// newTestServer serves the WebSocket endpoint and the HTTP API like main does.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", handleConnections)
+	mux.HandleFunc("/api/funscript", handleFunscriptUpload)
+	mux.HandleFunc("/api/rooms", handleCreateRoom)
+	mux.HandleFunc("/api/recordings", handleRecordings)
+	mux.HandleFunc("/api/recordings/replay", handleRecordings)
+	mux.HandleFunc("/api/admin/rooms", handleAdmin)
+	mux.HandleFunc("/api/admin/rooms/", handleAdmin)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// wsURL returns the WebSocket endpoint of srv with query appended.
+func wsURL(srv *httptest.Server, query string) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?" + query
+}
+
+// dial connects to the server's WebSocket endpoint.
+func dial(t *testing.T, srv *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL(srv, query), nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", query, err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// readUntil reads server messages until match accepts one, failing the test after timeout.
+func readUntil(t *testing.T, ws *websocket.Conn, timeout time.Duration, match func(map[string]json.RawMessage) bool) map[string]json.RawMessage {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(timeout))
+	defer ws.SetReadDeadline(time.Time{})
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		var messages []map[string]json.RawMessage
+		if json.Unmarshal(data, &messages) != nil {
+			continue
+		}
+		for _, msg := range messages {
+			if match(msg) {
+				return msg
+			}
+		}
+	}
+}
+
+// waitStatus reads until a status update with state arrives.
+func waitStatus(t *testing.T, ws *websocket.Conn, state string) map[string]json.RawMessage {
+	t.Helper()
+	return readUntil(t, ws, 2*time.Second, func(msg map[string]json.RawMessage) bool {
+		return string(msg["type"]) == `"status"` && string(msg["state"]) == `"`+state+`"`
+	})
+}
+
+// waitClose reads until the server closes the connection and returns the close code.
+func waitClose(t *testing.T, ws *websocket.Conn) int {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) {
+			t.Fatalf("connection ended without a close frame: %v", err)
+		}
+		return closeErr.Code
+	}
+}
+
+// eventually polls cond until it holds, failing the test after timeout.
+func eventually(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// lookupRoom returns the live room for key, nil if there is none.
+func lookupRoom(key string) *Room {
+	roomsMu.RLock()
+	defer roomsMu.RUnlock()
+	return rooms[key]
+}
+
+// addRoom registers an empty room for key, protected by owner unless it is empty.
+func addRoom(t *testing.T, key string, owner string) *Room {
+	t.Helper()
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	room := newTestRoom(key)
+	if owner != "" {
+		room.owner = hashOwnerSecret(owner)
+	}
+	rooms[key] = room
+	t.Cleanup(func() {
+		roomsMu.Lock()
+		delete(rooms, key)
+		roomsMu.Unlock()
+	})
+	return room
+}
+
+// newTestRoom returns an empty room initialized like handleConnections does.
+func newTestRoom(key string) *Room {
+	return &Room{
+		key:                    key,
+		devices:                make(map[uint32]DeviceInfo),
+		lastCommandedPositions: make(map[uint32]map[uint32]float64),
+	}
+}
+
+// TestEndToEnd drives simulated toys through the whole chain: controller → server → bridge → Intiface.
+func TestEndToEnd(t *testing.T) {
+	srv := newTestServer(t)
+	sim := buttplugsim.NewServer("Test Intiface")
+	sim.Logf = func(string, ...interface{}) {}
+	commands := make(chan string, 16)
+	sim.OnCommand = func(c buttplugsim.Command) { commands <- c.Name }
+	stroker := sim.AddDevice(buttplugsim.DeviceConfig{Name: "Stroker", Linear: 1})
+	vibrator := sim.AddDevice(buttplugsim.DeviceConfig{Name: "Vibe", Vibrate: 1})
+	intiface := httptest.NewServer(sim)
+	t.Cleanup(intiface.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	b := &bridge{
+		serverURL:   wsURL(srv, "type=client&key=e2e"),
+		intifaceURL: "ws" + strings.TrimPrefix(intiface.URL, "http"),
+		devices:     make(map[uint32]ButtplugDevice),
+		nextID:      2,
+		resume:      new(atomic.Pointer[string]),
+	}
+	go func() { done <- b.run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	controller := dial(t, srv, "type=controller&key=e2e")
+	waitStatus(t, controller, "ready") // The bridge reported the devices and selected the stroker
+
+	err := controller.WriteJSON(ControlMessage{Type: "control", Position: 0.8, SampleIntervalMs: 100})
+	if err != nil {
+		t.Fatalf("send control: %v", err)
+	}
+	eventually(t, 2*time.Second, "the stroker to be commanded to 0.8", func() bool { return stroker.Target(0) == 0.8 })
+
+	room := lookupRoom("e2e")
+	eventually(t, 2*time.Second, "the bridge to acknowledge the command", func() bool {
+		room.commands.mu.Lock()
+		defer room.commands.mu.Unlock()
+		return len(room.commands.pending) == 0
+	})
+
+	// The simulator speaks spec v3 like Intiface and refuses VibrateCmd
+	err = controller.WriteJSON(ControlMessage{Type: "vibrate", Device: &DeviceTarget{Index: vibrator.Index}, Intensity: 0.5})
+	if err != nil {
+		t.Fatalf("send vibrate: %v", err)
+	}
+	eventually(t, 2*time.Second, "the vibrator to run at 0.5", func() bool { return vibrator.VibrateSpeed(0) == 0.5 })
+
+	if err := controller.WriteJSON(ControlMessage{Type: "stop"}); err != nil {
+		t.Fatalf("send stop: %v", err)
+	}
+	for stopped := false; !stopped; {
+		select {
+		case name := <-commands:
+			stopped = name == "StopDeviceCmd"
+		case <-time.After(2 * time.Second):
+			t.Fatal("the stroker was not stopped")
+		}
+	}
+
+	// Leave before the bridge does, so the room is torn down one party at a time
+	controller.Close()
+	eventually(t, 2*time.Second, "the controller to leave", func() bool {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return !room.controllerConnected
+	})
+}
+
+func TestVibrateIsScalarCmd(t *testing.T) {
+	data, err := constructVibrateCmd(1, 3, []ActuatorCommand{{Index: 0, Intensity: 0.5}, {Index: 1, Intensity: 2}})
+	if err != nil {
+		t.Fatalf("construct: %v", err)
+	}
+	var messages []map[string]ButtplugScalarCmd
+	if err := json.Unmarshal(data, &messages); err != nil {
+		t.Fatalf("decode %s: %v", data, err)
+	}
+	cmd, ok := messages[0]["ScalarCmd"]
+	if len(messages) != 1 || !ok {
+		t.Fatalf("got %s, want a single ScalarCmd (VibrateCmd is not in message spec v3)", data)
+	}
+	want := []ButtplugScalar{{Index: 0, Scalar: 0.5, ActuatorType: "Vibrate"}, {Index: 1, Scalar: 1, ActuatorType: "Vibrate"}}
+	if cmd.DeviceIndex != 3 || len(cmd.Scalars) != 2 || cmd.Scalars[0] != want[0] || cmd.Scalars[1] != want[1] {
+		t.Fatalf("got %+v, want device 3 with %+v", cmd, want)
+	}
+}
+
+func TestLinearCmdDurationPerAxis(t *testing.T) {
+	msg := ControlMessage{Type: "control", Axes: []AxisCommand{
+		{Index: 0, Position: 0.75, Speed: 1},  // 0.5 at full speed: 100ms
+		{Index: 1, Position: 0.5, Speed: 0.5}, // 0.5 at half speed: 200ms, capped at 120ms
+		{Index: 2, Position: 1.5, Speed: 1},   // Never commanded: minimum duration, position clamped
+	}}
+	data, err := constructLinearCmd(1, 5, msg.linearAxes(), 100, 0, map[uint32]float64{0: 0.25, 1: 1}, false, 0, nil)
+	if err != nil {
+		t.Fatalf("construct: %v", err)
+	}
+	var messages []map[string]ButtplugLinearCmd
+	if err := json.Unmarshal(data, &messages); err != nil {
+		t.Fatalf("decode %s: %v", data, err)
+	}
+	cmd := messages[0]["LinearCmd"]
+	want := []ButtplugLinearVector{{Index: 0, Duration: 100, Position: 0.75}, {Index: 1, Duration: 120, Position: 0.5}, {Index: 2, Duration: 20, Position: 1}}
+	if cmd.DeviceIndex != 5 || len(cmd.Vectors) != len(want) {
+		t.Fatalf("got %s, want one LinearCmd for device 5 with %d vectors", data, len(want))
+	}
+	for i, v := range cmd.Vectors {
+		if v != want[i] {
+			t.Errorf("vector %d = %+v, want %+v", i, v, want[i])
+		}
+	}
+
+	// A scripted duration replaces the computed one
+	data, err = constructLinearCmd(1, 5, []AxisCommand{{Index: 0, Position: 1}}, 0, 400, map[uint32]float64{0: 0}, false, 0, nil)
+	if err != nil {
+		t.Fatalf("construct: %v", err)
+	}
+	messages = nil
+	if err := json.Unmarshal(data, &messages); err != nil {
+		t.Fatalf("decode %s: %v", data, err)
+	}
+	if v := messages[0]["LinearCmd"].Vectors[0]; v.Duration != 400 {
+		t.Fatalf("scripted move lasts %dms, want 400ms", v.Duration)
+	}
+
+	// Without axes, Position and Speed drive axis 0
+	single := ControlMessage{Type: "control", Position: 0.3, Speed: 0.4}
+	if axes := single.linearAxes(); len(axes) != 1 || axes[0] != (AxisCommand{Index: 0, Position: 0.3, Speed: 0.4}) {
+		t.Fatalf("linearAxes() = %+v, want axis 0 only", axes)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import "sync"
+
+const (
+	maxOverflowCommands = 64 // Commands held while the send buffer is full, stops excepted
+	priorityBufferSize  = 32 // Stops and safety notices waiting for writePump
+)
+
+// outboundMessage is a message waiting for a client's writePump.
+type outboundMessage struct {
+	data   []byte
+	id     uint   // Command ID, 0 for other messages
+	seq    uint64 // Queue order of commands, 0 for other messages
+	device uint32
+	motion bool // Motion command for device, discarded if a stop for the device overtook it
+}
+
+// overflowCommand is a Buttplug command that did not fit into the client's send buffer.
+type overflowCommand struct {
+	id      uint
+	command string // Buttplug message name, "StopDeviceCmd" is never coalesced or dropped
+	message outboundMessage
+}
+
+// commandOverflow orders a client's commands. Stops take the priority lane, and motion queued
+// for the device before a stop is discarded instead of being written after it. Commands that
+// don't fit into the send buffer are held here: motion commands are latest-wins per device and
+// command type, so a newer LinearCmd replaces the held one instead of being dropped. Once
+// anything is held, later commands queue behind it so the order is kept until writePump has
+// drained the send buffer. A stop that finds the priority lane full is held too, but writePump
+// takes it without waiting for the send buffer.
+type commandOverflow struct {
+	mu        sync.Mutex
+	commands  []overflowCommand
+	seq       uint64
+	stoppedAt map[uint32]uint64 // Device index -> seq of its latest stop
+	discarded []uint            // IDs of motion commands writePump skipped, reported with the next queueResult
+	closed    bool              // The send channel is closed, nothing is queued any more
+}
+
+// queueResult tells the caller what happened to a command and the commands it superseded.
+type queueResult struct {
+	queued   bool   // The command will be written
+	replaced []uint // IDs of older commands it superseded
+}
+
+// queueCommand queues a Buttplug command for the client without blocking.
+func (c *Client) queueCommand(id uint, device uint32, command string, cmdJSON []byte) queueResult {
+	o := &c.overflow
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return queueResult{}
+	}
+
+	o.seq++
+	stop := command == "StopDeviceCmd"
+	message := outboundMessage{data: cmdJSON, id: id, seq: o.seq, device: device, motion: !stop}
+	entry := overflowCommand{id: id, command: command, message: message}
+	result := queueResult{replaced: o.discarded}
+	o.discarded = nil
+
+	if stop {
+		// The stop supersedes every motion still waiting for this device
+		if o.stoppedAt == nil {
+			o.stoppedAt = make(map[uint32]uint64)
+		}
+		o.stoppedAt[device] = o.seq
+		kept := o.commands[:0]
+		for _, queued := range o.commands {
+			if queued.message.device == device && queued.message.motion {
+				result.replaced = append(result.replaced, queued.id)
+				continue
+			}
+			kept = append(kept, queued)
+		}
+		o.commands = kept
+		result.queued = true
+
+		select {
+		case c.priority <- message:
+		default:
+			o.commands = append(o.commands, entry) // Priority lane full, still never dropped
+			c.wakeWriter()
+		}
+		return result
+	}
+
+	if len(o.commands) == 0 {
+		select {
+		case c.send <- message:
+			result.queued = true
+			return result
+		default:
+		}
+	}
+
+	for i, queued := range o.commands {
+		if queued.message.device == device && queued.command == command {
+			result.replaced = append(result.replaced, queued.id)
+			o.commands[i] = entry
+			result.queued = true
+			return result
+		}
+	}
+	if len(o.commands) >= maxOverflowCommands {
+		return result
+	}
+	o.commands = append(o.commands, entry)
+	result.queued = true
+	c.wakeWriter() // The send buffer may already be empty, with nothing left to wake writePump
+	return result
+}
+
+// wakeWriter tells writePump that commands are held. Caller must hold the overflow lock.
+func (c *Client) wakeWriter() {
+	select {
+	case c.held <- struct{}{}:
+	default: // A wake-up is already pending
+	}
+}
+
+// closeSend closes the send channel so writePump ends the connection. Messages and commands queued
+// afterwards are dropped instead of being sent on the closed channel.
+func (c *Client) closeSend() {
+	o := &c.overflow
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.closed {
+		o.closed = true
+		close(c.send)
+	}
+}
+
+// takeOverflow returns the held commands that may be written now: held stops right away, and the
+// rest once the send buffer is empty, so it is written after everything queued before it. Called
+// by writePump.
+func (c *Client) takeOverflow() []outboundMessage {
+	o := &c.overflow
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.commands) == 0 {
+		return nil
+	}
+	drained := len(c.send) == 0
+	var messages []outboundMessage
+	kept := o.commands[:0]
+	for _, command := range o.commands {
+		if drained || !command.message.motion {
+			messages = append(messages, command.message)
+			continue
+		}
+		kept = append(kept, command)
+	}
+	o.commands = kept
+	return messages
+}
+
+// superseded reports whether a motion command was overtaken by a stop for its device.
+func (c *Client) superseded(message outboundMessage) bool {
+	if !message.motion {
+		return false
+	}
+	o := &c.overflow
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stoppedAt[message.device] <= message.seq {
+		return false
+	}
+	o.discarded = append(o.discarded, message.id)
+	return true
+}
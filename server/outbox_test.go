@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// connectedClient returns a server-side Client without a running writePump and the peer that reads
+// what it writes.
+func connectedClient(t *testing.T) (*Client, *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conns <- ws
+	}))
+	t.Cleanup(srv.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	c := &Client{
+		conn:     <-conns,
+		send:     make(chan outboundMessage, 256),
+		priority: make(chan outboundMessage, priorityBufferSize),
+		held:     make(chan struct{}, 1),
+	}
+	return c, peer
+}
+
+// motionCmd is a stand-in LinearCmd with command ID id for device.
+func motionCmd(id uint, device uint32) []byte {
+	return []byte(fmt.Sprintf(`[{"LinearCmd":{"Id":%d,"DeviceIndex":%d,"Vectors":[]}}]`, id, device))
+}
+
+// readCommandID reads the next frame and returns the ID of the command in it.
+func readCommandID(t *testing.T, peer *websocket.Conn, timeout time.Duration) uint {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(timeout))
+	_, data, err := peer.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var containers []map[string]struct{ Id uint }
+	if err := json.Unmarshal(data, &containers); err != nil || len(containers) != 1 || len(containers[0]) != 1 {
+		t.Fatalf("frame without a single command: %s", data)
+	}
+	for _, cmd := range containers[0] {
+		return cmd.Id
+	}
+	return 0
+}
+
+func TestMotionCoalescesOnFullSendBuffer(t *testing.T) {
+	c, peer := connectedClient(t)
+
+	var id uint
+	for range cap(c.send) {
+		id++
+		if result := c.queueCommand(id, 0, "LinearCmd", motionCmd(id, 0)); !result.queued || len(result.replaced) != 0 {
+			t.Fatalf("command %d: %+v, want it queued in the send buffer", id, result)
+		}
+	}
+
+	// Overflow is latest-wins per device and command type
+	id++
+	c.queueCommand(id, 0, "LinearCmd", motionCmd(id, 0))
+	id++
+	if result := c.queueCommand(id, 0, "LinearCmd", motionCmd(id, 0)); !result.queued || !slices.Equal(result.replaced, []uint{id - 1}) {
+		t.Fatalf("newer overflow command: %+v, want it to replace %d", result, id-1)
+	}
+	latest := id
+	id++
+	otherDevice := id
+	c.queueCommand(id, 1, "LinearCmd", motionCmd(id, 1))
+
+	go c.writePump()
+	for want := uint(1); want <= uint(cap(c.send)); want++ {
+		if got := readCommandID(t, peer, time.Second); got != want {
+			t.Fatalf("frame %d is command %d", want, got)
+		}
+	}
+	if got := readCommandID(t, peer, time.Second); got != latest {
+		t.Fatalf("first held frame is command %d, want the latest for device 0 (%d)", got, latest)
+	}
+	if got := readCommandID(t, peer, time.Second); got != otherDevice {
+		t.Fatalf("second held frame is command %d, want %d", got, otherDevice)
+	}
+	c.closeSend()
+}
+
+func TestStopOvertakesFloodedSendBuffer(t *testing.T) {
+	c, peer := connectedClient(t)
+
+	// Fill the send buffer with motion for device 0, except for one command for device 1
+	var id uint
+	for range cap(c.send) - 1 {
+		id++
+		if !c.queueCommand(id, 0, "LinearCmd", motionCmd(id, 0)).queued {
+			t.Fatalf("command %d was not queued", id)
+		}
+	}
+	id++
+	otherDevice := id
+	c.queueCommand(id, 1, "LinearCmd", motionCmd(id, 1))
+	if len(c.send) != cap(c.send) {
+		t.Fatalf("send buffer holds %d commands, want it full (%d)", len(c.send), cap(c.send))
+	}
+
+	// Both overflow, and the held command for device 0 is replaced by a newer one
+	id++
+	c.queueCommand(id, 0, "LinearCmd", motionCmd(id, 0))
+	id++
+	overflowed := id
+	if result := c.queueCommand(id, 0, "LinearCmd", motionCmd(id, 0)); !slices.Equal(result.replaced, []uint{id - 1}) {
+		t.Fatalf("newer overflow command replaced %v, want [%d]", result.replaced, id-1)
+	}
+	id++
+	overflowedOther := id
+	c.queueCommand(id, 1, "LinearCmd", motionCmd(id, 1))
+
+	id++
+	stop := id
+	stopJSON, _ := constructStopCmd(stop, 0)
+	result := c.queueCommand(stop, 0, "StopDeviceCmd", stopJSON)
+	if !result.queued || !slices.Equal(result.replaced, []uint{overflowed}) {
+		t.Fatalf("stop: queued=%v replaced=%v, want queued and [%d] replaced", result.queued, result.replaced, overflowed)
+	}
+
+	go c.writePump()
+	start := time.Now()
+	if first := readCommandID(t, peer, time.Second); first != stop {
+		t.Fatalf("first frame is command %d, want the stop %d", first, stop)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatalf("the stop took %v behind %d queued commands", elapsed, cap(c.send))
+	}
+
+	// Motion for device 0 queued before the stop is never written, device 1 is unaffected
+	if next := readCommandID(t, peer, time.Second); next != otherDevice {
+		t.Fatalf("frame after the stop is command %d, want %d for the other device", next, otherDevice)
+	}
+	if next := readCommandID(t, peer, time.Second); next != overflowedOther {
+		t.Fatalf("next frame is command %d, want the held command %d for the other device", next, overflowedOther)
+	}
+
+	// Motion after the stop is written again, and reports what writePump discarded
+	id++
+	result = c.queueCommand(id, 0, "LinearCmd", motionCmd(id, 0))
+	if !result.queued {
+		t.Fatal("motion after the stop was not queued")
+	}
+	if len(result.replaced) != cap(c.send)-1 || result.replaced[0] != 1 || result.replaced[len(result.replaced)-1] != uint(cap(c.send)-1) {
+		t.Fatalf("discarded %d commands (%v), want the %d queued for device 0 before the stop", len(result.replaced), result.replaced, cap(c.send)-1)
+	}
+	if next := readCommandID(t, peer, time.Second); next != id {
+		t.Fatalf("next frame is command %d, want %d", next, id)
+	}
+	c.closeSend()
+}
+
+func TestStopHeldWithFullPriorityLane(t *testing.T) {
+	c, peer := connectedClient(t)
+
+	// Safety notices fill the priority lane while the send buffer stays empty
+	room := newTestRoom("priority-full")
+	for range cap(c.priority) {
+		room.sendPriorityStatusUpdate(c, "safety_violation", "clamped")
+	}
+	stopJSON, _ := constructStopCmd(1, 0)
+	if !c.queueCommand(1, 0, "StopDeviceCmd", stopJSON).queued {
+		t.Fatal("the stop was dropped")
+	}
+	if len(c.send) != 0 {
+		t.Fatalf("send buffer holds %d message(s), want it empty", len(c.send))
+	}
+
+	// Nothing else is queued, the held stop must still go out
+	go c.writePump()
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	for range cap(c.priority) {
+		if _, _, err := peer.ReadMessage(); err != nil {
+			t.Fatalf("read notice: %v", err)
+		}
+	}
+	if id := readCommandID(t, peer, time.Second); id != 1 {
+		t.Fatalf("frame after the notices is command %d, want the stop", id)
+	}
+	c.closeSend()
+}
+
+func TestHeldStopSkipsSendBuffer(t *testing.T) {
+	c, peer := connectedClient(t)
+	room := newTestRoom("priority-full-busy")
+	for range cap(c.priority) {
+		room.sendPriorityStatusUpdate(c, "safety_violation", "clamped")
+	}
+	for id := range uint(cap(c.send)) {
+		c.queueCommand(id+1, 1, "LinearCmd", motionCmd(id+1, 1))
+	}
+	stop := uint(cap(c.send)) + 1
+	stopJSON, _ := constructStopCmd(stop, 0)
+	c.queueCommand(stop, 0, "StopDeviceCmd", stopJSON)
+
+	// The held stop follows the notices without waiting for the motion in the send buffer
+	go c.writePump()
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	for range cap(c.priority) {
+		if _, _, err := peer.ReadMessage(); err != nil {
+			t.Fatalf("read notice: %v", err)
+		}
+	}
+	first := readCommandID(t, peer, time.Second)
+	if first != stop {
+		if second := readCommandID(t, peer, time.Second); second != stop {
+			t.Fatalf("frames after the notices are commands %d and %d, want the stop %d within them", first, second, stop)
+		}
+	}
+	c.closeSend()
+}
+
+func TestQueueAfterCloseIsDropped(t *testing.T) {
+	c, _ := connectedClient(t)
+	c.closeSend()
+	c.closeSend() // Both the handler and a kick may close the connection
+
+	// Sending on the closed channel would panic
+	room := &Room{key: "closed-send"}
+	room.sendStatusUpdate(c, "ready", "")
+	room.sendPriorityStatusUpdate(c, "locked", "")
+	if c.queueCommand(1, 0, "LinearCmd", motionCmd(1, 0)).queued {
+		t.Fatal("command queued after the send channel was closed")
+	}
+}
+
+func TestOverflowIsBounded(t *testing.T) {
+	c := &Client{send: make(chan outboundMessage)} // Unbuffered and never read: everything overflows
+	for device := range uint32(maxOverflowCommands) {
+		if !c.queueCommand(uint(device)+1, device, "LinearCmd", motionCmd(uint(device)+1, device)).queued {
+			t.Fatalf("command for device %d was not held", device)
+		}
+	}
+	if c.queueCommand(1000, maxOverflowCommands, "LinearCmd", motionCmd(1000, maxOverflowCommands)).queued {
+		t.Fatal("motion for one more device was held beyond maxOverflowCommands")
+	}
+	stopJSON, _ := constructStopCmd(1001, maxOverflowCommands)
+	if !c.queueCommand(1001, maxOverflowCommands, "StopDeviceCmd", stopJSON).queued {
+		t.Fatal("a stop was dropped")
+	}
+}
+
+func TestClientBacklogReported(t *testing.T) {
+	beikongduan, _ := connectedClient(t)
+	controller, _ := connectedClient(t)
+	room := newTestRoom("backlog")
+	room.client, room.controller = beikongduan, controller
+
+	for i := range cap(beikongduan.send) + 2 {
+		id := room.commands.allocate()
+		if !room.sendCommand(beikongduan, id, 0, motionCmd(id, 0)) {
+			t.Fatalf("command %d was not queued", i)
+		}
+	}
+
+	var status []StatusUpdateMessage
+	select {
+	case message := <-controller.send:
+		if err := json.Unmarshal(message.data, &status); err != nil || len(status) != 1 || status[0].State != "client_backlog" {
+			t.Fatalf("controller was sent %s, want a client_backlog status", message.data)
+		}
+	default:
+		t.Fatal("the controller was not told about the backlog")
+	}
+	if status[0].Coalesced != 1 || status[0].Dropped != 0 {
+		t.Fatalf("backlog %+v, want 1 coalesced command", status[0])
+	}
+	if len(controller.send) != 0 {
+		t.Fatal("backlog reported more than once per interval")
+	}
+
+	room.commands.mu.Lock()
+	pending := len(room.commands.pending)
+	room.commands.mu.Unlock()
+	if pending != cap(beikongduan.send)+1 {
+		t.Fatalf("%d commands pending, want the coalesced one forgotten", pending)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPatternIntervalMs = 100
+	minPatternIntervalMs     = 50
+	maxPatternIntervalMs     = 1000
+	minPatternFrequencyHz    = 0.05
+	maxPatternFrequencyHz    = 5.0
+)
+
+// PatternParams describes a server-generated stroke pattern.
+type PatternParams struct {
+	Waveform    string  `json:"waveform"`             // "sine", "sawtooth", "ramp" (linear up and down) or "random"
+	FrequencyHz float64 `json:"frequencyHz"`          // Strokes per second
+	Amplitude   float64 `json:"amplitude"`            // 0.0 - 1.0 share of the stroke range, 0 means 1.0
+	Min         float64 `json:"min"`                  // Stroke range, 0.0 - 1.0
+	Max         float64 `json:"max"`                  // Stroke range, 0.0 - 1.0, 0 means 1.0
+	DurationMs  uint32  `json:"durationMs,omitempty"` // Stops by itself after this long, 0 runs until stopped
+	IntervalMs  uint32  `json:"intervalMs,omitempty"` // Command interval, defaults to 100ms
+}
+
+// normalize fills in defaults and validates the parameters.
+func (p *PatternParams) normalize() error {
+	switch p.Waveform {
+	case "sine", "sawtooth", "ramp", "random":
+	default:
+		return fmt.Errorf("unknown waveform %q", p.Waveform)
+	}
+	if p.FrequencyHz < minPatternFrequencyHz || p.FrequencyHz > maxPatternFrequencyHz {
+		return fmt.Errorf("frequency must be between %.2f and %.1f Hz", minPatternFrequencyHz, maxPatternFrequencyHz)
+	}
+	if p.Amplitude == 0 {
+		p.Amplitude = 1.0
+	}
+	if p.Max == 0 {
+		p.Max = 1.0
+	}
+	if p.Amplitude < 0 || p.Amplitude > 1 || p.Min < 0 || p.Max > 1 || p.Min >= p.Max {
+		return fmt.Errorf("invalid amplitude %.3f or stroke range %.3f - %.3f", p.Amplitude, p.Min, p.Max)
+	}
+	if p.IntervalMs == 0 {
+		p.IntervalMs = defaultPatternIntervalMs
+	}
+	p.IntervalMs = max(minPatternIntervalMs, min(maxPatternIntervalMs, p.IntervalMs))
+	return nil
+}
+
+// wave returns the waveform value (0.0 - 1.0) at phase (in cycles).
+func (p *PatternParams) wave(phase float64) float64 {
+	frac := phase - math.Floor(phase)
+	switch p.Waveform {
+	case "sawtooth":
+		return frac
+	case "ramp":
+		return 1 - math.Abs(2*frac-1)
+	default: // "sine"
+		return 0.5 - 0.5*math.Cos(2*math.Pi*frac) // Starts at the bottom of the stroke
+	}
+}
+
+// position maps a waveform value into the stroke range.
+func (p *PatternParams) position(value float64) float64 {
+	center := (p.Min + p.Max) / 2
+	half := (p.Max - p.Min) / 2 * p.Amplitude
+	return center + (value*2-1)*half
+}
+
+// PatternStatusMessage reports the generator state to both parties.
+type PatternStatusMessage struct {
+	Type    string         `json:"type"`  // Always "pattern"
+	State   string         `json:"state"` // "running", "stopped", "finished"
+	Pattern *PatternParams `json:"pattern,omitempty"`
+	Message string         `json:"message,omitempty"`
+}
+
+// patternGenerator streams LinearCmds for a pattern on a ticker. The phase is accumulated tick by
+// tick so frequency changes take effect without a jump in position.
+type patternGenerator struct {
+	room *Room
+	stop chan struct{}
+
+	mu            sync.Mutex
+	device        *DeviceTarget // nil drives the room's default device
+	params        PatternParams
+	started       time.Time
+	phase         float64 // Cycles elapsed
+	lastTick      time.Time
+	randomCycle   int64 // Cycle of the current random target
+	intervalDirty bool  // IntervalMs changed, the ticker needs a reset
+}
+
+// update replaces the parameters and target of a running generator. A new duration counts from now.
+func (g *patternGenerator) update(params PatternParams, device *DeviceTarget) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.intervalDirty = params.IntervalMs != g.params.IntervalMs
+	g.params = params
+	g.device = device
+	g.started = time.Now()
+}
+
+// target returns the device the generator drives, nil for the room's default device.
+func (g *patternGenerator) target() *DeviceTarget {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.device
+}
+
+// tick advances the phase and returns the next target position and move duration, or ok=false if
+// nothing should be sent this tick. done is set once the pattern's duration is over.
+func (g *patternGenerator) tick(now time.Time) (pos float64, duration time.Duration, ok bool, done bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	p := g.params
+	if p.DurationMs > 0 && now.Sub(g.started) >= time.Duration(p.DurationMs)*time.Millisecond {
+		return 0, 0, false, true
+	}
+	g.phase += p.FrequencyHz * now.Sub(g.lastTick).Seconds()
+	g.lastTick = now
+
+	interval := time.Duration(p.IntervalMs) * time.Millisecond
+	ahead := g.phase + p.FrequencyHz*interval.Seconds() // Where the stroke should be at the end of this move
+
+	if p.Waveform == "random" {
+		cycle := int64(math.Floor(ahead))
+		if cycle == g.randomCycle {
+			return 0, 0, false, false
+		}
+		g.randomCycle = cycle
+		period := time.Duration(float64(time.Second) / p.FrequencyHz)
+		return p.position(rand.Float64()), period, true, false
+	}
+	return p.position(p.wave(ahead)), interval, true, false
+}
+
+func (g *patternGenerator) run() {
+	g.mu.Lock()
+	interval := time.Duration(g.params.IntervalMs) * time.Millisecond
+	g.mu.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastPos := -1.0
+	for {
+		pos, duration, ok, done := g.tick(time.Now())
+		if done {
+			g.room.finishPattern(g)
+			return
+		}
+		if ok {
+			speed := 0.0
+			if lastPos >= 0 {
+				speed = math.Min(1.0, math.Abs(pos-lastPos)/duration.Seconds()/assumedMaxRawSpeed)
+			}
+			msg := ControlMessage{
+				Type:       "control",
+				Position:   pos,
+				Speed:      speed,
+				DurationMs: uint32(duration.Milliseconds()),
+				Device:     g.target(),
+			}
+			g.room.processControlMessage(&msg)
+			lastPos = msg.Position // May have been clamped by the safety profile
+		}
+
+		g.mu.Lock()
+		if g.intervalDirty {
+			ticker.Reset(time.Duration(g.params.IntervalMs) * time.Millisecond)
+			g.intervalDirty = false
+		}
+		g.mu.Unlock()
+
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// startPattern starts a generator, or updates the parameters and target of the running one. Refused
+// while the room is locked.
+func (r *Room) startPattern(params PatternParams, device *DeviceTarget) error {
+	r.mu.Lock()
+	running := r.pattern
+	locked := r.locked
+	r.mu.Unlock()
+	if locked {
+		return errRoomLocked
+	}
+	if running != nil {
+		running.update(params, device)
+		log.Printf("Key %s: Updated pattern %+v", r.key, params)
+		r.broadcastPattern(PatternStatusMessage{Type: "pattern", State: "running", Pattern: &params})
+		return nil
+	}
+
+	r.pausePlayback("pattern started")
+	r.stopReplay("pattern started")
+
+	now := time.Now()
+	g := &patternGenerator{
+		room:        r,
+		device:      device,
+		stop:        make(chan struct{}),
+		params:      params,
+		started:     now,
+		lastTick:    now,
+		randomCycle: -1,
+	}
+	r.mu.Lock()
+	if r.locked {
+		r.mu.Unlock()
+		return errRoomLocked // Emergency stop in the meantime
+	}
+	r.pattern = g
+	r.mu.Unlock()
+
+	log.Printf("Key %s: Started pattern %+v", r.key, params)
+	r.broadcastPattern(PatternStatusMessage{Type: "pattern", State: "running", Pattern: &params})
+	go g.run()
+	return nil
+}
+
+// stopPattern stops the running generator, if any, and returns it.
+func (r *Room) stopPattern(reason string) *patternGenerator {
+	r.mu.Lock()
+	g := r.pattern
+	r.pattern = nil
+	r.mu.Unlock()
+	if g == nil {
+		return nil
+	}
+	close(g.stop)
+	log.Printf("Key %s: Pattern stopped: %s", r.key, reason)
+	r.broadcastPattern(PatternStatusMessage{Type: "pattern", State: "stopped", Message: reason})
+	return g
+}
+
+// finishPattern clears a generator whose duration is over and brings its devices to a stop.
+func (r *Room) finishPattern(g *patternGenerator) {
+	device := g.target()
+	r.mu.Lock()
+	current := r.pattern == g
+	if current {
+		r.pattern = nil
+	}
+	beikongduan := r.client
+	targets, err := r.resolveTargets(device, "stop")
+	r.mu.Unlock()
+	if !current {
+		return
+	}
+	log.Printf("Key %s: Pattern finished", r.key)
+	if err == nil {
+		r.stopDevices(beikongduan, targets)
+	}
+	r.broadcastPattern(PatternStatusMessage{Type: "pattern", State: "finished"})
+}
+
+// handlePatternMessage handles a controller's "pattern" message: start/update with a pattern, or
+// "stop". Errors go back to the controller that sent it.
+func (r *Room) handlePatternMessage(controller *Client, msg *ControlMessage) {
+	if msg.Action == "stop" {
+		g := r.stopPattern("stopped by controller")
+		if g == nil {
+			return
+		}
+		device := g.target() // The devices the pattern drove, whatever the stop message names
+		r.mu.RLock()
+		beikongduan := r.client
+		targets, err := r.resolveTargets(device, "stop")
+		r.mu.RUnlock()
+		if err == nil {
+			r.stopDevices(beikongduan, targets)
+		}
+		return
+	}
+	if msg.Pattern == nil {
+		r.sendStatusUpdate(controller, "pattern_error", "pattern message without pattern")
+		return
+	}
+	params := *msg.Pattern
+	if err := params.normalize(); err != nil {
+		log.Printf("Key %s: Invalid pattern from controller: %v", r.key, err)
+		r.sendStatusUpdate(controller, "pattern_error", err.Error())
+		return
+	}
+	if err := r.startPattern(params, msg.Device); err != nil {
+		log.Printf("Key %s: Pattern refused: %v", r.key, err)
+		r.sendStatusUpdate(controller, "pattern_error", err.Error())
+	}
+}
+
+// broadcastPattern sends a pattern status to the controllers and the client.
+func (r *Room) broadcastPattern(status PatternStatusMessage) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.sendToControllers(status, "pattern status")
+	r.sendMessage(r.client, status, "pattern status")
+}
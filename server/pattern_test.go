@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPatternParams(t *testing.T) {
+	p := PatternParams{Waveform: "sine", FrequencyHz: 1}
+	if err := p.normalize(); err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	if p.Amplitude != 1 || p.Max != 1 || p.IntervalMs != defaultPatternIntervalMs {
+		t.Fatalf("defaults %+v, want full amplitude and range at %dms", p, defaultPatternIntervalMs)
+	}
+
+	for _, tt := range []struct {
+		waveform string
+		phase    float64
+		want     float64
+	}{
+		{"sine", 0, 0}, {"sine", 0.5, 1}, {"sine", 1.25, 0.5},
+		{"sawtooth", 0.25, 0.25}, {"sawtooth", 1.75, 0.75},
+		{"ramp", 0.25, 0.5}, {"ramp", 0.5, 1}, {"ramp", 0.75, 0.5},
+	} {
+		p.Waveform = tt.waveform
+		if got := p.wave(tt.phase); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s at phase %v = %v, want %v", tt.waveform, tt.phase, got, tt.want)
+		}
+	}
+
+	// Half the amplitude keeps the stroke centered in the range
+	p = PatternParams{Waveform: "sine", FrequencyHz: 1, Amplitude: 0.5, Min: 0.2, Max: 0.6}
+	if err := p.normalize(); err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	if lo, hi := p.position(0), p.position(1); math.Abs(lo-0.3) > 1e-9 || math.Abs(hi-0.5) > 1e-9 {
+		t.Fatalf("stroke %v - %v, want 0.3 - 0.5", lo, hi)
+	}
+
+	for _, bad := range []PatternParams{
+		{Waveform: "square", FrequencyHz: 1},
+		{Waveform: "sine", FrequencyHz: 10},
+		{Waveform: "sine", FrequencyHz: 1, Min: 0.8, Max: 0.2},
+	} {
+		if err := bad.normalize(); err == nil {
+			t.Errorf("%+v was accepted", bad)
+		}
+	}
+}
+
+func TestPatternRetargetAndStop(t *testing.T) {
+	srv := newTestServer(t)
+	client := dial(t, srv, "type=client&key=pattern")
+	devices := []DeviceInfo{{Index: 0, LinearCount: 1}, {Index: 1, LinearCount: 1}}
+	if err := client.WriteJSON(MessageFromClient{Type: "deviceList", Devices: devices}); err != nil {
+		t.Fatalf("send device list: %v", err)
+	}
+	controller := dial(t, srv, "type=controller&key=pattern")
+	waitStatus(t, controller, "ready")
+
+	linearTo := func(index uint32) func(map[string]json.RawMessage) bool {
+		return func(msg map[string]json.RawMessage) bool {
+			var cmd ButtplugLinearCmd
+			return msg["LinearCmd"] != nil && json.Unmarshal(msg["LinearCmd"], &cmd) == nil && cmd.DeviceIndex == index
+		}
+	}
+	pattern := &PatternParams{Waveform: "sine", FrequencyHz: 1, IntervalMs: 50}
+	if err := controller.WriteJSON(ControlMessage{Type: "pattern", Pattern: pattern, Device: &DeviceTarget{Index: 0}}); err != nil {
+		t.Fatalf("send pattern: %v", err)
+	}
+	readUntil(t, client, 2*time.Second, linearTo(0))
+
+	// Updating the running pattern moves it to the newly named device
+	if err := controller.WriteJSON(ControlMessage{Type: "pattern", Pattern: pattern, Device: &DeviceTarget{Index: 1}}); err != nil {
+		t.Fatalf("send pattern: %v", err)
+	}
+	readUntil(t, client, 2*time.Second, linearTo(1))
+
+	// Stop halts the device the pattern drove, not the one the stop message names
+	if err := controller.WriteJSON(ControlMessage{Type: "pattern", Action: "stop", Device: &DeviceTarget{Index: 0}}); err != nil {
+		t.Fatalf("send stop: %v", err)
+	}
+	msg := readUntil(t, client, 2*time.Second, func(msg map[string]json.RawMessage) bool { return msg["StopDeviceCmd"] != nil })
+	var stop ButtplugStopDeviceCmd
+	if err := json.Unmarshal(msg["StopDeviceCmd"], &stop); err != nil || stop.DeviceIndex != 1 {
+		t.Fatalf("stopped %s (%v), want device 1", msg["StopDeviceCmd"], err)
+	}
+
+	room := lookupRoom("pattern")
+	room.mu.RLock()
+	running := room.pattern
+	room.mu.RUnlock()
+	if running != nil {
+		t.Fatal("the pattern kept running after the stop")
+	}
+
+	controller.Close()
+	eventually(t, 2*time.Second, "the controller to leave", func() bool {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return !room.controllerConnected
+	})
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// recordDir is where session recordings are written; recording is disabled when empty.
+var recordDir string
+
+// validRecordingName guards replay requests against path traversal.
+var validRecordingName = regexp.MustCompile(`^[0-9A-Za-z-]+$`)
+
+// RecordedMessage is one line of a JSONL session recording.
+type RecordedMessage struct {
+	OffsetMs int64          `json:"t"` // Milliseconds since the recording started
+	Message  ControlMessage `json:"msg"`
+}
+
+// RecordingStatusMessage tells both parties about recording and replay.
+type RecordingStatusMessage struct {
+	Type     string `json:"type"`  // Always "recording"
+	State    string `json:"state"` // "recording", "stopped", "replaying", "replay_finished", "replay_stopped"
+	Name     string `json:"name"`
+	Messages int    `json:"messages"`
+	Message  string `json:"message,omitempty"`
+}
+
+// sessionRecorder appends a room's live controller input to a JSONL file and collects the
+// linear positions for a funscript export.
+type sessionRecorder struct {
+	name     string
+	file     *os.File
+	writer   *bufio.Writer
+	start    time.Time
+	messages int
+	actions  []FunscriptAction
+}
+
+// newRecordingName returns a sortable, unguessable recording name.
+func newRecordingName() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+func newSessionRecorder() (*sessionRecorder, error) {
+	if err := os.MkdirAll(recordDir, 0755); err != nil {
+		return nil, fmt.Errorf("create recording directory: %w", err)
+	}
+	name := newRecordingName()
+	file, err := os.Create(filepath.Join(recordDir, name+".jsonl"))
+	if err != nil {
+		return nil, fmt.Errorf("create recording: %w", err)
+	}
+	return &sessionRecorder{name: name, file: file, writer: bufio.NewWriter(file), start: time.Now()}, nil
+}
+
+// record appends one controller message.
+func (s *sessionRecorder) record(msg *ControlMessage) error {
+	offset := time.Since(s.start).Milliseconds()
+	line, err := json.Marshal(RecordedMessage{OffsetMs: offset, Message: *msg})
+	if err != nil {
+		return err
+	}
+	if _, err := s.writer.Write(line); err != nil {
+		return err
+	}
+	if err := s.writer.WriteByte('\n'); err != nil {
+		return err
+	}
+	s.messages++
+	if msg.Type == "control" {
+		s.actions = append(s.actions, FunscriptAction{At: offset, Pos: msg.linearAxes()[0].Position * 100})
+	}
+	return nil
+}
+
+// close flushes the JSONL file and writes the funscript export next to it.
+func (s *sessionRecorder) close() error {
+	flushErr := s.writer.Flush()
+	closeErr := s.file.Close()
+	if flushErr != nil {
+		return flushErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if len(s.actions) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(Funscript{Version: "1.0", Range: 100, Actions: s.actions})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(recordDir, s.name+".funscript"), data, 0644)
+}
+
+// startRecording begins recording the room's controller input.
+func (r *Room) startRecording() (RecordingStatusMessage, error) {
+	if recordDir == "" {
+		return RecordingStatusMessage{}, fmt.Errorf("recording is disabled on this server")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.recorder != nil {
+		return RecordingStatusMessage{}, fmt.Errorf("already recording %s", r.recorder.name)
+	}
+	recorder, err := newSessionRecorder()
+	if err != nil {
+		return RecordingStatusMessage{}, err
+	}
+	r.recorder = recorder
+	log.Printf("Key %s: Started recording %s", r.key, recorder.name)
+	return RecordingStatusMessage{Type: "recording", State: "recording", Name: recorder.name}, nil
+}
+
+// stopRecording finishes the room's recording, if any.
+func (r *Room) stopRecording() (RecordingStatusMessage, bool) {
+	r.mu.Lock()
+	recorder := r.recorder
+	r.recorder = nil
+	r.mu.Unlock()
+	if recorder == nil {
+		return RecordingStatusMessage{}, false
+	}
+
+	status := RecordingStatusMessage{Type: "recording", State: "stopped", Name: recorder.name, Messages: recorder.messages}
+	if err := recorder.close(); err != nil {
+		log.Printf("Key %s: Error finishing recording %s: %v", r.key, recorder.name, err)
+		status.Message = err.Error()
+	} else {
+		log.Printf("Key %s: Stopped recording %s (%d messages)", r.key, recorder.name, recorder.messages)
+	}
+	return status, true
+}
+
+// recordControlMessage appends live controller input to the room's recording, if one is running.
+// A failed write ends the recording, since the buffered writer keeps failing after its first error.
+func (r *Room) recordControlMessage(msg *ControlMessage) {
+	r.mu.Lock()
+	recorder := r.recorder
+	if recorder == nil {
+		r.mu.Unlock()
+		return
+	}
+	err := recorder.record(msg)
+	if err != nil {
+		r.recorder = nil
+		r.sendStatusToControllers("recording_error", err.Error())
+	}
+	r.mu.Unlock()
+	if err == nil {
+		return
+	}
+
+	log.Printf("Key %s: Error writing recording %s, stopping it: %v", r.key, recorder.name, err)
+	recorder.close() // Fails with the same error; whatever was flushed stays on disk
+	r.broadcastRecording(RecordingStatusMessage{Type: "recording", State: "stopped", Name: recorder.name, Messages: recorder.messages, Message: err.Error()})
+}
+
+// loadRecording reads a JSONL recording from recordDir.
+func loadRecording(name string) ([]RecordedMessage, error) {
+	if recordDir == "" {
+		return nil, fmt.Errorf("recording is disabled on this server")
+	}
+	if !validRecordingName.MatchString(name) {
+		return nil, fmt.Errorf("invalid recording name %q", name)
+	}
+	file, err := os.Open(filepath.Join(recordDir, name+".jsonl"))
+	if err != nil {
+		return nil, fmt.Errorf("recording %s not found", name)
+	}
+	defer file.Close()
+
+	var messages []RecordedMessage
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var m RecordedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return nil, fmt.Errorf("recording %s line %d: %w", name, len(messages)+1, err)
+		}
+		messages = append(messages, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read recording %s: %w", name, err)
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("recording %s is empty", name)
+	}
+	return messages, nil
+}
+
+// startReplay replays a recording into the room with its original timing, replacing any running replay.
+// Refused while the room is locked.
+func (r *Room) startReplay(name string) error {
+	r.mu.RLock()
+	locked := r.locked
+	r.mu.RUnlock()
+	if locked {
+		return errRoomLocked
+	}
+	messages, err := loadRecording(name)
+	if err != nil {
+		return err
+	}
+	r.stopReplay("replaced by " + name)
+	r.pausePlayback("replay started")
+	r.stopPattern("replay started")
+
+	stop := make(chan struct{})
+	r.mu.Lock()
+	if r.locked {
+		r.mu.Unlock()
+		return errRoomLocked // Emergency stop in the meantime
+	}
+	r.replayStop = stop
+	r.mu.Unlock()
+
+	log.Printf("Key %s: Replaying recording %s (%d messages)", r.key, name, len(messages))
+	r.broadcastRecording(RecordingStatusMessage{Type: "recording", State: "replaying", Name: name, Messages: len(messages)})
+	go r.runReplay(name, messages, stop)
+	return nil
+}
+
+func (r *Room) runReplay(name string, messages []RecordedMessage, stop chan struct{}) {
+	start := time.Now()
+	for _, m := range messages {
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Until(start.Add(time.Duration(m.OffsetMs) * time.Millisecond))):
+		}
+		msg := m.Message
+		r.processControlMessage(&msg)
+	}
+
+	r.mu.Lock()
+	finished := r.replayStop == stop
+	if finished {
+		r.replayStop = nil
+	}
+	r.mu.Unlock()
+	if finished {
+		log.Printf("Key %s: Replay of %s finished", r.key, name)
+		r.broadcastRecording(RecordingStatusMessage{Type: "recording", State: "replay_finished", Name: name, Messages: len(messages)})
+	}
+}
+
+// stopReplay cancels a running replay, e.g. on live input, emergency stop or a disconnect.
+func (r *Room) stopReplay(reason string) {
+	r.mu.Lock()
+	stop := r.replayStop
+	r.replayStop = nil
+	r.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	log.Printf("Key %s: Replay stopped: %s", r.key, reason)
+	r.broadcastRecording(RecordingStatusMessage{Type: "recording", State: "replay_stopped", Message: reason})
+}
+
+// handleRecordMessage handles a controller's "record" (start/stop) and "replay" (start/stop)
+// messages. Errors go back to the controller that sent them.
+func (r *Room) handleRecordMessage(controller *Client, msg *ControlMessage) {
+	var err error
+	switch {
+	case msg.Type == "record" && msg.Action == "start":
+		var status RecordingStatusMessage
+		if status, err = r.startRecording(); err == nil {
+			r.broadcastRecording(status)
+		}
+	case msg.Type == "record" && msg.Action == "stop":
+		if status, ok := r.stopRecording(); ok {
+			r.broadcastRecording(status)
+		} else {
+			err = fmt.Errorf("not recording")
+		}
+	case msg.Type == "replay" && msg.Action == "start":
+		err = r.startReplay(msg.Recording)
+	case msg.Type == "replay" && msg.Action == "stop":
+		r.stopReplay("stopped by controller")
+	default:
+		err = fmt.Errorf("unknown %s action %q", msg.Type, msg.Action)
+	}
+	if err != nil {
+		log.Printf("Key %s: %s %s failed: %v", r.key, msg.Type, msg.Action, err)
+		r.sendStatusUpdate(controller, "recording_error", err.Error())
+	}
+}
+
+// broadcastRecording sends a recording status to the controllers and the client.
+func (r *Room) broadcastRecording(status RecordingStatusMessage) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.sendToControllers(status, "recording status")
+	r.sendMessage(r.client, status, "recording status")
+}
+
+// checkReplayTakeover refuses a replay requested with an invite while controllers hold the room,
+// unless the takeover policy would let a newcomer replace them. Caller must hold r.mu (read or write).
+func (r *Room) checkReplayTakeover() error {
+	if len(r.controllerTargets()) == 0 && !r.graceHeld("controller") {
+		return nil
+	}
+	if r.arbitration.mode != "" {
+		return fmt.Errorf("the room is shared by several controllers")
+	}
+	if policy := r.takeoverPolicy(); policy != "replace" {
+		return fmt.Errorf("a controller has the room and the takeover policy is %q", policy)
+	}
+	return nil
+}
+
+// handleRecordings lists recordings (GET /api/recordings, admin token only) and replays one into a
+// room (POST /api/recordings/replay?key=ROOM&name=RECORDING, authorized like a controller joining
+// the room, see authorizeRequest).
+func handleRecordings(w http.ResponseWriter, r *http.Request) {
+	if recordDir == "" {
+		http.Error(w, "recording is disabled on this server", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/recordings":
+		if !isAdminRequest(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		paths, err := filepath.Glob(filepath.Join(recordDir, "*.jsonl"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		names := make([]string, 0, len(paths))
+		for _, path := range paths {
+			names = append(names, strings.TrimSuffix(filepath.Base(path), ".jsonl"))
+		}
+		sort.Strings(names)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"recordings": names})
+
+	case r.Method == http.MethodPost && r.URL.Path == "/api/recordings/replay":
+		key := r.URL.Query().Get("key")
+		roomsMu.RLock()
+		room, ok := rooms[key]
+		var privileged bool
+		var authErr error
+		if ok {
+			privileged, authErr = authorizeRequest(room, key, r)
+		}
+		roomsMu.RUnlock()
+		if key == "" || !ok {
+			http.Error(w, "room not found", http.StatusNotFound)
+			return
+		}
+		if authErr != nil {
+			http.Error(w, authErr.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !privileged {
+			room.mu.RLock()
+			err := room.checkReplayTakeover()
+			room.mu.RUnlock()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+		if err := room.startReplay(r.URL.Query().Get("name")); errors.Is(err, errRoomLocked) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
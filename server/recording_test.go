@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// failingWriter rejects every write, like a full disk.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestRecordingRoundTrip(t *testing.T) {
+	recordDir = t.TempDir()
+	t.Cleanup(func() { recordDir = "" })
+	room := addRoom(t, "recorder", "")
+
+	status, err := room.startRecording()
+	if err != nil {
+		t.Fatalf("start recording: %v", err)
+	}
+	room.recordControlMessage(&ControlMessage{Type: "control", Position: 0.25})
+	room.recordControlMessage(&ControlMessage{Type: "vibrate", Intensity: 0.5})
+	room.recordControlMessage(&ControlMessage{Type: "control", Position: 0.75})
+	stopped, ok := room.stopRecording()
+	if !ok || stopped.Messages != 3 || stopped.Message != "" {
+		t.Fatalf("stop recording: %+v, want 3 messages and no error", stopped)
+	}
+
+	messages, err := loadRecording(status.Name)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(messages) != 3 || messages[1].Message.Type != "vibrate" || messages[2].Message.Position != 0.75 {
+		t.Fatalf("loaded %+v, want the three recorded messages in order", messages)
+	}
+
+	// Only linear input makes it into the funscript export
+	data, err := os.ReadFile(filepath.Join(recordDir, status.Name+".funscript"))
+	if err != nil {
+		t.Fatalf("read export: %v", err)
+	}
+	var script Funscript
+	if err := json.Unmarshal(data, &script); err != nil {
+		t.Fatalf("decode export %s: %v", data, err)
+	}
+	if len(script.Actions) != 2 || script.Actions[0].Pos != 25 || script.Actions[1].Pos != 75 {
+		t.Fatalf("exported %+v, want positions 25 and 75", script.Actions)
+	}
+
+	if _, err := loadRecording("../" + status.Name); err == nil {
+		t.Fatal("a recording name with a path was accepted")
+	}
+}
+
+func TestRecordingWriteErrorStopsRecording(t *testing.T) {
+	recordDir = t.TempDir()
+	t.Cleanup(func() { recordDir = "" })
+	room := addRoom(t, "full-disk", "")
+
+	if _, err := room.startRecording(); err != nil {
+		t.Fatalf("start recording: %v", err)
+	}
+	room.mu.Lock()
+	room.recorder.writer = bufio.NewWriterSize(failingWriter{}, 16) // Lines are longer, so every write fails
+	room.mu.Unlock()
+
+	room.recordControlMessage(&ControlMessage{Type: "control", Position: 0.5})
+
+	room.mu.RLock()
+	recorder := room.recorder
+	room.mu.RUnlock()
+	if recorder != nil {
+		t.Fatal("the recording kept running after a failed write")
+	}
+	if _, ok := room.stopRecording(); ok {
+		t.Fatal("stop found a recording after it had failed")
+	}
+}
+
+func TestReplayHTTP(t *testing.T) {
+	recordDir, adminToken = t.TempDir(), "admin-token"
+	t.Cleanup(func() { recordDir, adminToken = "", "" })
+	line := `{"t":0,"msg":{"type":"control","position":0.5}}` + "\n"
+	if err := os.WriteFile(filepath.Join(recordDir, "session.jsonl"), []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newTestServer(t)
+	room := addRoom(t, "replay", "")
+	request := func(method string, path string, token string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := request("GET", "/api/recordings", ""); code != http.StatusUnauthorized {
+		t.Fatalf("listing without the admin token: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := request("GET", "/api/recordings", "admin-token"); code != http.StatusOK {
+		t.Fatalf("listing with the admin token: status %d, want %d", code, http.StatusOK)
+	}
+	if code := request("POST", "/api/recordings/replay?key=replay&name=missing", ""); code != http.StatusBadRequest {
+		t.Fatalf("replay of a missing recording: status %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := request("POST", "/api/recordings/replay?key=nobody&name=session", ""); code != http.StatusNotFound {
+		t.Fatalf("replay into a missing room: status %d, want %d", code, http.StatusNotFound)
+	}
+
+	room.mu.Lock()
+	room.locked = true
+	room.mu.Unlock()
+	if code := request("POST", "/api/recordings/replay?key=replay&name=session", ""); code != http.StatusConflict {
+		t.Fatalf("replay into a locked room: status %d, want %d", code, http.StatusConflict)
+	}
+
+	room.mu.Lock()
+	room.locked = false
+	room.mu.Unlock()
+	if code := request("POST", "/api/recordings/replay?key=replay&name=session", ""); code != http.StatusAccepted {
+		t.Fatalf("replay: status %d, want %d", code, http.StatusAccepted)
+	}
+	room.stopReplay("test over")
+
+	owned := addRoom(t, "replay-owned", "owner-secret")
+	invite, _ := newInvite("replay-owned", owned.owner, time.Minute)
+	replay := "/api/recordings/replay?key=replay-owned&name=session"
+	if code := request("POST", replay, ""); code != http.StatusUnauthorized {
+		t.Fatalf("replay into an owned room without invite: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := request("POST", replay+"&owner=owner-secret", ""); code != http.StatusAccepted {
+		t.Fatalf("replay with the owner secret: status %d, want %d", code, http.StatusAccepted)
+	}
+	owned.stopReplay("test over")
+	if code := request("POST", replay+"&invite="+url.QueryEscape(invite), ""); code != http.StatusAccepted {
+		t.Fatalf("replay with invite: status %d, want %d", code, http.StatusAccepted)
+	}
+	owned.stopReplay("test over")
+
+	// An invite does not get around a controller that holds the room under the "reject" policy
+	owned.mu.Lock()
+	owned.takeover = "reject"
+	owned.controller = &Client{}
+	owned.mu.Unlock()
+	if code := request("POST", replay+"&invite="+url.QueryEscape(invite), ""); code != http.StatusConflict {
+		t.Fatalf("replay with invite into an occupied room: status %d, want %d", code, http.StatusConflict)
+	}
+	if code := request("POST", replay+"&owner=owner-secret", ""); code != http.StatusAccepted {
+		t.Fatalf("replay with the owner secret into an occupied room: status %d, want %d", code, http.StatusAccepted)
+	}
+	owned.stopReplay("test over")
+	if code := request("POST", replay, "admin-token"); code != http.StatusAccepted {
+		t.Fatalf("replay with the admin token into an occupied room: status %d, want %d", code, http.StatusAccepted)
+	}
+	owned.stopReplay("test over")
+}
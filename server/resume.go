@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"log"
+	"time"
+)
+
+// resumeGrace is how long a room holds the place of a dropped connection for a reconnect with its
+// resume token. 0 disables resuming: a disconnect resets the room state right away.
+var resumeGrace time.Duration
+
+// SessionMessage hands a new connection the token that lets it resume its place after a drop.
+type SessionMessage struct {
+	Type        string `json:"type"`        // Always "session"
+	ResumeToken string `json:"resumeToken"` // Pass as ?resume= when reconnecting
+	GraceMs     int64  `json:"graceMs"`     // How long the place is held after a disconnect
+	Resumed     bool   `json:"resumed"`     // This connection took over the state of a dropped one
+}
+
+// resumeSlot is the resume state of one role ("controller" or "client") in a room.
+type resumeSlot struct {
+	token      string      // Token of the role's latest connection
+	timer      *time.Timer // Running while the role is within its grace period
+	generation uint64      // Bumped whenever the grace period starts or ends, so a stale timer does nothing
+}
+
+// issueResumeToken gives the role's new connection a fresh token, or "" if resuming is disabled.
+// Caller must hold r.mu.
+func (r *Room) issueResumeToken(role string) string {
+	if resumeGrace <= 0 {
+		return ""
+	}
+	if r.resume == nil {
+		r.resume = make(map[string]*resumeSlot)
+	}
+	slot, ok := r.resume[role]
+	if !ok {
+		slot = &resumeSlot{}
+		r.resume[role] = slot
+	}
+	slot.token = rand.Text()
+	return slot.token
+}
+
+// sendSession issues a resume token to a connection that just took its role in the room.
+// Caller must hold r.mu.
+func (r *Room) sendSession(c *Client, resumed bool) {
+	if token := r.issueResumeToken(c.Type); token != "" {
+		r.sendMessage(c, SessionMessage{Type: "session", ResumeToken: token, GraceMs: resumeGrace.Milliseconds(), Resumed: resumed}, "session")
+	}
+}
+
+// startGrace holds the place of the role's dropped connection for resumeGrace and reports whether
+// it did. The room state is released when the period runs out. Caller must hold r.mu.
+func (r *Room) startGrace(role string) bool {
+	slot := r.resume[role]
+	if resumeGrace <= 0 || slot == nil {
+		return false
+	}
+	slot.generation++
+	generation := slot.generation
+	slot.timer = time.AfterFunc(resumeGrace, func() { r.expireGrace(role, generation) })
+	log.Printf("Key %s: Holding the %s's place for %v", r.key, role, resumeGrace)
+	return true
+}
+
+// inGrace reports whether a dropped connection may still resume. Caller must hold r.mu (read or write).
+func (r *Room) inGrace() bool {
+	for _, slot := range r.resume {
+		if slot.timer != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// graceHeld reports whether the role's dropped connection may still resume. Caller must hold r.mu
+// (read or write).
+func (r *Room) graceHeld(role string) bool {
+	slot := r.resume[role]
+	return slot != nil && slot.timer != nil
+}
+
+// cancelGrace ends the role's grace period and reports whether one was running. Caller must hold r.mu.
+func (r *Room) cancelGrace(role string) bool {
+	slot := r.resume[role]
+	if slot == nil || slot.timer == nil {
+		return false
+	}
+	slot.timer.Stop()
+	slot.timer = nil
+	slot.generation++
+	return true
+}
+
+// revokeResume invalidates the role's resume token, so the connection holding the role cannot
+// come back in its place, and ends its grace period. It reports whether a grace period was running;
+// the caller then releases the role. Caller must hold r.mu.
+func (r *Room) revokeResume(role string) bool {
+	held := r.cancelGrace(role)
+	delete(r.resume, role) // startGrace holds no place without a slot, so the disconnect releases the role
+	return held
+}
+
+// reclaimRole runs before a new connection registers for role. A valid resume token ends the grace
+// period and keeps the room state for the new connection. Without one, a pending grace period ends
+// right away and the dropped connection's state is released, so the new one starts over. The
+// exception is a controller: the takeover policy decides whether it may take the dropped
+// controller's place (see admitController). Caller must not hold r.mu.
+func (r *Room) reclaimRole(role string, token string) bool {
+	r.mu.Lock()
+	slot := r.resume[role]
+	if slot == nil || slot.timer == nil {
+		r.mu.Unlock()
+		return false
+	}
+	resumed := token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(slot.token)) == 1
+	if !resumed && role == "controller" {
+		r.mu.Unlock()
+		return false // Still holding the place, the takeover policy decides
+	}
+	r.cancelGrace(role)
+	r.mu.Unlock()
+
+	if resumed {
+		log.Printf("Key %s: The %s resumed its session", r.key, role)
+		return true
+	}
+	log.Printf("Key %s: New %s without a valid resume token, ending the grace period", r.key, role)
+	r.releaseRole(role)
+	return false
+}
+
+// expireGrace releases the role's state once its grace period ran out without a reconnect.
+func (r *Room) expireGrace(role string, generation uint64) {
+	r.mu.Lock()
+	slot := r.resume[role]
+	if slot == nil || slot.generation != generation {
+		r.mu.Unlock()
+		return // Resumed or taken over in the meantime
+	}
+	slot.timer = nil
+	slot.generation++
+	r.mu.Unlock()
+
+	log.Printf("Key %s: Grace period of the %s ran out", r.key, role)
+	r.releaseRole(role)
+
+	// A controller that queued behind the dropped one takes its place
+	var next *Client
+	if role == "controller" {
+		r.mu.Lock()
+		if r.controller == nil {
+			next = r.nextWaitingController()
+		}
+		r.mu.Unlock()
+	}
+	if next != nil {
+		r.promoteController(next)
+	}
+	r.removeIfEmpty()
+}
+
+// releaseRole resets what a departed connection left in the room and tells the other party it is
+// gone. Runs on disconnect, or when the grace period ends without a resume.
+func (r *Room) releaseRole(role string) {
+	r.mu.Lock()
+	r.releaseRoleLocked(role)
+	r.mu.Unlock()
+
+	if role == "controller" {
+		r.finishRecording()
+	}
+}
+
+// releaseRoleLocked is the part of releaseRole that runs under the room lock. A caller releasing the
+// controller role calls finishRecording once it released r.mu. Caller must hold r.mu.
+func (r *Room) releaseRoleLocked(role string) {
+	if role == "controller" {
+		if r.jitter != nil {
+			r.jitter.close() // Held input must not play out after the controller is gone
+			r.jitter = nil
+		}
+		r.sendStatusUpdate(r.client, "controller_disconnected", "")
+	} else {
+		r.resetDevices()                 // Clear devices and last commanded positions for this room
+		r.setSafetyProfile(r.baseSafety) // The client's own profile leaves with it
+		r.sendStatusToControllers("client_disconnected", "")
+		r.sendStatusToControllers("waiting_client", "") // Controllers go back to waiting for a client
+	}
+}
+
+// finishRecording stops the room's recording, if any, once the controller that made it is gone.
+func (r *Room) finishRecording() {
+	if status, ok := r.stopRecording(); ok {
+		r.broadcastRecording(status)
+	}
+}
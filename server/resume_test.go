@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// waitSession reads until the server hands out a session and returns it.
+func waitSession(t *testing.T, ws *websocket.Conn) SessionMessage {
+	t.Helper()
+	msg := readUntil(t, ws, 2*time.Second, func(msg map[string]json.RawMessage) bool { return string(msg["type"]) == `"session"` })
+	var session SessionMessage
+	data, _ := json.Marshal(msg)
+	json.Unmarshal(data, &session)
+	return session
+}
+
+func TestClientResumeKeepsDevices(t *testing.T) {
+	srv := newTestServer(t)
+	controller := dial(t, srv, "type=controller&key=resume")
+	waitStatus(t, controller, "waiting_client")
+
+	client := dial(t, srv, "type=client&key=resume")
+	token := waitSession(t, client).ResumeToken
+	client.WriteJSON(MessageFromClient{Type: "deviceList", Devices: []DeviceInfo{{Index: 0, Name: "Stroker", LinearCount: 1}}})
+	waitStatus(t, controller, "ready")
+
+	client.Close()
+	waitStatus(t, controller, "client_reconnecting")
+
+	resumed := dial(t, srv, "type=client&key=resume&resume="+url.QueryEscape(token))
+	session := waitSession(t, resumed)
+	if !session.Resumed {
+		t.Fatal("a reconnect with the resume token did not resume")
+	}
+	waitStatus(t, controller, "client_reconnected")
+	waitStatus(t, controller, "ready") // The devices survived the drop
+
+	// Without the token, the new client starts over
+	resumed.Close()
+	waitStatus(t, controller, "client_reconnecting")
+	fresh := dial(t, srv, "type=client&key=resume")
+	if waitSession(t, fresh).Resumed {
+		t.Fatal("a reconnect without the resume token resumed")
+	}
+	waitStatus(t, controller, "client_disconnected")
+	room := lookupRoom("resume")
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	if room.hasDevice() {
+		t.Fatal("a new client inherited the dropped client's devices")
+	}
+}
+
+func TestGraceExpiryRemovesEmptyRoom(t *testing.T) {
+	srv := newTestServer(t)
+	client := dial(t, srv, "type=client&key=expire")
+	waitSession(t, client)
+	room := lookupRoom("expire")
+
+	client.Close()
+	eventually(t, time.Second, "the grace period to start", func() bool {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return room.graceHeld("client")
+	})
+	if lookupRoom("expire") != room {
+		t.Fatal("the room was removed while the client could still resume")
+	}
+	eventually(t, 2*resumeGrace+time.Second, "the room to be removed", func() bool { return lookupRoom("expire") == nil })
+}
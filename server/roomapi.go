@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	closeRoomExpired = 4408 // The room's lifetime from POST /api/rooms ran out
+
+	maxCreateRoomBytes = 64 << 10
+)
+
+var (
+	requireCreatedRooms bool          // Refuse room keys that were not created with POST /api/rooms
+	maxRoomTTL          time.Duration // Lifetime of created rooms, the default and the longest allowed
+	maxCreatedRooms     int           // Created rooms alive at once, 0 = no cap
+	createRoomRate      int           // Rooms one address may create per minute, 0 = no limit
+)
+
+// roomCreations counts POST /api/rooms requests per remote address in fixed one-minute windows.
+type roomCreations struct {
+	mu     sync.Mutex
+	window time.Time
+	counts map[string]int
+}
+
+var creations roomCreations
+
+// allow reports whether the address of r may create another room in the current window, and
+// counts the request if so.
+func (c *roomCreations) allow(r *http.Request) bool {
+	if createRoomRate <= 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); now.Sub(c.window) >= time.Minute {
+		c.window = now
+		c.counts = make(map[string]int)
+	}
+	if c.counts[host] >= createRoomRate {
+		return false
+	}
+	c.counts[host]++
+	return true
+}
+
+// createdRooms holds the settings of rooms created with POST /api/rooms until they expire, keyed by
+// room key. A created room keeps its key and settings while nobody is connected. Guarded by roomsMu.
+var createdRooms = make(map[string]*createdRoom)
+
+// createdRoom is a room key issued by the server and the settings its room starts with.
+type createdRoom struct {
+	owner    []byte         // SHA-256 of the owner secret handed out with the client URL
+	takeover string         // Takeover policy, empty for the server default
+	safety   *SafetyProfile // Safety profile in force until the client pushes its own
+	expires  time.Time
+}
+
+// CreateRoomRequest is the optional JSON body of POST /api/rooms.
+type CreateRoomRequest struct {
+	TakeoverPolicy string         `json:"takeoverPolicy,omitempty"` // "replace", "reject", "approve" or "queue"
+	Safety         *SafetyProfile `json:"safety,omitempty"`
+	TTLSec         int64          `json:"ttlSec,omitempty"` // Room lifetime, capped at -room-ttl
+}
+
+// CreateRoomResponse tells the creator the new room key and how to join it.
+type CreateRoomResponse struct {
+	Key           string `json:"key"`
+	OwnerSecret   string `json:"ownerSecret"`   // Included in the client URL, proves the client owns the room
+	ClientURL     string `json:"clientUrl"`     // For the person with the toy
+	ControllerURL string `json:"controllerUrl"` // Carries an invite valid for the room's lifetime (at most -invite-ttl)
+	SpectatorURL  string `json:"spectatorUrl"`  // WebSocket URL for read-only spectators
+	ExpiresAt     int64  `json:"expiresAt"`     // Unix ms
+}
+
+// handleCreateRoom serves POST /api/rooms: it creates a room with a random key and returns the join URLs.
+// Each address may create -create-room-rate rooms per minute and at most -max-created-rooms may be
+// alive at once; requests with the admin token are exempt.
+func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	admin := isAdminRequest(r)
+	if !admin && !creations.allow(r) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many rooms created, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	var req CreateRoomRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCreateRoomBytes)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid room settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.TakeoverPolicy != "" && !takeoverPolicies[req.TakeoverPolicy] {
+		http.Error(w, fmt.Sprintf("unknown takeover policy %q", req.TakeoverPolicy), http.StatusBadRequest)
+		return
+	}
+	if req.Safety != nil {
+		if err := req.Safety.normalize(); err != nil {
+			http.Error(w, "invalid safety profile: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ttl := time.Duration(req.TTLSec) * time.Second
+	if ttl <= 0 || ttl > maxRoomTTL {
+		ttl = maxRoomTTL
+	}
+
+	key := rand.Text()
+	ownerSecret := rand.Text()
+	created := &createdRoom{
+		owner:    hashOwnerSecret(ownerSecret),
+		takeover: req.TakeoverPolicy,
+		safety:   req.Safety,
+		expires:  time.Now().Add(ttl),
+	}
+	invite, _ := newInvite(key, created.owner, ttl)
+
+	roomsMu.Lock()
+	if !admin && maxCreatedRooms > 0 && len(createdRooms) >= maxCreatedRooms {
+		roomsMu.Unlock()
+		log.Printf("Refusing to create a room, %d created rooms are alive", len(createdRooms))
+		http.Error(w, "the server has too many rooms, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	createdRooms[key] = created
+	roomsMu.Unlock()
+	time.AfterFunc(ttl, func() { expireCreatedRoom(key) })
+	log.Printf("Key %s: Room created via API, expires %s", key, created.expires.Format(time.RFC3339))
+
+	origin := "http://" + r.Host
+	wsOrigin := "ws://" + r.Host
+	if r.TLS != nil {
+		origin = "https://" + r.Host
+		wsOrigin = "wss://" + r.Host
+	}
+	escapedKey := url.QueryEscape(key)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateRoomResponse{
+		Key:           key,
+		OwnerSecret:   ownerSecret,
+		ClientURL:     origin + "/client/index.html?key=" + escapedKey + "&owner=" + url.QueryEscape(ownerSecret),
+		ControllerURL: origin + "/controller/index.html?key=" + escapedKey + "&invite=" + url.QueryEscape(invite),
+		SpectatorURL:  wsOrigin + "/ws?type=spectator&key=" + escapedKey + "&invite=" + url.QueryEscape(invite),
+		ExpiresAt:     created.expires.UnixMilli(),
+	})
+}
+
+// newRoom returns an empty room for key with the settings it was created with, if any. Caller must
+// hold roomsMu.
+func newRoom(key string) *Room {
+	room := &Room{
+		key:                    key,
+		devices:                make(map[uint32]DeviceInfo), // Initialize room-specific state
+		lastCommandedPositions: make(map[uint32]map[uint32]float64),
+		controllerConnected:    false,
+		clientConnected:        false,
+	}
+	if created := createdRooms[key]; created != nil {
+		room.owner = created.owner
+		room.takeover = created.takeover
+		room.baseSafety = created.safety
+		room.setSafetyProfile(created.safety)
+	}
+	return room
+}
+
+// checkRoomKey refuses keys the server did not create when -require-created-rooms is set.
+// Caller must hold roomsMu.
+func checkRoomKey(key string) error {
+	if requireCreatedRooms && createdRooms[key] == nil {
+		return errors.New("unknown room key, create rooms with POST /api/rooms")
+	}
+	return nil
+}
+
+// expireCreatedRoom forgets a created room key once its lifetime ran out and disconnects everyone
+// still in the room.
+func expireCreatedRoom(key string) {
+	roomsMu.Lock()
+	delete(createdRooms, key)
+	room := rooms[key]
+	delete(rooms, key)
+	roomsMu.Unlock()
+
+	log.Printf("Key %s: Created room expired", key)
+	if room != nil {
+		room.closeAll(closeRoomExpired, "room expired")
+	}
+}
+
+// closeAll closes every connection in the room with code and reason.
+func (r *Room) closeAll(code int, reason string) {
+	r.mu.RLock()
+	connections := append(r.controllerTargets(), r.spectatorList()...)
+	if r.client != nil {
+		connections = append(connections, r.client)
+	}
+	for _, w := range r.waiting {
+		connections = append(connections, w.client)
+	}
+	r.mu.RUnlock()
+
+	for _, c := range connections {
+		c.closeWith(code, reason)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createRoom posts body to /api/rooms and returns the status code and the response, forgetting the
+// room afterwards.
+func createRoom(t *testing.T, srv *httptest.Server, body string) (int, CreateRoomResponse) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/rooms", strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("create room: %v", err)
+	}
+	defer resp.Body.Close()
+	var created CreateRoomResponse
+	if json.NewDecoder(resp.Body).Decode(&created) == nil && created.Key != "" {
+		t.Cleanup(func() {
+			roomsMu.Lock()
+			delete(createdRooms, created.Key)
+			delete(rooms, created.Key)
+			roomsMu.Unlock()
+		})
+	}
+	return resp.StatusCode, created
+}
+
+// limitRoomCreation sets the POST /api/rooms limits for one test.
+func limitRoomCreation(t *testing.T, rate int, capacity int) {
+	t.Helper()
+	creations = roomCreations{}
+	createRoomRate, maxCreatedRooms = rate, capacity
+	t.Cleanup(func() {
+		creations = roomCreations{}
+		createRoomRate, maxCreatedRooms = 0, 0
+	})
+}
+
+func TestCreateRoom(t *testing.T) {
+	srv := newTestServer(t)
+	if code, _ := createRoom(t, srv, `{"takeoverPolicy":"steal"}`); code != http.StatusBadRequest {
+		t.Fatalf("unknown policy: status %d, want 400", code)
+	}
+
+	code, created := createRoom(t, srv, `{"takeoverPolicy":"reject","safety":{"maxSpeed":0.5},"ttlSec":60}`)
+	if code != http.StatusCreated || created.Key == "" || created.OwnerSecret == "" {
+		t.Fatalf("got status %d and %+v, want 201 with a key and an owner secret", code, created)
+	}
+	if remaining := time.Until(time.UnixMilli(created.ExpiresAt)); remaining <= 0 || remaining > time.Minute {
+		t.Fatalf("room expires in %s, want within the requested minute", remaining)
+	}
+	controllerURL, err := url.Parse(created.ControllerURL)
+	if err != nil || controllerURL.Query().Get("invite") == "" {
+		t.Fatalf("controller URL %q carries no invite", created.ControllerURL)
+	}
+	key := url.QueryEscape(created.Key)
+
+	// The room is owned from the start and keeps its settings until the client joins
+	if code := waitClose(t, dial(t, srv, "type=client&key="+key+"&owner=wrong")); code != closeUnauthorized {
+		t.Fatalf("client with the wrong secret closed with %d, want %d", code, closeUnauthorized)
+	}
+	client := dial(t, srv, "type=client&key="+key+"&owner="+url.QueryEscape(created.OwnerSecret))
+	waitSession(t, client)
+	room := lookupRoom(created.Key)
+	room.mu.RLock()
+	maxSpeed, takeover := room.maxSpeed(), room.takeover
+	room.mu.RUnlock()
+	if maxSpeed != 0.5 || takeover != "reject" {
+		t.Fatalf("room has max speed %v and policy %q, want 0.5 and reject", maxSpeed, takeover)
+	}
+
+	if code := waitClose(t, dial(t, srv, "type=controller&key="+key)); code != closeUnauthorized {
+		t.Fatalf("controller without an invite closed with %d, want %d", code, closeUnauthorized)
+	}
+	invited := "type=controller&key=" + key + "&invite=" + url.QueryEscape(controllerURL.Query().Get("invite"))
+	controller := dial(t, srv, invited)
+	waitSession(t, controller)
+	if code := waitClose(t, dial(t, srv, invited)); code != closeRoomOccupied {
+		t.Fatalf("second controller closed with %d, want %d", code, closeRoomOccupied)
+	}
+
+	expireCreatedRoom(created.Key)
+	if code := waitClose(t, client); code != closeRoomExpired {
+		t.Fatalf("client closed with %d on expiry, want %d", code, closeRoomExpired)
+	}
+	if code := waitClose(t, controller); code != closeRoomExpired {
+		t.Fatalf("controller closed with %d on expiry, want %d", code, closeRoomExpired)
+	}
+}
+
+func TestRequireCreatedRooms(t *testing.T) {
+	requireCreatedRooms = true
+	t.Cleanup(func() { requireCreatedRooms = false })
+	srv := newTestServer(t)
+
+	if code := waitClose(t, dial(t, srv, "type=client&key=ad-hoc")); code != closeRoomNotFound {
+		t.Fatalf("ad-hoc key closed with %d, want %d", code, closeRoomNotFound)
+	}
+	_, created := createRoom(t, srv, "")
+	waitSession(t, dial(t, srv, "type=client&key="+url.QueryEscape(created.Key)+"&owner="+url.QueryEscape(created.OwnerSecret)))
+}
+
+func TestCreateRoomRateLimit(t *testing.T) {
+	srv := newTestServer(t)
+	limitRoomCreation(t, 2, 0)
+
+	for i := range 2 {
+		if code, _ := createRoom(t, srv, ""); code != http.StatusCreated {
+			t.Fatalf("room %d: status %d, want 201", i+1, code)
+		}
+	}
+	if code, _ := createRoom(t, srv, ""); code != http.StatusTooManyRequests {
+		t.Fatalf("third room: status %d, want 429", code)
+	}
+}
+
+func TestCreateRoomCap(t *testing.T) {
+	srv := newTestServer(t)
+	roomsMu.RLock()
+	alive := len(createdRooms)
+	roomsMu.RUnlock()
+	limitRoomCreation(t, 0, alive+1)
+
+	if code, _ := createRoom(t, srv, ""); code != http.StatusCreated {
+		t.Fatalf("first room: status %d, want 201", code)
+	}
+	if code, _ := createRoom(t, srv, ""); code != http.StatusServiceUnavailable {
+		t.Fatalf("room over the cap: status %d, want 503", code)
+	}
+}
+
+func TestLastSpectatorRemovesEmptyRoom(t *testing.T) {
+	srv := newTestServer(t)
+	roomsMu.Lock()
+	createdRooms["spectated"] = &createdRoom{expires: time.Now().Add(time.Hour)}
+	roomsMu.Unlock()
+	t.Cleanup(func() {
+		roomsMu.Lock()
+		delete(createdRooms, "spectated")
+		delete(rooms, "spectated")
+		roomsMu.Unlock()
+	})
+
+	first := dial(t, srv, "type=spectator&key=spectated")
+	second := dial(t, srv, "type=spectator&key=spectated")
+	eventually(t, 2*time.Second, "the spectators to join", func() bool {
+		room := lookupRoom("spectated")
+		if room == nil {
+			return false
+		}
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return len(room.spectators) == 2
+	})
+
+	first.Close()
+	eventually(t, 2*time.Second, "the first spectator to leave", func() bool {
+		room := lookupRoom("spectated")
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return len(room.spectators) == 1
+	})
+	second.Close()
+	eventually(t, 2*time.Second, "the room to be removed", func() bool { return lookupRoom("spectated") == nil })
+}
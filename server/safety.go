@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// SafetyProfile holds the limits the device owner (client) pushes for its room.
+// The server enforces them on every motion command, whatever the controller sends.
+type SafetyProfile struct {
+	MinPosition       float64 `json:"minPosition"`       // 0.0 - 1.0
+	MaxPosition       float64 `json:"maxPosition"`       // 0.0 - 1.0, 0 means 1.0
+	MaxSpeed          float64 `json:"maxSpeed"`          // Same scale as ControlMessage.Speed, 0 means unlimited
+	MaxAcceleration   float64 `json:"maxAcceleration"`   // Max change of speed per second, 0 means unlimited
+	MaxIntensity      float64 `json:"maxIntensity"`      // Cap for vibrate/rotate/scalar intensities, 0 means unlimited
+	MaxSessionSeconds uint32  `json:"maxSessionSeconds"` // Motion allowed after the first command, 0 means unlimited
+	Mode              string  `json:"mode"`              // "clamp" (default) adjusts violating commands, "reject" drops them
+
+	// Dead-man watchdog overrides
+	WatchdogMs   uint32   `json:"watchdogMs,omitempty"`   // Stop after this long without controller input, 0 uses the server default
+	RestPosition *float64 `json:"restPosition,omitempty"` // Strokers return here instead of stopping where they are
+}
+
+const (
+	safetyModeClamp  = "clamp"
+	safetyModeReject = "reject"
+
+	safetyReportInterval = time.Second            // Max rate of safety_violation status updates per room
+	safetyIdleReset      = time.Second            // After this gap the device is assumed to be at rest
+	safetyDefaultStep    = 100 * time.Millisecond // Acceleration time step when the previous command is stale
+)
+
+// errSafetySessionExpired is returned once the profile's session length is used up.
+var errSafetySessionExpired = errors.New("safety session length exceeded")
+
+// errRoomLocked refuses scripted motion while the client's emergency stop holds the room.
+var errRoomLocked = errors.New("room is locked by the client's emergency stop")
+
+// normalize fills in defaults and validates the profile.
+func (p *SafetyProfile) normalize() error {
+	if p.MaxPosition == 0 {
+		p.MaxPosition = 1.0
+	}
+	if p.MinPosition < 0 || p.MaxPosition > 1 || p.MinPosition >= p.MaxPosition {
+		return fmt.Errorf("invalid position range %.3f - %.3f", p.MinPosition, p.MaxPosition)
+	}
+	if p.MaxSpeed < 0 || p.MaxAcceleration < 0 || p.MaxIntensity < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if p.RestPosition != nil && (*p.RestPosition < p.MinPosition || *p.RestPosition > p.MaxPosition) {
+		return fmt.Errorf("rest position %.3f outside %.3f - %.3f", *p.RestPosition, p.MinPosition, p.MaxPosition)
+	}
+	switch p.Mode {
+	case "":
+		p.Mode = safetyModeClamp
+	case safetyModeClamp, safetyModeReject:
+	default:
+		return fmt.Errorf("unknown safety mode %q", p.Mode)
+	}
+	return nil
+}
+
+// axisKey identifies one linear axis of one device.
+type axisKey struct {
+	device uint32
+	axis   uint32
+}
+
+// velocitySample is the signed speed last commanded to an axis.
+type velocitySample struct {
+	velocity float64
+	at       time.Time
+}
+
+// safetyState is the per-room enforcement state of the safety profile.
+type safetyState struct {
+	profile        *SafetyProfile
+	sessionStart   time.Time // Set by the first motion command under the profile
+	sessionExpired bool
+	lastVelocities map[axisKey]velocitySample
+	lastReport     time.Time // Last safety_violation status sent
+}
+
+// SafetyProfileMessage tells both parties which limits are active (Profile is nil when cleared).
+type SafetyProfileMessage struct {
+	Type    string         `json:"type"` // Always "safety"
+	Profile *SafetyProfile `json:"profile"`
+}
+
+// setSafetyProfile replaces the room's profile and restarts its session clock. Caller must hold r.mu.
+func (r *Room) setSafetyProfile(profile *SafetyProfile) {
+	r.safety = safetyState{
+		profile:        profile,
+		lastVelocities: make(map[axisKey]velocitySample),
+	}
+}
+
+// maxSpeed returns the speed limit for linear moves, or 0 if there is none. Caller must hold r.mu.
+func (r *Room) maxSpeed() float64 {
+	if r.safety.profile == nil {
+		return 0
+	}
+	return r.safety.profile.MaxSpeed
+}
+
+// enforceSafety checks a motion message against the room's safety profile before it is constructed.
+// In clamp mode the message is adjusted in place and the adjustments are returned as violations;
+// in reject mode the first violation is returned as an error. Caller must hold r.mu.
+func (r *Room) enforceSafety(msg *ControlMessage, targets []uint32, lastPositions map[uint32]map[uint32]float64) ([]string, error) {
+	profile := r.safety.profile
+	if profile == nil || msg.Type == "stop" {
+		return nil, nil // Stopping is always allowed
+	}
+
+	now := time.Now()
+	if profile.MaxSessionSeconds > 0 {
+		if r.safety.sessionStart.IsZero() {
+			r.safety.sessionStart = now
+		}
+		if r.safety.sessionExpired || now.Sub(r.safety.sessionStart) > time.Duration(profile.MaxSessionSeconds)*time.Second {
+			r.safety.sessionExpired = true
+			return nil, errSafetySessionExpired
+		}
+	}
+
+	var violations []string
+	switch msg.Type {
+	case "control":
+		axes := append([]AxisCommand(nil), msg.linearAxes()...)
+		for i := range axes {
+			axis := &axes[i]
+			if axis.Position < profile.MinPosition || axis.Position > profile.MaxPosition {
+				clamped := math.Max(profile.MinPosition, math.Min(profile.MaxPosition, axis.Position))
+				violations = append(violations, fmt.Sprintf("axis %d position %.3f outside %.3f - %.3f", axis.Index, axis.Position, profile.MinPosition, profile.MaxPosition))
+				axis.Position = clamped
+			}
+			if profile.MaxSpeed > 0 && axis.Speed > profile.MaxSpeed {
+				violations = append(violations, fmt.Sprintf("axis %d speed %.3f above %.3f", axis.Index, axis.Speed, profile.MaxSpeed))
+				axis.Speed = profile.MaxSpeed
+			}
+			if profile.MaxAcceleration > 0 {
+				if v := r.limitAcceleration(axis, targets, lastPositions, now, profile.MaxAcceleration); v != "" {
+					violations = append(violations, v)
+				}
+			}
+		}
+		if len(violations) > 0 && profile.Mode == safetyModeReject {
+			return violations, errors.New(strings.Join(violations, "; "))
+		}
+		if len(msg.Axes) > 0 {
+			msg.Axes = axes
+		} else {
+			msg.Position = axes[0].Position
+			msg.Speed = axes[0].Speed
+		}
+		r.recordVelocities(axes, targets, lastPositions, now)
+
+	case "vibrate", "rotate", "scalar":
+		if profile.MaxIntensity <= 0 {
+			break
+		}
+		actuators := append([]ActuatorCommand(nil), msg.actuatorCommands()...)
+		for i := range actuators {
+			if actuators[i].Intensity > profile.MaxIntensity {
+				violations = append(violations, fmt.Sprintf("actuator %d intensity %.3f above %.3f", actuators[i].Index, actuators[i].Intensity, profile.MaxIntensity))
+				actuators[i].Intensity = profile.MaxIntensity
+			}
+		}
+		if len(violations) > 0 && profile.Mode == safetyModeReject {
+			return violations, errors.New(strings.Join(violations, "; "))
+		}
+		msg.Actuators = actuators
+	}
+	return violations, nil
+}
+
+// signedVelocity returns the signed speed of a move from lastPos to pos, 0 if the axis doesn't move.
+func signedVelocity(pos, lastPos, speed float64) float64 {
+	if lastPos < 0 || math.Abs(pos-lastPos) < 0.001 {
+		return 0
+	}
+	if pos < lastPos {
+		return -speed
+	}
+	return speed
+}
+
+// previousVelocity returns the last velocity of an axis and the time step since then.
+// Stale samples mean the axis has come to rest.
+func (r *Room) previousVelocity(key axisKey, now time.Time) (float64, float64) {
+	prev, ok := r.safety.lastVelocities[key]
+	if !ok || now.Sub(prev.at) > safetyIdleReset {
+		return 0, safetyDefaultStep.Seconds()
+	}
+	return prev.velocity, math.Max(now.Sub(prev.at).Seconds(), 0.001)
+}
+
+// limitAcceleration lowers an axis' speed so that the change from the previously commanded velocity
+// stays within maxAcceleration on every target device. A reversal that comes too soon is slowed down
+// to the minimum the duration calculation allows. Caller must hold r.mu.
+func (r *Room) limitAcceleration(axis *AxisCommand, targets []uint32, lastPositions map[uint32]map[uint32]float64, now time.Time, maxAcceleration float64) string {
+	const minReversalSpeed = 0.05 // Matches minSpeedThreshold in computeLinearDuration
+
+	limited := axis.Speed
+	for _, device := range targets {
+		lastPos, ok := lastPositions[device][axis.Index]
+		if !ok {
+			continue
+		}
+		velocity := signedVelocity(axis.Position, lastPos, axis.Speed)
+		prevVelocity, dt := r.previousVelocity(axisKey{device, axis.Index}, now)
+		maxDelta := maxAcceleration * dt
+		if math.Abs(velocity-prevVelocity) <= maxDelta {
+			continue
+		}
+		allowed := prevVelocity + math.Copysign(maxDelta, velocity-prevVelocity)
+		speed := math.Abs(allowed)
+		if velocity != 0 && math.Signbit(allowed) != math.Signbit(velocity) {
+			speed = minReversalSpeed // Can't reverse yet, approach the new target as slowly as possible
+		}
+		limited = math.Min(limited, speed)
+	}
+	if limited >= axis.Speed {
+		return ""
+	}
+	violation := fmt.Sprintf("axis %d speed change to %.3f exceeds acceleration %.3f/s", axis.Index, axis.Speed, maxAcceleration)
+	axis.Speed = limited
+	return violation
+}
+
+// recordVelocities remembers the velocities of the axes about to be commanded. Caller must hold r.mu.
+func (r *Room) recordVelocities(axes []AxisCommand, targets []uint32, lastPositions map[uint32]map[uint32]float64, now time.Time) {
+	for _, device := range targets {
+		for _, axis := range axes {
+			lastPos, ok := lastPositions[device][axis.Index]
+			if !ok {
+				lastPos = -1.0
+			}
+			r.safety.lastVelocities[axisKey{device, axis.Index}] = velocitySample{
+				velocity: signedVelocity(axis.Position, lastPos, axis.Speed),
+				at:       now,
+			}
+		}
+	}
+}
+
+// shouldReportViolation rate-limits safety_violation status updates. Caller must hold r.mu.
+func (r *Room) shouldReportViolation() bool {
+	now := time.Now()
+	if now.Sub(r.safety.lastReport) < safetyReportInterval {
+		return false
+	}
+	r.safety.lastReport = now
+	return true
+}
+
+// emergencyStop stops every known device and locks the room until the client unlocks it.
+// While locked, all controller commands are dropped. Scripted motion is cancelled rather than
+// paused, so nothing picks up again after the unlock.
+func (r *Room) emergencyStop(client *Client) {
+	r.mu.Lock()
+	r.locked = true
+	r.disarmWatchdog()
+	devices := r.sortedDeviceIndices()
+	controllers := r.controllerTargets()
+	r.mu.Unlock()
+
+	log.Printf("Key %s: Emergency stop from client, stopping %d device(s) and locking the room", r.key, len(devices))
+	r.cancelScriptedMotion("emergency stop")
+	r.stopDevices(client, devices)
+	for _, controller := range controllers {
+		r.sendPriorityStatusUpdate(controller, "locked", "emergency stop by client")
+	}
+	r.sendPriorityStatusUpdate(client, "locked", "emergency stop by client")
+}
+
+// unlock lifts an emergency stop lock and tells both parties the current room state.
+func (r *Room) unlock(client *Client) {
+	r.mu.Lock()
+	wasLocked := r.locked
+	r.locked = false
+	controllers := r.controllerTargets()
+	r.mu.Unlock()
+
+	if !wasLocked {
+		log.Printf("Key %s: Unlock requested but room is not locked", r.key)
+		return
+	}
+	log.Printf("Key %s: Client unlocked the room", r.key)
+	for _, controller := range controllers {
+		r.sendStatusUpdate(controller, "unlocked", "")
+	}
+	r.sendStatusUpdate(client, "unlocked", "")
+	r.notifyDeviceChange(client)
+}
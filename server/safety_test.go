@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// safetyRoom returns a room with one linear device enforcing profile.
+func safetyRoom(t *testing.T, profile SafetyProfile) *Room {
+	t.Helper()
+	if err := profile.normalize(); err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	room := newTestRoom("safety")
+	room.setDeviceList([]DeviceInfo{{Index: 0, LinearCount: 1, VibrateCount: 1}})
+	room.setSafetyProfile(&profile)
+	return room
+}
+
+func TestSafetyClampsMotion(t *testing.T) {
+	room := safetyRoom(t, SafetyProfile{MinPosition: 0.2, MaxPosition: 0.8, MaxSpeed: 0.5, MaxIntensity: 0.4})
+
+	msg := ControlMessage{Type: "control", Position: 0.95, Speed: 1}
+	violations, err := room.enforceSafety(&msg, []uint32{0}, nil)
+	if err != nil || len(violations) != 2 {
+		t.Fatalf("got %v, %v, want a position and a speed violation", violations, err)
+	}
+	if msg.Position != 0.8 || msg.Speed != 0.5 {
+		t.Fatalf("clamped to %.2f at %.2f, want 0.80 at 0.50", msg.Position, msg.Speed)
+	}
+
+	msg = ControlMessage{Type: "control", Axes: []AxisCommand{{Index: 0, Position: 0.1, Speed: 0.3}}}
+	if _, err := room.enforceSafety(&msg, []uint32{0}, nil); err != nil || msg.Axes[0].Position != 0.2 {
+		t.Fatalf("axis clamped to %+v (%v), want position 0.2", msg.Axes[0], err)
+	}
+
+	msg = ControlMessage{Type: "vibrate", Intensity: 0.9}
+	if _, err := room.enforceSafety(&msg, []uint32{0}, nil); err != nil || msg.actuatorCommands()[0].Intensity != 0.4 {
+		t.Fatalf("intensity clamped to %+v (%v), want 0.4", msg.actuatorCommands(), err)
+	}
+
+	msg = ControlMessage{Type: "control", Position: 0.5, Speed: 0.4}
+	if violations, err := room.enforceSafety(&msg, []uint32{0}, nil); err != nil || len(violations) != 0 {
+		t.Fatalf("a command within the limits got %v, %v", violations, err)
+	}
+}
+
+func TestSafetyRejectMode(t *testing.T) {
+	room := safetyRoom(t, SafetyProfile{MaxPosition: 0.5, MaxIntensity: 0.4, Mode: safetyModeReject})
+
+	msg := ControlMessage{Type: "control", Position: 0.9, Speed: 0.5}
+	if _, err := room.enforceSafety(&msg, []uint32{0}, nil); err == nil {
+		t.Fatal("a position outside the profile was accepted")
+	}
+	msg = ControlMessage{Type: "scalar", Intensity: 0.5}
+	if _, err := room.enforceSafety(&msg, []uint32{0}, nil); err == nil {
+		t.Fatal("an intensity above the profile was accepted")
+	}
+	msg = ControlMessage{Type: "stop"}
+	if _, err := room.enforceSafety(&msg, []uint32{0}, nil); err != nil {
+		t.Fatalf("stop was refused: %v", err)
+	}
+}
+
+func TestSafetyLimitsAcceleration(t *testing.T) {
+	room := safetyRoom(t, SafetyProfile{MaxAcceleration: 1})
+	last := map[uint32]map[uint32]float64{0: {0: 0.5}}
+
+	// From rest, the speed may grow by 1/s over the default 100ms step
+	msg := ControlMessage{Type: "control", Position: 0.9, Speed: 1}
+	violations, err := room.enforceSafety(&msg, []uint32{0}, last)
+	if err != nil || len(violations) != 1 {
+		t.Fatalf("got %v, %v, want an acceleration violation", violations, err)
+	}
+	if msg.Speed < 0.099 || msg.Speed > 0.101 {
+		t.Fatalf("speed limited to %.3f, want 0.1", msg.Speed)
+	}
+
+	// Reversing right away is slowed down to the minimum speed
+	last[0][0] = 0.6
+	msg = ControlMessage{Type: "control", Position: 0.1, Speed: 1}
+	if _, err := room.enforceSafety(&msg, []uint32{0}, last); err != nil || msg.Speed != 0.05 {
+		t.Fatalf("reversal at %.3f (%v), want 0.05", msg.Speed, err)
+	}
+}
+
+func TestSafetySessionExpires(t *testing.T) {
+	room := safetyRoom(t, SafetyProfile{MaxSessionSeconds: 1})
+
+	msg := ControlMessage{Type: "control", Position: 0.5}
+	if _, err := room.enforceSafety(&msg, []uint32{0}, nil); err != nil {
+		t.Fatalf("first command: %v", err)
+	}
+	room.safety.sessionStart = time.Now().Add(-2 * time.Second)
+	if _, err := room.enforceSafety(&msg, []uint32{0}, nil); !errors.Is(err, errSafetySessionExpired) {
+		t.Fatalf("got %v after the session length, want errSafetySessionExpired", err)
+	}
+	stop := ControlMessage{Type: "stop"}
+	if _, err := room.enforceSafety(&stop, []uint32{0}, nil); err != nil {
+		t.Fatalf("stop after the session: %v", err)
+	}
+}
+
+func TestSafetyProfileValidation(t *testing.T) {
+	for _, p := range []SafetyProfile{
+		{MinPosition: 0.6, MaxPosition: 0.4},
+		{MaxPosition: 1.5},
+		{MaxSpeed: -1},
+		{Mode: "ignore"},
+	} {
+		if err := p.normalize(); err == nil {
+			t.Errorf("profile %+v was accepted", p)
+		}
+	}
+}
+
+func TestSafetyMaxSpeedLengthensMoves(t *testing.T) {
+	axes := []AxisCommand{{Index: 0, Position: 0.75, Speed: 1}}
+	tests := []struct {
+		last map[uint32]float64
+		want uint32
+	}{
+		{map[uint32]float64{0: 0.25}, 200}, // 0.5 at half of full speed
+		{nil, 400},                         // Unknown start, assumed a full stroke away
+	}
+	for _, tt := range tests {
+		data, err := constructLinearCmd(1, 0, axes, 100, 0, tt.last, false, 0.5, nil)
+		if err != nil {
+			t.Fatalf("construct: %v", err)
+		}
+		var messages []map[string]ButtplugLinearCmd
+		if err := json.Unmarshal(data, &messages); err != nil {
+			t.Fatalf("decode %s: %v", data, err)
+		}
+		if d := messages[0]["LinearCmd"].Vectors[0].Duration; d != tt.want {
+			t.Errorf("from %v: duration %dms, want %dms", tt.last, d, tt.want)
+		}
+	}
+}
+
+func TestSafetyProfileFromClient(t *testing.T) {
+	srv := newTestServer(t)
+	client := dial(t, srv, "type=client&key=safety-e2e")
+	if err := client.WriteJSON(MessageFromClient{Type: "deviceList", Devices: []DeviceInfo{{Index: 0, LinearCount: 1}}}); err != nil {
+		t.Fatalf("send device list: %v", err)
+	}
+	if err := client.WriteJSON(MessageFromClient{Type: "safetyProfile", Profile: &SafetyProfile{MaxPosition: 0.5}}); err != nil {
+		t.Fatalf("send profile: %v", err)
+	}
+	readUntil(t, client, 2*time.Second, func(msg map[string]json.RawMessage) bool { return string(msg["type"]) == `"safety"` })
+
+	controller := dial(t, srv, "type=controller&key=safety-e2e")
+	waitStatus(t, controller, "ready")
+	if err := controller.WriteJSON(ControlMessage{Type: "control", Position: 0.9, Speed: 0.5, SampleIntervalMs: 100}); err != nil {
+		t.Fatalf("send control: %v", err)
+	}
+
+	msg := readUntil(t, client, 2*time.Second, func(msg map[string]json.RawMessage) bool { return msg["LinearCmd"] != nil })
+	var cmd ButtplugLinearCmd
+	if err := json.Unmarshal(msg["LinearCmd"], &cmd); err != nil {
+		t.Fatalf("decode LinearCmd: %v", err)
+	}
+	if cmd.Vectors[0].Position != 0.5 {
+		t.Fatalf("the device was sent to %.2f, want it clamped to 0.5", cmd.Vectors[0].Position)
+	}
+	waitStatus(t, controller, "safety_violation")
+
+	// Leave one at a time, like TestEndToEnd
+	room := lookupRoom("safety-e2e")
+	controller.Close()
+	eventually(t, 2*time.Second, "the controller to leave", func() bool {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return !room.controllerConnected
+	})
+}
+
+func TestEmergencyStopLocksRoom(t *testing.T) {
+	srv := newTestServer(t)
+	client := dial(t, srv, "type=client&key=emergency")
+	if err := client.WriteJSON(MessageFromClient{Type: "deviceList", Devices: []DeviceInfo{{Index: 0, LinearCount: 1}, {Index: 1, VibrateCount: 1}}}); err != nil {
+		t.Fatalf("send device list: %v", err)
+	}
+	controller := dial(t, srv, "type=controller&key=emergency")
+	waitStatus(t, controller, "ready")
+
+	if err := client.WriteJSON(MessageFromClient{Type: "emergencyStop"}); err != nil {
+		t.Fatalf("send emergency stop: %v", err)
+	}
+	stopped := map[uint32]bool{}
+	readUntil(t, client, 2*time.Second, func(msg map[string]json.RawMessage) bool {
+		var stop ButtplugStopDeviceCmd
+		if json.Unmarshal(msg["StopDeviceCmd"], &stop) == nil {
+			stopped[stop.DeviceIndex] = true
+		}
+		return len(stopped) == 2
+	})
+	waitStatus(t, controller, "locked")
+
+	// Dropped while locked: the first motion the client sees is the one sent after the unlock
+	room := lookupRoom("emergency")
+	room.processControlMessage(&ControlMessage{Type: "control", Position: 0.9, Speed: 0.5})
+	if err := client.WriteJSON(MessageFromClient{Type: "unlock"}); err != nil {
+		t.Fatalf("send unlock: %v", err)
+	}
+	waitStatus(t, controller, "unlocked")
+	if err := controller.WriteJSON(ControlMessage{Type: "control", Position: 0.3, Speed: 0.5}); err != nil {
+		t.Fatalf("send control: %v", err)
+	}
+	msg := readUntil(t, client, 2*time.Second, func(msg map[string]json.RawMessage) bool { return msg["LinearCmd"] != nil })
+	var cmd ButtplugLinearCmd
+	if err := json.Unmarshal(msg["LinearCmd"], &cmd); err != nil || cmd.Vectors[0].Position != 0.3 {
+		t.Fatalf("first LinearCmd after the lock = %s, want position 0.3", msg["LinearCmd"])
+	}
+
+	controller.Close()
+	eventually(t, 2*time.Second, "the controller to leave", func() bool {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return !room.controllerConnected
+	})
+}
+
+func TestEmergencyStopCancelsScriptedMotion(t *testing.T) {
+	room := addRoom(t, "locked", "")
+	script := &Funscript{Actions: []FunscriptAction{{At: 0, Pos: 0}, {At: 60000, Pos: 100}}}
+	if err := room.loadFunscript(script, nil); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	room.handlePlaybackMessage(nil, &ControlMessage{Type: "playback", Action: "play"})
+	if err := room.startPattern(PatternParams{Waveform: "sine", FrequencyHz: 1, Max: 1, IntervalMs: 100}, nil); err != nil {
+		t.Fatalf("start pattern: %v", err)
+	}
+
+	room.emergencyStop(nil)
+
+	room.mu.RLock()
+	pattern, player := room.pattern, room.player
+	room.mu.RUnlock()
+	if pattern != nil {
+		t.Fatal("the pattern kept running after the emergency stop")
+	}
+	player.mu.Lock()
+	playing, position := player.playing, player.positionMs
+	player.mu.Unlock()
+	if playing || position != 0 {
+		t.Fatalf("playback after the emergency stop: playing=%v at %vms, want stopped at 0ms", playing, position)
+	}
+
+	// Nothing scripted may start while the room is locked
+	room.handlePlaybackMessage(nil, &ControlMessage{Type: "playback", Action: "play"})
+	player.mu.Lock()
+	playing = player.playing
+	player.mu.Unlock()
+	if playing {
+		t.Fatal("playback started while the room is locked")
+	}
+	if err := room.startPattern(PatternParams{Waveform: "sine", FrequencyHz: 1, Max: 1, IntervalMs: 100}, nil); !errors.Is(err, errRoomLocked) {
+		t.Fatalf("start pattern while locked: %v, want errRoomLocked", err)
+	}
+	if err := room.startReplay("any"); !errors.Is(err, errRoomLocked) {
+		t.Fatalf("start replay while locked: %v, want errRoomLocked", err)
+	}
+
+	// Unlocking does not resume anything
+	room.unlock(nil)
+	room.mu.RLock()
+	pattern = room.pattern
+	room.mu.RUnlock()
+	player.mu.Lock()
+	playing = player.playing
+	player.mu.Unlock()
+	if pattern != nil || playing {
+		t.Fatal("scripted motion resumed after the unlock")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	closeRoomNotFound = 4404 // Spectators only join rooms that exist
+
+	maxSpectators = 16 // Per room
+)
+
+// spectatorRate is how many frames per second a spectator receives at most.
+var spectatorRate int
+
+// SpectatorFrame is the view of a room sent to spectators whenever it changes, at most spectatorRate
+// times per second.
+type SpectatorFrame struct {
+	Type      string                        `json:"type"`                // Always "spectate"
+	State     string                        `json:"state"`               // "waiting_client", "client_reconnecting", "locked", "waiting_toy", "controller_reconnecting", "waiting_controller" or "ready"
+	Positions map[uint32]map[uint32]float64 `json:"positions,omitempty"` // Last commanded position per device index and axis index
+	At        int64                         `json:"at"`                  // Server time, Unix ms
+}
+
+// spectate serves a read-only connection: the spectator gets the device list, then a frame whenever
+// the room state or a commanded position changes. Anything it sends besides pings is ignored.
+func (r *Room) spectate(c *Client) {
+	r.mu.Lock()
+	if len(r.spectators) >= maxSpectators {
+		r.mu.Unlock()
+		log.Printf("Key %s: Rejecting spectator, the room has %d", r.key, maxSpectators)
+		c.closeWith(closeRoomOccupied, "too many spectators")
+		c.closeSend()
+		return
+	}
+	if r.spectators == nil {
+		r.spectators = make(map[*Client]bool)
+	}
+	r.spectatorSeq++
+	c.id = fmt.Sprintf("spectator-%d", r.spectatorSeq)
+	r.spectators[c] = true
+	r.sendMessage(c, r.deviceListMessage(), "devices")
+	log.Printf("Key %s: Spectator joined (%d watching)", r.key, len(r.spectators))
+	r.mu.Unlock()
+
+	go r.streamToSpectator(c)
+
+	for {
+		var msg MessageFromClient
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			break
+		}
+		c.received.Add(1)
+		if msg.Type != "ping" {
+			log.Printf("Key %s: Ignoring %s from spectator, spectators are read-only", r.key, msg.Type)
+		}
+	}
+
+	r.mu.Lock()
+	delete(r.spectators, c)
+	log.Printf("Key %s: Spectator left (%d watching)", r.key, len(r.spectators))
+	c.closeSend()
+	last := len(r.spectators) == 0
+	r.mu.Unlock()
+
+	// A spectator may be the only one who ever joined a created room
+	if last {
+		r.removeIfEmpty()
+	}
+}
+
+// streamToSpectator sends frames to a spectator until it leaves. Unchanged frames are skipped.
+func (r *Room) streamToSpectator(c *Client) {
+	ticker := time.NewTicker(time.Second / time.Duration(spectatorRate))
+	defer ticker.Stop()
+
+	var last []byte
+	for range ticker.C {
+		r.mu.RLock()
+		if !r.spectators[c] {
+			r.mu.RUnlock()
+			return
+		}
+		frame := r.spectatorFrameLocked()
+		data, _ := json.Marshal(frame)
+		if !bytes.Equal(data, last) {
+			last = data
+			frame.At = time.Now().UnixMilli()
+			r.sendMessage(c, frame, "spectator frame")
+		}
+		r.mu.RUnlock()
+	}
+}
+
+// spectatorFrameLocked captures the room for spectators, without a timestamp so unchanged frames
+// compare equal. Caller must hold r.mu (read or write).
+func (r *Room) spectatorFrameLocked() SpectatorFrame {
+	frame := SpectatorFrame{Type: "spectate", State: "ready", Positions: make(map[uint32]map[uint32]float64, len(r.lastCommandedPositions))}
+	for index := range r.lastCommandedPositions {
+		frame.Positions[index] = r.axisPositions(index)
+	}
+
+	reconnecting := func(role string) bool {
+		slot := r.resume[role]
+		return slot != nil && slot.timer != nil
+	}
+	switch {
+	case reconnecting("client"):
+		frame.State = "client_reconnecting"
+	case !r.clientConnected:
+		frame.State = "waiting_client"
+	case r.locked:
+		frame.State = "locked"
+	case !r.hasDevice():
+		frame.State = "waiting_toy"
+	case reconnecting("controller"):
+		frame.State = "controller_reconnecting"
+	case !r.controllerConnected:
+		frame.State = "waiting_controller"
+	}
+	return frame
+}
+
+// spectatorList returns the room's spectators. Caller must hold r.mu (read or write).
+func (r *Room) spectatorList() []*Client {
+	list := make([]*Client, 0, len(r.spectators))
+	for c := range r.spectators {
+		list = append(list, c)
+	}
+	return list
+}
+
+// dismissSpectators closes every spectator of a room that is being removed.
+func (r *Room) dismissSpectators() {
+	r.mu.RLock()
+	spectators := r.spectatorList()
+	r.mu.RUnlock()
+	for _, c := range spectators {
+		c.closeWith(websocket.CloseNormalClosure, "room closed")
+	}
+}
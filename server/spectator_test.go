@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readSpectatorFrame reads until a spectator frame accepted by match arrives.
+func readSpectatorFrame(t *testing.T, ws *websocket.Conn, match func(SpectatorFrame) bool) SpectatorFrame {
+	t.Helper()
+	var frame SpectatorFrame
+	readUntil(t, ws, 2*time.Second, func(msg map[string]json.RawMessage) bool {
+		if string(msg["type"]) != `"spectate"` {
+			return false
+		}
+		data, _ := json.Marshal(msg)
+		frame = SpectatorFrame{}
+		return json.Unmarshal(data, &frame) == nil && match(frame)
+	})
+	return frame
+}
+
+func TestSpectatorNeedsExistingRoom(t *testing.T) {
+	srv := newTestServer(t)
+	spectator := dial(t, srv, "type=spectator&key=nobody-here")
+	if code := waitClose(t, spectator); code != closeRoomNotFound {
+		t.Fatalf("closed with %d, want %d", code, closeRoomNotFound)
+	}
+	if lookupRoom("nobody-here") != nil {
+		t.Fatal("a spectator created a room")
+	}
+}
+
+func TestSpectatorWatchesRoom(t *testing.T) {
+	srv := newTestServer(t)
+	client := dial(t, srv, "type=client&key=spectate")
+	if err := client.WriteJSON(MessageFromClient{Type: "deviceList", Devices: []DeviceInfo{{Index: 0, LinearCount: 1}}}); err != nil {
+		t.Fatalf("send device list: %v", err)
+	}
+	waitStatus(t, client, "waiting_controller")
+
+	spectator := dial(t, srv, "type=spectator&key=spectate")
+	readUntil(t, spectator, 2*time.Second, func(msg map[string]json.RawMessage) bool { return string(msg["type"]) == `"devices"` })
+	readSpectatorFrame(t, spectator, func(f SpectatorFrame) bool { return f.State == "waiting_controller" })
+
+	controller := dial(t, srv, "type=controller&key=spectate")
+	waitStatus(t, controller, "ready")
+	if err := controller.WriteJSON(ControlMessage{Type: "control", Position: 0.6, SampleIntervalMs: 100}); err != nil {
+		t.Fatalf("send control: %v", err)
+	}
+	frame := readSpectatorFrame(t, spectator, func(f SpectatorFrame) bool { return f.Positions[0][0] == 0.6 })
+	if frame.State != "ready" || frame.At == 0 {
+		t.Fatalf("got frame %+v, want a timestamped ready frame", frame)
+	}
+
+	// Commands from a spectator are read and dropped; once it has left, all it sent was handled
+	if err := spectator.WriteJSON(ControlMessage{Type: "control", Position: 0.1, SampleIntervalMs: 100}); err != nil {
+		t.Fatalf("send control as spectator: %v", err)
+	}
+	spectator.Close()
+	room := lookupRoom("spectate")
+	eventually(t, 2*time.Second, "the spectator to leave", func() bool {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return len(room.spectators) == 0
+	})
+	room.mu.RLock()
+	position := room.lastCommandedPositions[0][0]
+	room.mu.RUnlock()
+	if position != 0.6 {
+		t.Fatalf("device 0 was commanded to %v after the spectator's control, want 0.6", position)
+	}
+}
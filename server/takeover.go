@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	closeTakeoverDenied = 4403 // The client denied, or did not answer, a takeover request
+	closeRoomOccupied   = 4409 // A controller is connected and the room rejects newcomers
+	closeTakenOver      = 4410 // Sent to a controller that another one replaced
+
+	takeoverTimeout = 30 * time.Second // How long the client has to answer a takeover request
+)
+
+// takeoverPolicies are what may happen when a controller joins a room that already has one:
+// "replace" closes the current controller, "reject" closes the newcomer, "approve" asks the client,
+// and "queue" lets the newcomer wait until the current controller leaves.
+var takeoverPolicies = map[string]bool{"replace": true, "reject": true, "approve": true, "queue": true}
+
+// defaultTakeoverPolicy applies to rooms whose client did not choose a policy.
+var defaultTakeoverPolicy = "replace"
+
+// waitingController is a controller that joined an occupied room and waits for approval or its turn.
+// It stays connected but its commands are ignored.
+type waitingController struct {
+	client    *Client
+	requestID uint64      // Takeover request the client has to answer, 0 when queued
+	timer     *time.Timer // Denies the request if the client does not answer in time
+}
+
+// takeoverPolicy returns the room's takeover policy. Caller must hold r.mu (read or write).
+func (r *Room) takeoverPolicy() string {
+	if r.takeover != "" {
+		return r.takeover
+	}
+	return defaultTakeoverPolicy
+}
+
+// admitController decides whether a controller joining the room takes the
+// controller role now. A connected controller, or a dropped one within its grace period, leaves the
+// newcomer to the takeover policy; a newcomer the policy admits ends the grace period. released
+// reports that it did, and the caller then calls finishRecording once it released r.mu.
+// Caller must hold r.mu.
+func (r *Room) admitController(c *Client) (admitted bool, released bool) {
+	if r.controller == nil && !r.graceHeld("controller") {
+		return true, false
+	}
+	if !r.admitNewController(c) {
+		return false, false
+	}
+	return true, r.takeOverGrace()
+}
+
+// takeOverGrace ends a dropped controller's grace period for the controller that replaces it and
+// reports whether there was one; see admitController. Caller must hold r.mu.
+func (r *Room) takeOverGrace() bool {
+	if !r.cancelGrace("controller") {
+		return false
+	}
+	log.Printf("Key %s: New controller takes the place of the dropped one", r.key)
+	r.releaseRoleLocked("controller")
+	return true
+}
+
+// admitNewController applies the takeover policy to a controller joining while another one is
+// connected or within its grace period. It reports whether the newcomer should take over right
+// away; otherwise the newcomer waits or has been closed. Caller must hold r.mu.
+func (r *Room) admitNewController(c *Client) bool {
+	switch r.takeoverPolicy() {
+	case "reject":
+		log.Printf("Key %s: Rejecting new controller, the room already has one", r.key)
+		c.closeWith(closeRoomOccupied, "another controller is connected")
+		return false
+
+	case "approve":
+		if r.client == nil {
+			log.Printf("Key %s: Rejecting new controller, no client to approve the takeover", r.key)
+			c.closeWith(closeTakeoverDenied, "no client to approve the takeover")
+			return false
+		}
+		r.takeoverSeq++
+		requestID := r.takeoverSeq
+		r.waiting = append(r.waiting, &waitingController{
+			client:    c,
+			requestID: requestID,
+			timer:     time.AfterFunc(takeoverTimeout, func() { r.decideTakeover(requestID, false, "takeover request timed out") }),
+		})
+		log.Printf("Key %s: New controller asks to take over (request %d)", r.key, requestID)
+		r.sendStatusUpdate(c, "takeover_pending", "")
+		r.sendMessage(r.client, StatusUpdateMessage{Type: "status", State: "takeover_request", RequestID: requestID}, "takeover request")
+		return false
+
+	case "queue":
+		r.waiting = append(r.waiting, &waitingController{client: c})
+		log.Printf("Key %s: New controller queued (%d waiting)", r.key, len(r.waiting))
+		r.notifyQueueLocked()
+		return false
+
+	default: // "replace"
+		log.Printf("Key %s: Replacing existing controller connection", r.key)
+		// Don't send disconnect to client here, the old controller's defer will handle it if needed
+		if r.controller != nil {
+			r.controller.closeWith(closeTakenOver, "replaced by a new controller")
+		}
+		return true
+	}
+}
+
+// decideTakeover applies the client's answer to a takeover request. An approved newcomer replaces
+// the current controller, a denied one is closed.
+func (r *Room) decideTakeover(requestID uint64, approve bool, reason string) {
+	r.mu.Lock()
+	released := r.decideTakeoverLocked(requestID, approve, reason)
+	r.mu.Unlock()
+	if released {
+		r.finishRecording()
+	}
+}
+
+// decideTakeoverLocked is decideTakeover under the room lock. It reports whether the approved
+// newcomer ended a dropped controller's grace period. Caller must hold r.mu.
+func (r *Room) decideTakeoverLocked(requestID uint64, approve bool, reason string) bool {
+	var candidate *waitingController
+	for i, w := range r.waiting {
+		if w.requestID != 0 && w.requestID == requestID {
+			candidate = w
+			r.waiting = append(r.waiting[:i], r.waiting[i+1:]...)
+			break
+		}
+	}
+	if candidate == nil {
+		return false // Already decided, or the newcomer left
+	}
+	candidate.timer.Stop()
+	r.notifyQueueLocked()
+
+	if !approve {
+		log.Printf("Key %s: Takeover request %d denied: %s", r.key, requestID, reason)
+		candidate.client.closeWith(closeTakeoverDenied, reason)
+		r.sendMessage(r.client, StatusUpdateMessage{Type: "status", State: "takeover_cancelled", RequestID: requestID}, "takeover cancellation")
+		return false
+	}
+	log.Printf("Key %s: Takeover request %d approved", r.key, requestID)
+	if r.controller != nil {
+		r.controller.closeWith(closeTakenOver, "replaced by a controller the client approved")
+	}
+	released := r.takeOverGrace()
+	r.registerController(candidate.client, false)
+	return released
+}
+
+// nextWaitingController removes and returns the controller that has waited longest, nil if none.
+// Caller must hold r.mu.
+func (r *Room) nextWaitingController() *Client {
+	if len(r.waiting) == 0 {
+		return nil
+	}
+	next := r.waiting[0]
+	r.waiting = r.waiting[1:]
+	r.withdrawLocked(next)
+	r.notifyQueueLocked()
+	return next.client
+}
+
+// removeWaitingController forgets a waiting controller that disconnected and reports whether it was
+// waiting. Caller must hold r.mu.
+func (r *Room) removeWaitingController(c *Client) bool {
+	for i, w := range r.waiting {
+		if w.client == c {
+			r.withdrawLocked(w)
+			r.waiting = append(r.waiting[:i], r.waiting[i+1:]...)
+			r.notifyQueueLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// withdrawLocked cancels the takeover request of a controller that leaves the waiting list without
+// the client's answer, so the client can stop asking. Caller must hold r.mu.
+func (r *Room) withdrawLocked(w *waitingController) {
+	if w.timer == nil {
+		return
+	}
+	w.timer.Stop()
+	r.sendMessage(r.client, StatusUpdateMessage{Type: "status", State: "takeover_cancelled", RequestID: w.requestID}, "takeover cancellation")
+}
+
+// isWaitingController reports whether c waits for approval or its turn. Caller must hold r.mu (read or write).
+func (r *Room) isWaitingController(c *Client) bool {
+	for _, w := range r.waiting {
+		if w.client == c {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyQueueLocked tells every queued controller its place in line. Caller must hold r.mu.
+func (r *Room) notifyQueueLocked() {
+	position := 0
+	for _, w := range r.waiting {
+		if w.requestID != 0 {
+			continue // Waiting for the client's answer, not in line
+		}
+		position++
+		r.sendMessage(w.client, StatusUpdateMessage{Type: "status", State: "controller_queued", QueuePosition: position}, "queue position")
+	}
+}
+
+// promoteController lets a waiting controller take over after the previous one left.
+func (r *Room) promoteController(c *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.controller != nil {
+		// Another controller got in first, c stays first in line
+		r.waiting = append([]*waitingController{{client: c}}, r.waiting...)
+		r.notifyQueueLocked()
+		return
+	}
+	log.Printf("Key %s: Waiting controller takes over", r.key)
+	r.registerController(c, false)
+}
+
+// setTakeoverPolicy changes the room's takeover policy at the client's request.
+func (r *Room) setTakeoverPolicy(client *Client, policy string) {
+	if !takeoverPolicies[policy] {
+		r.sendStatusUpdate(client, "takeover_policy_invalid", fmt.Sprintf("unknown takeover policy %q", policy))
+		return
+	}
+	r.mu.Lock()
+	r.takeover = policy
+	r.mu.Unlock()
+
+	log.Printf("Key %s: Client set takeover policy %q", r.key, policy)
+	r.sendStatusUpdate(client, "takeover_policy", policy)
+}
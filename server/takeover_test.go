@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"server/buttplugsim"
+
+	"github.com/gorilla/websocket"
+)
+
+// droppedController joins key as controller and drops the connection, leaving its place in grace.
+// It returns the controller's resume token.
+func droppedController(t *testing.T, srv string, key string) string {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(srv+"type=controller&key="+key, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	token := waitSession(t, ws).ResumeToken
+	ws.Close()
+	room := lookupRoom(key)
+	eventually(t, 2*time.Second, "the controller's grace period", func() bool {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return room.controller == nil && room.graceHeld("controller")
+	})
+	return token
+}
+
+func TestTakeoverPolicyAppliesDuringGrace(t *testing.T) {
+	srv := newTestServer(t)
+	base := wsURL(srv, "")
+
+	t.Run("reject", func(t *testing.T) {
+		room := addRoom(t, "grace-reject", "")
+		room.takeover = "reject"
+		token := droppedController(t, base, "grace-reject")
+
+		newcomer := dial(t, srv, "type=controller&key=grace-reject")
+		if code := waitClose(t, newcomer); code != closeRoomOccupied {
+			t.Fatalf("newcomer closed with %d, want %d", code, closeRoomOccupied)
+		}
+
+		resumed := dial(t, srv, "type=controller&key=grace-reject&resume="+url.QueryEscape(token))
+		if session := waitSession(t, resumed); !session.Resumed {
+			t.Fatal("the dropped controller could not resume after a rejected newcomer")
+		}
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		room := addRoom(t, "grace-queue", "")
+		room.takeover = "queue"
+		droppedController(t, base, "grace-queue")
+
+		newcomer := dial(t, srv, "type=controller&key=grace-queue")
+		waitStatus(t, newcomer, "controller_queued")
+		room.mu.RLock()
+		held := room.graceHeld("controller")
+		room.mu.RUnlock()
+		if !held {
+			t.Fatal("a queued newcomer ended the grace period")
+		}
+
+		// Once the grace period runs out, the queued controller takes over
+		if session := waitSession(t, newcomer); session.Resumed {
+			t.Fatal("the queued controller resumed the dropped one's session")
+		}
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		if room.controller == nil || len(room.waiting) != 0 {
+			t.Fatalf("after the grace period: controller=%v, %d waiting", room.controller != nil, len(room.waiting))
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		room := addRoom(t, "grace-replace", "")
+		room.takeover = "replace"
+		token := droppedController(t, base, "grace-replace")
+
+		newcomer := dial(t, srv, "type=controller&key=grace-replace")
+		waitSession(t, newcomer)
+		room.mu.RLock()
+		held := room.graceHeld("controller")
+		room.mu.RUnlock()
+		if held {
+			t.Fatal("the newcomer took over, but the dropped controller's place is still held")
+		}
+
+		late := dial(t, srv, "type=controller&key=grace-replace&resume="+url.QueryEscape(token))
+		if session := waitSession(t, late); session.Resumed {
+			t.Fatal("the dropped controller resumed a place that was taken over")
+		}
+	})
+}
+
+func TestTakeoverPolicies(t *testing.T) {
+	srv := newTestServer(t)
+
+	t.Run("replace", func(t *testing.T) {
+		addRoom(t, "policy-replace", "").takeover = "replace"
+		first := dial(t, srv, "type=controller&key=policy-replace")
+		waitStatus(t, first, "waiting_client")
+		second := dial(t, srv, "type=controller&key=policy-replace")
+		waitStatus(t, second, "waiting_client")
+		if code := waitClose(t, first); code != closeTakenOver {
+			t.Fatalf("replaced controller closed with %d, want %d", code, closeTakenOver)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		addRoom(t, "policy-reject", "").takeover = "reject"
+		first := dial(t, srv, "type=controller&key=policy-reject")
+		waitStatus(t, first, "waiting_client")
+		if code := waitClose(t, dial(t, srv, "type=controller&key=policy-reject")); code != closeRoomOccupied {
+			t.Fatalf("newcomer closed with %d, want %d", code, closeRoomOccupied)
+		}
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		room := addRoom(t, "policy-queue", "")
+		room.takeover = "queue"
+		first := dial(t, srv, "type=controller&key=policy-queue")
+		waitStatus(t, first, "waiting_client")
+		second := dial(t, srv, "type=controller&key=policy-queue")
+		if position := waitStatus(t, second, "controller_queued")["queuePosition"]; string(position) != "1" {
+			t.Fatalf("queue position %s, want 1", position)
+		}
+
+		first.Close()
+		waitStatus(t, second, "waiting_client") // Promoted without waiting for a grace period
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		if len(room.waiting) != 0 || room.graceHeld("controller") {
+			t.Fatalf("after the promotion: %d waiting, grace held %v", len(room.waiting), room.graceHeld("controller"))
+		}
+	})
+
+	t.Run("approve", func(t *testing.T) {
+		client := dial(t, srv, "type=client&key=policy-approve")
+		client.WriteJSON(MessageFromClient{Type: "takeoverPolicy", Policy: "approve"})
+		waitStatus(t, client, "takeover_policy")
+		first := dial(t, srv, "type=controller&key=policy-approve")
+		waitStatus(t, first, "waiting_toy")
+
+		// takeoverRequest has the client answer the next takeover request
+		takeoverRequest := func(approve bool) *websocket.Conn {
+			t.Helper()
+			newcomer := dial(t, srv, "type=controller&key=policy-approve")
+			waitStatus(t, newcomer, "takeover_pending")
+			var requestID uint64
+			json.Unmarshal(waitStatus(t, client, "takeover_request")["requestId"], &requestID)
+			client.WriteJSON(MessageFromClient{Type: "takeoverDecision", RequestID: requestID, Approve: approve})
+			return newcomer
+		}
+
+		if code := waitClose(t, takeoverRequest(false)); code != closeTakeoverDenied {
+			t.Fatalf("denied newcomer closed with %d, want %d", code, closeTakeoverDenied)
+		}
+		approved := takeoverRequest(true)
+		if code := waitClose(t, first); code != closeTakenOver {
+			t.Fatalf("replaced controller closed with %d, want %d", code, closeTakenOver)
+		}
+		waitStatus(t, approved, "waiting_toy")
+	})
+}
+
+// startBridge runs a bridge with one simulated stroker as the client of key.
+func startBridge(t *testing.T, srv *httptest.Server, key string, approveTakeover bool) {
+	t.Helper()
+	sim := buttplugsim.NewServer("Test Intiface")
+	sim.Logf = func(string, ...interface{}) {}
+	sim.AddDevice(buttplugsim.DeviceConfig{Name: "Stroker", Linear: 1})
+	intiface := httptest.NewServer(sim)
+	t.Cleanup(intiface.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	b := &bridge{
+		serverURL:   wsURL(srv, "type=client&key="+key),
+		intifaceURL: "ws" + strings.TrimPrefix(intiface.URL, "http"),
+		takeover:    approveTakeover,
+		devices:     make(map[uint32]ButtplugDevice),
+		nextID:      2,
+		resume:      new(atomic.Pointer[string]),
+	}
+	go func() { done <- b.run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestBridgeAnswersTakeoverRequests(t *testing.T) {
+	srv := newTestServer(t)
+	for _, approve := range []bool{false, true} {
+		key := fmt.Sprintf("bridge-takeover-%v", approve)
+		addRoom(t, key, "").takeover = "approve"
+		startBridge(t, srv, key, approve)
+		first := dial(t, srv, "type=controller&key="+key)
+		waitStatus(t, first, "ready")
+
+		newcomer := dial(t, srv, "type=controller&key="+key)
+		waitStatus(t, newcomer, "takeover_pending")
+		if approve {
+			if code := waitClose(t, first); code != closeTakenOver {
+				t.Fatalf("--takeover approve: current controller closed with %d, want %d", code, closeTakenOver)
+			}
+			waitStatus(t, newcomer, "ready")
+		} else if code := waitClose(t, newcomer); code != closeTakeoverDenied {
+			t.Fatalf("--takeover deny: newcomer closed with %d, want %d", code, closeTakeoverDenied)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	planStep           = 5 * time.Millisecond // Granularity of planned durations
+	maxPlannedDuration = 2 * time.Second      // A planner never stretches a single move beyond this
+	defaultPlannerName = "limits"
+)
+
+// MotionLimits are the physical limits of a device's linear axes, in position units (0.0 - 1.0) per second.
+// Zero values are not enforced.
+type MotionLimits struct {
+	Planner         string  `json:"planner,omitempty"`         // Trajectory planner name, defaults to "limits"
+	MaxVelocity     float64 `json:"maxVelocity,omitempty"`     // units/s (full speed is 5.0)
+	MaxAcceleration float64 `json:"maxAcceleration,omitempty"` // units/s²
+	MaxJerk         float64 `json:"maxJerk,omitempty"`         // units/s³
+}
+
+// TrajectoryPlanner shapes consecutive linear moves of one device. Plan is called for every axis
+// of every LinearCmd with the target position and the duration computed so far, and returns the
+// duration to actually use. Implementations keep their own per-axis motion state and must be
+// safe for concurrent use.
+type TrajectoryPlanner interface {
+	Plan(axis uint32, target float64, duration time.Duration, now time.Time) time.Duration
+}
+
+// trajectoryPlanners maps planner names to constructors, so other planners can be plugged in.
+var trajectoryPlanners = map[string]func(MotionLimits) TrajectoryPlanner{
+	defaultPlannerName: newLimitedPlanner,
+}
+
+// newTrajectoryPlanner builds the planner selected by limits.
+func newTrajectoryPlanner(limits MotionLimits) (TrajectoryPlanner, error) {
+	if limits.MaxVelocity < 0 || limits.MaxAcceleration < 0 || limits.MaxJerk < 0 {
+		return nil, fmt.Errorf("motion limits must not be negative")
+	}
+	name := limits.Planner
+	if name == "" {
+		name = defaultPlannerName
+	}
+	constructor, ok := trajectoryPlanners[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown trajectory planner %q", name)
+	}
+	return constructor(limits), nil
+}
+
+// axisMotion is the move an axis was last commanded to make, with constant velocity as LinearCmd does.
+type axisMotion struct {
+	from, to float64
+	start    time.Time
+	duration time.Duration
+	accel    float64 // Velocity change per second implied when the move started
+}
+
+// at returns the estimated position and velocity of the axis at time t.
+func (m axisMotion) at(t time.Time) (float64, float64) {
+	elapsed := t.Sub(m.start)
+	if m.duration <= 0 || elapsed >= m.duration {
+		return m.to, 0 // Arrived and resting
+	}
+	progress := float64(elapsed) / float64(m.duration)
+	return m.from + (m.to-m.from)*progress, (m.to - m.from) / m.duration.Seconds()
+}
+
+// limitedPlanner lengthens moves until the velocity, acceleration and jerk they imply, relative to
+// where the axis is estimated to be right now, stay within the device's limits. Abrupt reversals
+// and starts from rest are slowed down instead of being sent at full speed.
+type limitedPlanner struct {
+	limits MotionLimits
+
+	mu   sync.Mutex
+	axes map[uint32]axisMotion
+}
+
+func newLimitedPlanner(limits MotionLimits) TrajectoryPlanner {
+	return &limitedPlanner{limits: limits, axes: make(map[uint32]axisMotion)}
+}
+
+// feasible reports whether moving by distance over d respects the limits, starting at velocity
+// and acceleration.
+func (p *limitedPlanner) feasible(distance float64, d time.Duration, velocity, accel float64) bool {
+	t := d.Seconds()
+	v := distance / t
+	if p.limits.MaxVelocity > 0 && math.Abs(v) > p.limits.MaxVelocity {
+		return false
+	}
+	a := (v - velocity) / t
+	if p.limits.MaxAcceleration > 0 && math.Abs(a) > p.limits.MaxAcceleration {
+		return false
+	}
+	if p.limits.MaxJerk > 0 && math.Abs(a-accel)/t > p.limits.MaxJerk {
+		return false
+	}
+	return true
+}
+
+func (p *limitedPlanner) Plan(axis uint32, target float64, duration time.Duration, now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	prev, known := p.axes[axis]
+	if !known {
+		// Nothing is known about where the axis is; record the move and shape the following ones
+		p.axes[axis] = axisMotion{from: target, to: target, start: now, duration: duration}
+		return duration
+	}
+
+	pos, velocity := prev.at(now)
+	accel := 0.0
+	if velocity != 0 {
+		accel = prev.accel
+	}
+	distance := target - pos
+
+	planned := max(duration, planStep)
+	for planned < maxPlannedDuration && !p.feasible(distance, planned, velocity, accel) {
+		planned += planStep
+	}
+	if planned > duration {
+		log.Printf("Trajectory planner: axis %d move to %.3f lengthened from %v to %v (v=%.2f, a=%.2f)", axis, target, duration, planned, velocity, accel)
+	}
+
+	p.axes[axis] = axisMotion{
+		from:     pos,
+		to:       target,
+		start:    now,
+		duration: planned,
+		accel:    (distance/planned.Seconds() - velocity) / planned.Seconds(),
+	}
+	return planned
+}
+
+// updatePlanners keeps one planner per device with motion limits, preserving the motion state of
+// devices whose limits did not change. Caller must hold r.mu.
+func (r *Room) updatePlanners() {
+	planners := make(map[uint32]TrajectoryPlanner)
+	for index, device := range r.devices {
+		if device.Limits == nil || device.LinearCount == 0 {
+			continue
+		}
+		if existing, ok := r.planners[index]; ok && r.plannerLimits[index] == *device.Limits {
+			planners[index] = existing
+			continue
+		}
+		planner, err := newTrajectoryPlanner(*device.Limits)
+		if err != nil {
+			log.Printf("Key %s: Ignoring motion limits of device %d: %v", r.key, index, err)
+			continue
+		}
+		log.Printf("Key %s: Device %d uses trajectory planner with limits %+v", r.key, index, *device.Limits)
+		planners[index] = planner
+	}
+
+	r.planners = planners
+	r.plannerLimits = make(map[uint32]MotionLimits, len(planners))
+	for index := range planners {
+		r.plannerLimits[index] = *r.devices[index].Limits
+	}
+}
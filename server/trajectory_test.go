@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestLimitedPlannerVelocity(t *testing.T) {
+	planner := newLimitedPlanner(MotionLimits{MaxVelocity: 1})
+	now := time.Now()
+	if d := planner.Plan(0, 0.5, 100*time.Millisecond, now); d != 100*time.Millisecond {
+		t.Fatalf("first move planned at %v, want it unchanged", d)
+	}
+
+	// 0.5 units at 1 unit/s take at least 500ms
+	now = now.Add(time.Second)
+	if d := planner.Plan(0, 1, 100*time.Millisecond, now); d < 500*time.Millisecond || d > 500*time.Millisecond+planStep {
+		t.Fatalf("move planned at %v, want 500ms", d)
+	}
+
+	// A slow enough move is left alone
+	now = now.Add(time.Second)
+	if d := planner.Plan(0, 0.9, 200*time.Millisecond, now); d != 200*time.Millisecond {
+		t.Fatalf("slow move planned at %v, want 200ms", d)
+	}
+}
+
+func TestLimitedPlannerSoftensReversal(t *testing.T) {
+	limits := MotionLimits{MaxAcceleration: 20}
+	now := time.Now()
+
+	// From rest, 0.2 units need d/t² <= 20: at least 100ms
+	rest := newLimitedPlanner(limits)
+	rest.Plan(0, 0.5, 100*time.Millisecond, now)
+	fromRest := rest.Plan(0, 0.3, 50*time.Millisecond, now.Add(time.Second))
+	if fromRest < 100*time.Millisecond {
+		t.Fatalf("move from rest planned at %v, want at least 100ms", fromRest)
+	}
+
+	// The same move right after heading the other way has to brake first
+	moving := newLimitedPlanner(limits)
+	moving.Plan(0, 0.5, 100*time.Millisecond, now)
+	moving.Plan(0, 0.9, 300*time.Millisecond, now.Add(time.Second))
+	reversal := moving.Plan(0, 0.3, 50*time.Millisecond, now.Add(time.Second+100*time.Millisecond))
+	if reversal <= fromRest {
+		t.Fatalf("reversal planned at %v, want longer than %v from rest", reversal, fromRest)
+	}
+
+	// Nothing is stretched beyond maxPlannedDuration
+	tight := newLimitedPlanner(MotionLimits{MaxVelocity: 0.01})
+	tight.Plan(0, 0, 100*time.Millisecond, now)
+	if d := tight.Plan(0, 1, 100*time.Millisecond, now.Add(time.Second)); d != maxPlannedDuration {
+		t.Fatalf("move planned at %v, want the %v cap", d, maxPlannedDuration)
+	}
+}
+
+func TestNewTrajectoryPlanner(t *testing.T) {
+	if _, err := newTrajectoryPlanner(MotionLimits{MaxVelocity: 2}); err != nil {
+		t.Fatalf("default planner: %v", err)
+	}
+	if _, err := newTrajectoryPlanner(MotionLimits{Planner: "magic"}); err == nil {
+		t.Fatal("an unknown planner was accepted")
+	}
+	if _, err := newTrajectoryPlanner(MotionLimits{MaxJerk: -1}); err == nil {
+		t.Fatal("negative limits were accepted")
+	}
+}
+
+func TestRoomPlanners(t *testing.T) {
+	room := newTestRoom("planners")
+	limits := &MotionLimits{MaxVelocity: 2}
+	room.setDeviceList([]DeviceInfo{
+		{Index: 0, LinearCount: 1, Limits: limits},
+		{Index: 1, LinearCount: 1},
+		{Index: 2, VibrateCount: 1, Limits: limits}, // Nothing linear to plan
+	})
+	if len(room.planners) != 1 || room.planners[0] == nil {
+		t.Fatalf("planners for %v, want device 0 only", room.planners)
+	}
+	planner := room.planners[0]
+
+	// The motion state survives a device list with the same limits
+	room.setDeviceList([]DeviceInfo{{Index: 0, LinearCount: 1, Limits: &MotionLimits{MaxVelocity: 2}}})
+	if room.planners[0] != planner {
+		t.Fatal("the planner was rebuilt although its limits did not change")
+	}
+	room.setDeviceList([]DeviceInfo{{Index: 0, LinearCount: 1, Limits: &MotionLimits{MaxVelocity: 1}}})
+	if room.planners[0] == planner {
+		t.Fatal("the planner was kept although its limits changed")
+	}
+
+	// Planned moves may exceed the usual 120ms cap
+	room.planners[0].Plan(0, 0, 100*time.Millisecond, time.Now())
+	data, err := constructLinearCmd(1, 0, []AxisCommand{{Index: 0, Position: 1, Speed: 1}}, 100, 0, map[uint32]float64{0: 0}, false, 0, room.planners[0])
+	if err != nil {
+		t.Fatalf("construct: %v", err)
+	}
+	var messages []map[string]ButtplugLinearCmd
+	if err := json.Unmarshal(data, &messages); err != nil {
+		t.Fatalf("decode %s: %v", data, err)
+	}
+	if d := messages[0]["LinearCmd"].Vectors[0].Duration; d < 1000 {
+		t.Fatalf("full stroke at 1 unit/s lasts %dms, want at least 1000ms", d)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// watchdogTimeout is the server-wide gap without motion commands after which a room's devices are stopped.
+// 0 disables the gap check; a client's safety profile can set its own value with watchdogMs.
+var watchdogTimeout time.Duration
+
+// restSpeed is the speed used to bring a stroker back to the profile's rest position.
+const restSpeed = 0.1
+
+// watchdogState tracks controller motion for the dead-man watchdog of a room.
+type watchdogState struct {
+	timer      *time.Timer
+	lastMotion time.Time // Last motion command forwarded to the client
+	active     bool      // Devices may be moving; cleared once they have been stopped
+}
+
+// watchdogGap returns the room's watchdog gap, preferring the client's safety profile. Caller must hold r.mu.
+func (r *Room) watchdogGap() time.Duration {
+	if r.safety.profile != nil && r.safety.profile.WatchdogMs > 0 {
+		return time.Duration(r.safety.profile.WatchdogMs) * time.Millisecond
+	}
+	return watchdogTimeout
+}
+
+// feedWatchdog records that a motion command was just forwarded and re-arms the watchdog.
+// A "stop" disarms it since the devices are already at rest. Caller must hold r.mu.
+func (r *Room) feedWatchdog(msgType string) {
+	if msgType == "stop" {
+		r.disarmWatchdog()
+		return
+	}
+	r.watchdog.lastMotion = time.Now()
+	r.watchdog.active = true
+
+	gap := r.watchdogGap()
+	if gap <= 0 {
+		return // Only controller disconnects trigger a stop
+	}
+	if r.watchdog.timer == nil {
+		r.watchdog.timer = time.AfterFunc(gap, r.watchdogExpired)
+	} else {
+		r.watchdog.timer.Reset(gap)
+	}
+}
+
+// disarmWatchdog stops the watchdog timer. Caller must hold r.mu.
+func (r *Room) disarmWatchdog() {
+	r.watchdog.active = false
+	if r.watchdog.timer != nil {
+		r.watchdog.timer.Stop()
+	}
+}
+
+// watchdogExpired runs on the watchdog timer. Commands racing with the timer re-arm it, so the
+// gap is checked again under the lock before stopping.
+func (r *Room) watchdogExpired() {
+	r.mu.RLock()
+	gap := r.watchdogGap()
+	stalled := r.watchdog.active && gap > 0 && time.Since(r.watchdog.lastMotion) >= gap
+	r.mu.RUnlock()
+
+	if stalled {
+		r.safeStop("watchdog_stop", "no controller input for "+gap.String())
+	}
+}
+
+// safeStop brings every device of the room to rest if motion may still be in progress, either by
+// returning strokers to the profile's rest position or with a StopDeviceCmd, and notifies both parties.
+func (r *Room) safeStop(state string, reason string) {
+	r.mu.Lock()
+	if !r.watchdog.active {
+		r.mu.Unlock()
+		return
+	}
+	r.disarmWatchdog()
+	beikongduan := r.client
+	controllers := r.controllerTargets()
+	var restPosition *float64
+	if r.safety.profile != nil {
+		restPosition = r.safety.profile.RestPosition
+	}
+
+	type restCommand struct {
+		id     uint
+		device uint32
+		json   []byte
+	}
+	commands := make([]restCommand, 0, len(r.devices))
+	for _, index := range r.sortedDeviceIndices() {
+		device := r.devices[index]
+		var cmdJSON []byte
+		var err error
+		commandID := r.commands.allocate()
+		if restPosition != nil && device.LinearCount > 0 && device.VibrateCount == 0 && device.RotateCount == 0 {
+			axes := make([]AxisCommand, device.LinearCount)
+			for i := range axes {
+				axes[i] = AxisCommand{Index: uint32(i), Position: *restPosition, Speed: restSpeed}
+			}
+			cmdJSON, err = constructLinearCmd(commandID, index, axes, 0, 0, r.axisPositions(index), true, restSpeed, r.planners[index])
+			if err == nil {
+				r.setAxisPositions(index, axes)
+			}
+		} else {
+			cmdJSON, err = constructStopCmd(commandID, index)
+		}
+		if err != nil {
+			log.Printf("Key %s: Error constructing %s command for DeviceIndex %d: %v", r.key, state, index, err)
+			continue
+		}
+		commands = append(commands, restCommand{id: commandID, device: index, json: cmdJSON})
+	}
+	r.mu.Unlock()
+
+	log.Printf("Key %s: Dead-man watchdog: %s, bringing %d device(s) to rest", r.key, reason, len(commands))
+	if beikongduan != nil {
+		for _, command := range commands {
+			if !r.sendCommand(beikongduan, command.id, command.device, command.json) {
+				log.Printf("Key %s: Watchdog command dropped: Client send buffer full", r.key)
+			}
+		}
+	}
+	for _, controller := range controllers {
+		r.sendPriorityStatusUpdate(controller, state, reason)
+	}
+	r.sendPriorityStatusUpdate(beikongduan, state, reason)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// joinWatchdogRoom connects a client with one stroker and profile, and a controller that is ready to drive it.
+func joinWatchdogRoom(t *testing.T, key string, profile *SafetyProfile) (client, controller *websocket.Conn) {
+	t.Helper()
+	srv := newTestServer(t)
+	client = dial(t, srv, "type=client&key="+key)
+	if err := client.WriteJSON(MessageFromClient{Type: "deviceList", Devices: []DeviceInfo{{Index: 0, LinearCount: 1}}}); err != nil {
+		t.Fatalf("send device list: %v", err)
+	}
+	if profile != nil {
+		if err := client.WriteJSON(MessageFromClient{Type: "safetyProfile", Profile: profile}); err != nil {
+			t.Fatalf("send profile: %v", err)
+		}
+		readUntil(t, client, 2*time.Second, func(msg map[string]json.RawMessage) bool { return string(msg["type"]) == `"safety"` })
+	}
+	controller = dial(t, srv, "type=controller&key="+key)
+	waitStatus(t, controller, "ready")
+	return client, controller
+}
+
+// readLinearCmd reads until the client is sent a LinearCmd and returns it.
+func readLinearCmd(t *testing.T, client *websocket.Conn) ButtplugLinearCmd {
+	t.Helper()
+	msg := readUntil(t, client, 2*time.Second, func(msg map[string]json.RawMessage) bool { return msg["LinearCmd"] != nil })
+	var cmd ButtplugLinearCmd
+	if err := json.Unmarshal(msg["LinearCmd"], &cmd); err != nil {
+		t.Fatalf("decode LinearCmd: %v", err)
+	}
+	return cmd
+}
+
+func TestWatchdogStopsOnControllerDisconnect(t *testing.T) {
+	client, controller := joinWatchdogRoom(t, "watchdog-disconnect", nil)
+	if err := controller.WriteJSON(ControlMessage{Type: "control", Position: 0.8, Speed: 0.5}); err != nil {
+		t.Fatalf("send control: %v", err)
+	}
+	readLinearCmd(t, client)
+
+	controller.Close()
+	readUntil(t, client, 2*time.Second, func(msg map[string]json.RawMessage) bool { return msg["StopDeviceCmd"] != nil })
+	waitStatus(t, client, "watchdog_stop")
+}
+
+func TestWatchdogReturnsToRestAfterGap(t *testing.T) {
+	rest := 0.1
+	client, controller := joinWatchdogRoom(t, "watchdog-gap", &SafetyProfile{WatchdogMs: 50, RestPosition: &rest})
+	if err := controller.WriteJSON(ControlMessage{Type: "control", Position: 0.8, Speed: 0.5}); err != nil {
+		t.Fatalf("send control: %v", err)
+	}
+	if cmd := readLinearCmd(t, client); cmd.Vectors[0].Position != 0.8 {
+		t.Fatalf("moved to %v, want 0.8", cmd.Vectors[0].Position)
+	}
+
+	// No input for longer than watchdogMs: the stroker is sent to the rest position at rest speed
+	cmd := readLinearCmd(t, client)
+	if cmd.Vectors[0].Position != rest || cmd.Vectors[0].Duration < 1000 {
+		t.Fatalf("watchdog sent %+v, want a slow move to %v", cmd.Vectors[0], rest)
+	}
+	waitStatus(t, controller, "watchdog_stop")
+
+	room := lookupRoom("watchdog-gap")
+	room.mu.RLock()
+	active := room.watchdog.active
+	room.mu.RUnlock()
+	if active {
+		t.Fatal("the watchdog is still armed after stopping the devices")
+	}
+
+	controller.Close()
+	eventually(t, 2*time.Second, "the controller to leave", func() bool {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return !room.controllerConnected
+	})
+}
+
+func TestWatchdogDisarmedByStop(t *testing.T) {
+	room := newTestRoom("watchdog-stop")
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	room.feedWatchdog("control")
+	if !room.watchdog.active {
+		t.Fatal("motion did not arm the watchdog")
+	}
+	room.feedWatchdog("stop")
+	if room.watchdog.active {
+		t.Fatal("a stop left the watchdog armed")
+	}
+}